@@ -0,0 +1,149 @@
+package tetris
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// codecEnv is the name of the environment variable a client sets to ask for a codec
+const codecEnv = "TETRIS_CODEC"
+
+// Codec marshals messages into packet payloads
+type Codec interface {
+	// Name is the identifier negotiated between client and server
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var codecs = make(map[string]Codec)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(GobCodec{})
+	RegisterCodec(BinaryCodec{})
+}
+
+// RegisterCodec makes a codec available for negotiation under its name.
+// It is not safe for concurrent use and is meant to be called from init functions.
+func RegisterCodec(c Codec) {
+	codecs[c.Name()] = c
+}
+
+// GetCodec returns the codec registered with the name
+func GetCodec(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// DefaultCodec is used by sessions that did not negotiate a codec
+var DefaultCodec Codec = JSONCodec{}
+
+type codecKey struct{}
+
+// CodecFromContext returns the codec negotiated by the session a unary handler serves, DefaultCodec if none
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok {
+		return c
+	}
+	return DefaultCodec
+}
+
+func contextWithCodec(ctx context.Context, c Codec) context.Context {
+	return context.WithValue(ctx, codecKey{}, c)
+}
+
+// JSONCodec encodes messages with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes messages with encoding/gob. Every message carries its own type information.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinaryCodec is a compact codec. Messages implementing encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler encode themselves, others must be fixed-size values accepted by encoding/binary.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, v)
+}
+
+func marshalPacket(c Codec, v interface{}) (*Packet, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to marshal with %s codec: %w", c.Name(), err)
+	}
+	return &Packet{Data: data}, nil
+}
+
+func unmarshalPacket(c Codec, p *Packet, v interface{}) error {
+	defer p.Release()
+	if err := c.Unmarshal(p.Data, v); err != nil {
+		return xerrors.Errorf("failed to unmarshal with %s codec: %w", c.Name(), err)
+	}
+	return nil
+}
+
+// parseEnvRequest parses the payload of an "env" channel request
+func parseEnvRequest(payload []byte) (name, value string, err error) {
+	var msg struct {
+		Name  string
+		Value string
+	}
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", "", xerrors.Errorf("failed to parse env request: %w", err)
+	}
+	return msg.Name, msg.Value, nil
+}
@@ -0,0 +1,128 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+type testMove struct {
+	X, Y     int32
+	Rotation uint8
+}
+
+func TestCodec_MarshalUnmarshal(t *testing.T) {
+	for _, name := range []string{"json", "gob", "binary"} {
+		t.Run(name, func(t *testing.T) {
+			c, ok := GetCodec(name)
+			if !ok {
+				t.Fatalf("codec %s is not registered", name)
+			}
+			want := testMove{X: 3, Y: -1, Rotation: 2}
+			data, err := c.Marshal(&want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got testMove
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, want); diff != "" {
+				t.Errorf("Unmarshal() %s", diff)
+			}
+		})
+	}
+}
+
+func TestBinaryCodec_Size(t *testing.T) {
+	data, err := BinaryCodec{}.Marshal(&testMove{X: 1, Y: 2, Rotation: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 9 {
+		t.Errorf("unexpected size %d", len(data))
+	}
+}
+
+func TestSSHClient_SetCodec(t *testing.T) {
+	addr := "127.0.0.1:31114"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.RegisterHandler("echo", func(ctx context.Context, stream *ServerStream) {
+		if stream.Codec().Name() != "gob" {
+			t.Errorf("unexpected codec %s", stream.Codec().Name())
+		}
+		for {
+			var m testMove
+			err := stream.RecvMsg(&m)
+			switch {
+			case xerrors.Is(err, io.EOF):
+				return
+			case err != nil:
+				t.Error(err)
+				return
+			}
+			m.Rotation++
+			if err := stream.SendMsg(&m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.SetCodec("echo", GobCodec{})
+	sess, err := cli.NewStreamSession(context.Background(), "echo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SendMsg(&testMove{X: 4, Y: 5, Rotation: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var got testMove
+	if err := sess.RecvMsg(&got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, testMove{X: 4, Y: 5, Rotation: 2}); diff != "" {
+		t.Errorf("RecvMsg() %s", diff)
+	}
+
+	cli.SetCodec("unknown", unknownCodec{})
+	if _, err := cli.NewUnarySession("unknown"); err == nil {
+		t.Error("codec unknown to the server must be rejected")
+	}
+}
+
+type unknownCodec struct {
+	JSONCodec
+}
+
+func (unknownCodec) Name() string {
+	return "unknown"
+}
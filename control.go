@@ -0,0 +1,51 @@
+package tetris
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// controlKind is the first byte of the payload of a control frame
+type controlKind byte
+
+const (
+	// controlResumeToken carries the token a client uses to resume the stream, sent by the server
+	controlResumeToken controlKind = iota + 1
+	// controlResume starts a resumed connection, it carries the last data sequence number received
+	controlResume
+	// controlAck acknowledges every data frame up to the carried sequence number
+	controlAck
+	// controlShutdown tells the client that the server is going down, it carries no payload
+	controlShutdown
+)
+
+func newControlPacket(kind controlKind, payload []byte) *Packet {
+	data := make([]byte, 1+len(payload))
+	data[0] = byte(kind)
+	copy(data[1:], payload)
+	return &Packet{
+		Type: FrameControl,
+		Data: data,
+	}
+}
+
+func newSeqControlPacket(kind controlKind, seq uint32) *Packet {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, seq)
+	return newControlPacket(kind, payload)
+}
+
+func parseControl(p *Packet) (controlKind, []byte, error) {
+	if len(p.Data) == 0 {
+		return 0, nil, xerrors.New("empty control frame")
+	}
+	return controlKind(p.Data[0]), p.Data[1:], nil
+}
+
+func parseSeq(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, xerrors.Errorf("invalid sequence number length %d", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
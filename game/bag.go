@@ -0,0 +1,44 @@
+package game
+
+// rng is splitmix64, it is implemented here so that a seed yields the same pieces on every platform and Go version
+type rng struct {
+	state uint64
+}
+
+func (r *rng) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// intn returns a number in [0, n)
+func (r *rng) intn(n int) int {
+	return int(r.next() % uint64(n))
+}
+
+// Bag is the 7-bag randomizer, every seven pieces are the seven tetrominoes in a random order
+type Bag struct {
+	rng    rng
+	pieces []Piece
+}
+
+// NewBag returns a bag dealing the same pieces for the same seed
+func NewBag(seed uint64) *Bag {
+	return &Bag{rng: rng{state: seed}}
+}
+
+// Next deals the next piece
+func (b *Bag) Next() Piece {
+	if len(b.pieces) == 0 {
+		b.pieces = append(b.pieces[:0], Pieces[:]...)
+		for i := len(b.pieces) - 1; i > 0; i-- {
+			j := b.rng.intn(i + 1)
+			b.pieces[i], b.pieces[j] = b.pieces[j], b.pieces[i]
+		}
+	}
+	p := b.pieces[0]
+	b.pieces = b.pieces[1:]
+	return p
+}
@@ -0,0 +1,56 @@
+package game
+
+import (
+	"testing"
+)
+
+func TestBag_Next(t *testing.T) {
+	bag := NewBag(42)
+	var dealt []Piece
+	for i := 0; i < 7*100; i++ {
+		dealt = append(dealt, bag.Next())
+	}
+
+	// every seven pieces are the seven tetrominoes
+	for i := 0; i < len(dealt); i += 7 {
+		seen := make(map[Piece]bool)
+		for _, p := range dealt[i : i+7] {
+			seen[p] = true
+		}
+		if len(seen) != 7 {
+			t.Fatalf("bag %d = %v, want every piece once", i/7, dealt[i:i+7])
+		}
+	}
+
+	// the same seed deals the same pieces
+	again := NewBag(42)
+	for i, want := range dealt {
+		if got := again.Next(); got != want {
+			t.Fatalf("Next() %d = %v, want %v", i, got, want)
+		}
+	}
+
+	other := NewBag(43)
+	same := true
+	for _, want := range dealt {
+		if other.Next() != want {
+			same = false
+			break
+		}
+	}
+	if same {
+		t.Error("different seeds dealt the same pieces")
+	}
+}
+
+func TestBag_Sequence(t *testing.T) {
+	// the sequence of a seed must never change, replays and lockstep games depend on it
+	bag := NewBag(1)
+	var got string
+	for i := 0; i < 14; i++ {
+		got += bag.Next().String()
+	}
+	if want := "JLZSIOTOJZTLSI"; got != want {
+		t.Errorf("sequence = %s, want %s", got, want)
+	}
+}
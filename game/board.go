@@ -0,0 +1,121 @@
+package game
+
+import "strings"
+
+const (
+	// Width is the number of columns of the well
+	Width = 10
+	// Height is the number of rows of the well, the rows above VisibleHeight are the buffer pieces spawn in
+	Height = 40
+	// VisibleHeight is the number of rows shown to players
+	VisibleHeight = 20
+)
+
+// Cell is the content of a cell of the board
+type Cell uint8
+
+const (
+	CellEmpty Cell = 0
+	// cells locked by a piece have the value of the piece
+	CellGarbage Cell = 8
+)
+
+// Board is the well, row 0 is the bottom
+type Board struct {
+	cells [Height][Width]Cell
+}
+
+func inside(x, y int) bool {
+	return x >= 0 && x < Width && y >= 0 && y < Height
+}
+
+// Cell returns the cell at x, y. Cells outside the well are garbage so that pieces do not leave it.
+func (b *Board) Cell(x, y int) Cell {
+	if !inside(x, y) {
+		return CellGarbage
+	}
+	return b.cells[y][x]
+}
+
+// Set sets the cell at x, y, cells outside the well are ignored
+func (b *Board) Set(x, y int, c Cell) {
+	if inside(x, y) {
+		b.cells[y][x] = c
+	}
+}
+
+// Fits reports whether the piece is inside the well and overlaps no cell
+func (b *Board) Fits(a ActivePiece) bool {
+	for _, p := range a.Cells() {
+		if b.Cell(p.X, p.Y) != CellEmpty {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Board) place(a ActivePiece) {
+	for _, p := range a.Cells() {
+		b.Set(p.X, p.Y, Cell(a.Piece))
+	}
+}
+
+func (b *Board) rowFull(y int) bool {
+	for x := 0; x < Width; x++ {
+		if b.cells[y][x] == CellEmpty {
+			return false
+		}
+	}
+	return true
+}
+
+// clearLines removes the full rows, the rows above fall down. It returns the cleared rows from the bottom.
+func (b *Board) clearLines() []int {
+	var cleared []int
+	dst := 0
+	for y := 0; y < Height; y++ {
+		if b.rowFull(y) {
+			cleared = append(cleared, y)
+			continue
+		}
+		if dst != y {
+			b.cells[dst] = b.cells[y]
+		}
+		dst++
+	}
+	for ; dst < Height; dst++ {
+		b.cells[dst] = [Width]Cell{}
+	}
+	return cleared
+}
+
+// Empty reports whether no cell is filled, e.g. after a perfect clear
+func (b *Board) Empty() bool {
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			if b.cells[y][x] != CellEmpty {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String draws the visible rows top first, '.' is empty, 'G' garbage and a letter a piece
+func (b *Board) String() string {
+	var sb strings.Builder
+	for y := VisibleHeight - 1; y >= 0; y-- {
+		for x := 0; x < Width; x++ {
+			switch c := b.cells[y][x]; c {
+			case CellEmpty:
+				sb.WriteByte('.')
+			case CellGarbage:
+				sb.WriteByte('G')
+			default:
+				sb.WriteString(Piece(c).String())
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -0,0 +1,65 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+)
+
+// boardOf builds a board from rows drawn top first, the last row is row 0. '#' is garbage.
+func boardOf(rows ...string) Board {
+	var b Board
+	for i, row := range rows {
+		y := len(rows) - 1 - i
+		for x, c := range row {
+			if c == '#' {
+				b.Set(x, y, CellGarbage)
+			}
+		}
+	}
+	return b
+}
+
+func TestBoard_clearLines(t *testing.T) {
+	b := boardOf(
+		"#.........",
+		"##########",
+		"..#.......",
+		"##########",
+		"##########",
+	)
+	got := b.clearLines()
+	if want := []int{0, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("clearLines() = %v, want %v", got, want)
+	}
+	if want := boardOf(
+		"#.........",
+		"..#.......",
+	); b != want {
+		t.Errorf("board after clear:\n%s\nwant:\n%s", b.String(), want.String())
+	}
+	if b.Empty() {
+		t.Error("Empty() = true, want false")
+	}
+}
+
+func TestBoard_Fits(t *testing.T) {
+	b := boardOf("#.........")
+	tests := []struct {
+		name  string
+		piece ActivePiece
+		want  bool
+	}{
+		{"empty", ActivePiece{Piece: PieceT, X: 3, Y: 1}, true},
+		{"overlaps", ActivePiece{Piece: PieceT, X: -1, Y: 1}, false},
+		{"left wall", ActivePiece{Piece: PieceT, X: -1, Y: 5}, false},
+		{"right wall", ActivePiece{Piece: PieceT, X: 8, Y: 5}, false},
+		{"floor", ActivePiece{Piece: PieceT, X: 3, Y: 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.Fits(tt.piece); got != tt.want {
+				t.Errorf("Fits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
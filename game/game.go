@@ -0,0 +1,507 @@
+// Package game is the tetris engine. A game advances frame by frame with the inputs of its player
+// and is deterministic: the same seed and inputs give the same game on every machine.
+package game
+
+// FramesPerSecond is the rate games are stepped at
+const FramesPerSecond = 60
+
+// gravityUnit is the number of subcells in a cell, gravity is counted in subcells so that no float is involved
+const gravityUnit = 1 << 16
+
+// gravityTable is the guideline gravity (0.8-(level-1)*0.007)^(level-1) seconds per row, in subcells per frame
+var gravityTable = [...]int{
+	1092, 1377, 1768, 2311, 3075, 4169, 5759, 8107, 11634, 17026,
+	25416, 38709, 60169, 95483, 154742, 256187, 433425, 749597, 1325716, 2398490,
+}
+
+// maxGravity is 20G, a piece falls to the bottom of the visible rows in a frame
+const maxGravity = VisibleHeight * gravityUnit
+
+func gravity(level int) int {
+	if level < 1 {
+		level = 1
+	}
+	if level > len(gravityTable) {
+		level = len(gravityTable)
+	}
+	g := gravityTable[level-1]
+	if g > maxGravity {
+		g = maxGravity
+	}
+	return g
+}
+
+// Input is the set of actions a player takes in a frame.
+// Moves and rotations are applied once per frame they are set in, auto repeat is up to the client.
+type Input uint8
+
+const (
+	InputLeft Input = 1 << iota
+	InputRight
+	InputRotateCW
+	InputRotateCCW
+	InputSoftDrop // held, the piece falls SoftDropFactor times faster
+	InputHardDrop
+	InputHold
+)
+
+// Config is the rules of a game
+type Config struct {
+	StartLevel int
+	// NextCount is the number of pieces in the next queue
+	NextCount int
+	// LockDelay is the number of frames a piece rests on the stack before it locks
+	LockDelay int
+	// MaxLockResets is how many moves or rotations on the stack restart the lock delay
+	MaxLockResets  int
+	SoftDropFactor int
+}
+
+// DefaultConfig is the guideline rules
+var DefaultConfig = Config{
+	StartLevel:     1,
+	NextCount:      5,
+	LockDelay:      30,
+	MaxLockResets:  15,
+	SoftDropFactor: 20,
+}
+
+func (c Config) withDefaults() Config {
+	if c.StartLevel <= 0 {
+		c.StartLevel = DefaultConfig.StartLevel
+	}
+	if c.NextCount <= 0 {
+		c.NextCount = DefaultConfig.NextCount
+	}
+	if c.LockDelay <= 0 {
+		c.LockDelay = DefaultConfig.LockDelay
+	}
+	if c.MaxLockResets <= 0 {
+		c.MaxLockResets = DefaultConfig.MaxLockResets
+	}
+	if c.SoftDropFactor <= 0 {
+		c.SoftDropFactor = DefaultConfig.SoftDropFactor
+	}
+	return c
+}
+
+// EventType is what happened in a frame
+type EventType uint8
+
+const (
+	EventSpawn    EventType = iota // a piece entered the well
+	EventHold                      // the active piece was put on hold
+	EventSoftDrop                  // the piece fell Drop rows by soft drop
+	EventLock                      // the piece locked, Lines are the rows it cleared
+	EventTopOut                    // the game is over
+	EventScore                     // a lock was scored, see Score
+	EventGarbage                   // Garbage rows rose into the well
+)
+
+// TopOutReason is why a game is over
+type TopOutReason uint8
+
+const (
+	TopOutNone TopOutReason = iota
+	// TopOutBlockOut is a piece spawning over the stack
+	TopOutBlockOut
+	// TopOutLockOut is a piece locking above the visible rows
+	TopOutLockOut
+	// TopOutGarbage is garbage pushing the stack out of the well
+	TopOutGarbage
+)
+
+// Event is something that happened in a game
+type Event struct {
+	Type  EventType
+	Frame uint64
+	Piece ActivePiece
+	// Drop is the number of rows dropped by soft drop, or by hard drop for a lock
+	Drop     int
+	HardDrop bool
+	// Lines are the rows cleared by a lock, from the bottom
+	Lines []int
+	// Rotated is whether the last move of a locked piece was a rotation, Kick is the SRS test it took
+	Rotated bool
+	Kick    int
+	// TSpin and PerfectClear describe the clear of a lock
+	TSpin        TSpin
+	PerfectClear bool
+	TopOut       TopOutReason
+	Score        ScoreEvent
+	Garbage      int
+}
+
+// Game is the game of one player
+type Game struct {
+	config     Config
+	board      Board
+	bag        *Bag
+	queue      []Piece
+	active     ActivePiece
+	hold       Piece
+	holdUsed   bool
+	scorer     *Scorer
+	frame      uint64
+	fall       int // subcells the piece has fallen toward the next row
+	lockTimer  int
+	lockResets int
+	lowest     int // lowest row the piece reached, reaching a lower one gives the lock resets back
+	rotated    bool
+	kick       int
+	over       TopOutReason
+	events     []Event
+}
+
+// New starts a game, zero fields of config take the value of DefaultConfig
+func New(config Config, seed uint64) *Game {
+	config = config.withDefaults()
+	g := &Game{
+		config: config,
+		bag:    NewBag(seed),
+		scorer: NewScorer(config.StartLevel),
+	}
+	for i := 0; i < config.NextCount; i++ {
+		g.queue = append(g.queue, g.bag.Next())
+	}
+	g.spawn(g.nextPiece())
+	return g
+}
+
+// Step advances the game by a frame with the input of the player, it returns what happened
+func (g *Game) Step(in Input) []Event {
+	if g.over != TopOutNone {
+		return nil
+	}
+	g.events = nil
+	g.frame++
+
+	if in&InputHold != 0 && !g.holdUsed {
+		g.swapHold()
+		if g.over != TopOutNone {
+			return g.events
+		}
+	}
+
+	switch {
+	case in&InputRotateCW != 0 && in&InputRotateCCW == 0:
+		g.rotate(g.active.Rotation.cw())
+	case in&InputRotateCCW != 0 && in&InputRotateCW == 0:
+		g.rotate(g.active.Rotation.ccw())
+	}
+	switch {
+	case in&InputLeft != 0 && in&InputRight == 0:
+		g.shift(-1)
+	case in&InputRight != 0 && in&InputLeft == 0:
+		g.shift(1)
+	}
+
+	if in&InputHardDrop != 0 {
+		rows := 0
+		for g.moveDown() {
+			rows++
+		}
+		g.lock(rows, true)
+		return g.events
+	}
+
+	g.applyGravity(in&InputSoftDrop != 0)
+
+	if g.onGround() {
+		g.lockTimer++
+		if g.lockTimer >= g.config.LockDelay {
+			g.lock(0, false)
+		}
+	}
+	return g.events
+}
+
+func (g *Game) emit(e Event) {
+	e.Frame = g.frame
+	g.events = append(g.events, e)
+}
+
+func (g *Game) nextPiece() Piece {
+	p := g.queue[0]
+	g.queue = append(g.queue[1:], g.bag.Next())
+	return p
+}
+
+func bottom(a ActivePiece) int {
+	cells := a.Cells()
+	y := cells[0].Y
+	for _, c := range cells[1:] {
+		if c.Y < y {
+			y = c.Y
+		}
+	}
+	return y
+}
+
+func (g *Game) spawn(p Piece) {
+	a := ActivePiece{Piece: p, Rotation: Rotation0, X: 3, Y: VisibleHeight + 1}
+	if !g.board.Fits(a) {
+		g.active = a
+		g.topOut(TopOutBlockOut)
+		return
+	}
+	// the guideline moves a piece down a row as it spawns
+	if g.board.Fits(a.moved(0, -1)) {
+		a = a.moved(0, -1)
+	}
+	g.active = a
+	g.fall = 0
+	g.lockTimer = 0
+	g.lockResets = 0
+	g.lowest = bottom(a)
+	g.rotated = false
+	g.kick = 0
+	g.emit(Event{Type: EventSpawn, Piece: a})
+}
+
+func (g *Game) swapHold() {
+	held := g.hold
+	g.hold = g.active.Piece
+	g.holdUsed = true
+	g.emit(Event{Type: EventHold, Piece: g.active})
+	if held == PieceNone {
+		held = g.nextPiece()
+	}
+	g.spawn(held)
+}
+
+func (g *Game) onGround() bool {
+	return !g.board.Fits(g.active.moved(0, -1))
+}
+
+// moved restarts the lock delay after a move or rotation on the stack, as long as resets are left
+func (g *Game) moved() {
+	if g.lockTimer > 0 && g.lockResets < g.config.MaxLockResets {
+		g.lockTimer = 0
+		g.lockResets++
+	}
+}
+
+func (g *Game) shift(dx int) {
+	a := g.active.moved(dx, 0)
+	if !g.board.Fits(a) {
+		return
+	}
+	g.active = a
+	g.rotated = false
+	g.moved()
+}
+
+func (g *Game) rotate(to Rotation) {
+	from := g.active.Rotation
+	for i, k := range kickTable(g.active.Piece, from, to) {
+		a := g.active
+		a.Rotation = to
+		a = a.moved(k.X, k.Y)
+		if !g.board.Fits(a) {
+			continue
+		}
+		g.active = a
+		g.rotated = true
+		g.kick = i
+		g.moved()
+		g.reachedRow()
+		return
+	}
+}
+
+func (g *Game) moveDown() bool {
+	a := g.active.moved(0, -1)
+	if !g.board.Fits(a) {
+		return false
+	}
+	g.active = a
+	g.rotated = false
+	g.reachedRow()
+	return true
+}
+
+// reachedRow gives the lock resets back when the piece goes lower than ever
+func (g *Game) reachedRow() {
+	if y := bottom(g.active); y < g.lowest {
+		g.lowest = y
+		g.lockResets = 0
+		g.lockTimer = 0
+	}
+}
+
+func (g *Game) applyGravity(soft bool) {
+	step := gravity(g.scorer.Level())
+	if soft {
+		step *= g.config.SoftDropFactor
+		if step > maxGravity {
+			step = maxGravity
+		}
+	}
+	g.fall += step
+
+	rows := 0
+	for g.fall >= gravityUnit {
+		if !g.moveDown() {
+			g.fall = 0
+			break
+		}
+		g.fall -= gravityUnit
+		rows++
+	}
+	if soft && rows > 0 {
+		g.scorer.Drop(rows, false)
+		g.emit(Event{Type: EventSoftDrop, Piece: g.active, Drop: rows})
+	}
+}
+
+func (g *Game) lock(drop int, hard bool) {
+	a := g.active
+	g.board.place(a)
+	tspin := detectTSpin(&g.board, a, g.rotated, g.kick)
+	lines := g.board.clearLines()
+	perfectClear := len(lines) > 0 && g.board.Empty()
+	g.emit(Event{
+		Type:         EventLock,
+		Piece:        a,
+		Drop:         drop,
+		HardDrop:     hard,
+		Lines:        lines,
+		Rotated:      g.rotated,
+		Kick:         g.kick,
+		TSpin:        tspin,
+		PerfectClear: perfectClear,
+	})
+	if hard {
+		g.scorer.Drop(drop, true)
+	}
+	score := g.scorer.Lock(g.frame, len(lines), tspin, perfectClear)
+	g.emit(Event{Type: EventScore, Piece: a, Score: score})
+	if len(lines) == 0 && bottom(a) >= VisibleHeight {
+		g.topOut(TopOutLockOut)
+		return
+	}
+	g.holdUsed = false
+	g.spawn(g.nextPiece())
+}
+
+// AddGarbage raises garbage rows into the well, a row per hole from the bottom.
+// The falling piece is pushed up if the stack reaches it.
+func (g *Game) AddGarbage(holes []int) []Event {
+	if g.over != TopOutNone || len(holes) == 0 {
+		return nil
+	}
+	g.events = nil
+	if !g.board.addGarbage(holes) {
+		g.topOut(TopOutGarbage)
+		return g.events
+	}
+	for !g.board.Fits(g.active) {
+		if g.active.Y >= Height {
+			g.topOut(TopOutGarbage)
+			return g.events
+		}
+		g.active = g.active.moved(0, 1)
+	}
+	g.lowest = bottom(g.active)
+	g.emit(Event{Type: EventGarbage, Piece: g.active, Garbage: len(holes)})
+	return g.events
+}
+
+func (g *Game) topOut(reason TopOutReason) {
+	g.over = reason
+	g.emit(Event{Type: EventTopOut, Piece: g.active, TopOut: reason})
+}
+
+// Board returns the well with the locked pieces
+func (g *Game) Board() Board {
+	return g.board
+}
+
+// Active returns the falling piece
+func (g *Game) Active() ActivePiece {
+	return g.active
+}
+
+// Ghost returns where the falling piece would land
+func (g *Game) Ghost() ActivePiece {
+	a := g.active
+	for g.board.Fits(a.moved(0, -1)) {
+		a = a.moved(0, -1)
+	}
+	return a
+}
+
+// Hold returns the piece on hold, PieceNone if there is none
+func (g *Game) Hold() Piece {
+	return g.hold
+}
+
+// CanHold reports whether the falling piece may be put on hold
+func (g *Game) CanHold() bool {
+	return !g.holdUsed
+}
+
+// Next returns the next queue, the first piece comes next
+func (g *Game) Next() []Piece {
+	return append([]Piece(nil), g.queue...)
+}
+
+// Level returns the level the gravity follows, it goes up every 10 lines
+func (g *Game) Level() int {
+	return g.scorer.Level()
+}
+
+// Score returns the points scored
+func (g *Game) Score() int64 {
+	return g.scorer.Score()
+}
+
+// Lines returns the lines cleared
+func (g *Game) Lines() int {
+	return g.scorer.Lines()
+}
+
+// Frame returns the number of frames stepped
+func (g *Game) Frame() uint64 {
+	return g.frame
+}
+
+// Over returns why the game is over, TopOutNone while it goes on
+func (g *Game) Over() TopOutReason {
+	return g.over
+}
+
+// Snapshot is the state of a game, enough to draw it
+type Snapshot struct {
+	Frame   uint64       `json:"frame"`
+	Board   []Cell       `json:"board"` // Width cells a row, from the bottom row
+	Active  ActivePiece  `json:"active"`
+	Hold    Piece        `json:"hold"`
+	CanHold bool         `json:"can_hold"`
+	Next    []Piece      `json:"next"`
+	Score   int64        `json:"score"`
+	Lines   int          `json:"lines"`
+	Level   int          `json:"level"`
+	Over    TopOutReason `json:"over"`
+}
+
+// Snapshot returns the current state of the game
+func (g *Game) Snapshot() Snapshot {
+	board := make([]Cell, 0, Width*Height)
+	for y := 0; y < Height; y++ {
+		board = append(board, g.board.cells[y][:]...)
+	}
+	return Snapshot{
+		Frame:   g.frame,
+		Board:   board,
+		Active:  g.active,
+		Hold:    g.hold,
+		CanHold: !g.holdUsed,
+		Next:    g.Next(),
+		Score:   g.Score(),
+		Lines:   g.Lines(),
+		Level:   g.Level(),
+		Over:    g.over,
+	}
+}
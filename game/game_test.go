@@ -0,0 +1,169 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestGame starts a game on the board with p falling
+func newTestGame(config Config, board Board, p Piece) *Game {
+	g := New(config, 1)
+	g.board = board
+	g.spawn(p)
+	return g
+}
+
+func TestGame_Deterministic(t *testing.T) {
+	a, b := New(DefaultConfig, 99), New(DefaultConfig, 99)
+	inputs := rng{state: 7}
+	locks := 0
+	for frame := 0; frame < 10000 && a.Over() == TopOutNone; frame++ {
+		in := Input(inputs.next() % 128)
+		ea, eb := a.Step(in), b.Step(in)
+		if !reflect.DeepEqual(ea, eb) {
+			t.Fatalf("frame %d events = %+v, want %+v", frame, eb, ea)
+		}
+		if a.Board() != b.Board() || a.Active() != b.Active() {
+			t.Fatalf("frame %d games diverged", frame)
+		}
+		for _, e := range ea {
+			if e.Type == EventLock {
+				locks++
+			}
+		}
+	}
+	if locks == 0 {
+		t.Error("no piece locked")
+	}
+}
+
+func TestGame_Gravity(t *testing.T) {
+	g := newTestGame(DefaultConfig, Board{}, PieceT)
+	y := g.Active().Y
+	for i := 0; i < 60; i++ {
+		g.Step(0)
+	}
+	if got := g.Active().Y; got != y {
+		t.Errorf("Y after 60 frames = %d, want %d", got, y)
+	}
+	g.Step(0)
+	if got := g.Active().Y; got != y-1 {
+		t.Errorf("Y after 61 frames = %d, want %d", got, y-1)
+	}
+
+	// 20G drops a piece to the floor at once
+	fast := newTestGame(Config{StartLevel: 20}, Board{}, PieceT)
+	fast.Step(0)
+	if got, want := fast.Active(), fast.Ghost(); got != want || bottom(got) != 0 {
+		t.Errorf("piece at 20G = %+v, want on the floor", got)
+	}
+}
+
+func TestGame_HardDropClearsLines(t *testing.T) {
+	g := newTestGame(DefaultConfig, boardOf("###....###"), PieceI)
+	events := g.Step(InputHardDrop)
+	if len(events) != 3 || events[0].Type != EventLock || events[1].Type != EventScore || events[2].Type != EventSpawn {
+		t.Fatalf("Step() = %+v, want lock, score and spawn", events)
+	}
+	lock := events[0]
+	if !reflect.DeepEqual(lock.Lines, []int{0}) || lock.Drop != VisibleHeight-1 || !lock.HardDrop || !lock.PerfectClear {
+		t.Errorf("lock = %+v", lock)
+	}
+	// a single, a perfect clear and two points a row dropped
+	if got, want := events[1].Score.Points, int64(100+800+2*(VisibleHeight-1)); got != want || g.Score() != want {
+		t.Errorf("points = %d, want %d", got, want)
+	}
+	board := g.Board()
+	if !board.Empty() {
+		t.Errorf("board is not empty:\n%s", board.String())
+	}
+}
+
+func TestGame_Hold(t *testing.T) {
+	g := New(DefaultConfig, 1)
+	first, next := g.Active().Piece, g.Next()
+
+	g.Step(InputHold)
+	if g.Hold() != first || g.Active().Piece != next[0] {
+		t.Fatalf("hold = %v active = %v, want %v %v", g.Hold(), g.Active().Piece, first, next[0])
+	}
+	// once per piece
+	if events := g.Step(InputHold); len(events) != 0 || g.Active().Piece != next[0] || g.CanHold() {
+		t.Errorf("second hold = %+v", events)
+	}
+
+	g.Step(InputHardDrop)
+	g.Step(InputHold)
+	if g.Hold() != next[1] || g.Active().Piece != first {
+		t.Errorf("hold = %v active = %v, want %v %v", g.Hold(), g.Active().Piece, next[1], first)
+	}
+}
+
+func lockFrame(g *Game, input func(frame int) Input) int {
+	for frame := 1; frame < 1000; frame++ {
+		for _, e := range g.Step(input(frame)) {
+			if e.Type == EventLock {
+				return frame
+			}
+		}
+	}
+	return -1
+}
+
+func TestGame_LockDelay(t *testing.T) {
+	config := Config{StartLevel: 20}
+
+	g := newTestGame(config, Board{}, PieceT)
+	if got := lockFrame(g, func(int) Input { return 0 }); got != DefaultConfig.LockDelay {
+		t.Errorf("locked at frame %d, want %d", got, DefaultConfig.LockDelay)
+	}
+
+	// moving on the stack restarts the delay, 15 times
+	g = newTestGame(config, Board{}, PieceT)
+	shuffle := func(frame int) Input {
+		if frame%2 == 0 {
+			return InputLeft
+		}
+		return InputRight
+	}
+	if got, want := lockFrame(g, shuffle), 1+DefaultConfig.MaxLockResets+DefaultConfig.LockDelay-1; got != want {
+		t.Errorf("locked at frame %d, want %d", got, want)
+	}
+}
+
+func TestGame_WallKick(t *testing.T) {
+	g := newTestGame(DefaultConfig, Board{}, PieceI)
+	// vertical against the left wall
+	g.active = ActivePiece{Piece: PieceI, Rotation: RotationL, X: -1, Y: 10}
+	g.Step(InputRotateCW)
+	if want := (ActivePiece{Piece: PieceI, Rotation: Rotation0, X: 0, Y: 10}); g.Active() != want || g.kick != 1 {
+		t.Errorf("Active() = %+v kick %d, want %+v kick 1", g.Active(), g.kick, want)
+	}
+}
+
+func TestGame_TopOut(t *testing.T) {
+	var board Board
+	for x := 3; x < 7; x++ {
+		board.Set(x, 20, CellGarbage)
+		board.Set(x, 21, CellGarbage)
+	}
+	g := newTestGame(DefaultConfig, board, PieceT)
+	if g.Over() != TopOutBlockOut {
+		t.Errorf("Over() = %v, want block out", g.Over())
+	}
+	if events := g.Step(InputHardDrop); events != nil {
+		t.Errorf("Step() after top out = %+v", events)
+	}
+
+	board = Board{}
+	for y := 0; y < VisibleHeight; y++ {
+		for x := 3; x < 7; x++ {
+			board.Set(x, y, CellGarbage)
+		}
+	}
+	g = newTestGame(DefaultConfig, board, PieceT)
+	events := g.Step(InputHardDrop)
+	if g.Over() != TopOutLockOut || events[len(events)-1].Type != EventTopOut {
+		t.Errorf("Over() = %v events = %+v, want lock out", g.Over(), events)
+	}
+}
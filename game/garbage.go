@@ -0,0 +1,171 @@
+package game
+
+var (
+	// attackLines are the lines sent by clears of 0 to 4 lines
+	attackLines = [5]int{0, 0, 1, 2, 4}
+	// attackTSpin are the lines sent by T-spins clearing 0 to 3 lines
+	attackTSpin = [4]int{0, 2, 4, 6}
+	// attackTSpinMini are the lines sent by T-spin minis clearing 0 to 2 lines
+	attackTSpinMini = [3]int{0, 0, 1}
+	// attackCombo are the lines added by the combo count, the last entry is for longer combos
+	attackCombo = [...]int{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 4, 5}
+)
+
+const (
+	attackBackToBack   = 1
+	attackPerfectClear = 10
+)
+
+// Attack returns the garbage lines a scored lock sends to opponents
+func Attack(e ScoreEvent) int {
+	if e.Lines == 0 {
+		return 0
+	}
+	var lines int
+	switch e.TSpin {
+	case TSpinFull:
+		lines = attackTSpin[e.Lines]
+	case TSpinMini:
+		lines = attackTSpinMini[e.Lines]
+	default:
+		lines = attackLines[e.Lines]
+	}
+	if e.BackToBack {
+		lines += attackBackToBack
+	}
+	if e.Combo >= 0 {
+		combo := int(e.Combo)
+		if combo >= len(attackCombo) {
+			combo = len(attackCombo) - 1
+		}
+		lines += attackCombo[combo]
+	}
+	if e.PerfectClear {
+		lines += attackPerfectClear
+	}
+	return lines
+}
+
+// GarbageQueue is the garbage sent to a player that has not risen into the well yet
+type GarbageQueue struct {
+	attacks []int // lines of each attack, oldest first
+}
+
+// Push queues an attack
+func (q *GarbageQueue) Push(lines int) {
+	if lines > 0 {
+		q.attacks = append(q.attacks, lines)
+	}
+}
+
+// Cancel offsets the queued garbage with an attack of the player, oldest first.
+// It returns the lines of the attack left to send to opponents.
+func (q *GarbageQueue) Cancel(attack int) int {
+	for attack > 0 && len(q.attacks) > 0 {
+		if q.attacks[0] > attack {
+			q.attacks[0] -= attack
+			return 0
+		}
+		attack -= q.attacks[0]
+		q.attacks = q.attacks[1:]
+	}
+	return attack
+}
+
+// Take removes up to max lines from the queue, it returns them by attack
+func (q *GarbageQueue) Take(max int) []int {
+	var taken []int
+	for max > 0 && len(q.attacks) > 0 {
+		n := q.attacks[0]
+		if n > max {
+			n = max
+			q.attacks[0] -= n
+		} else {
+			q.attacks = q.attacks[1:]
+		}
+		taken = append(taken, n)
+		max -= n
+	}
+	return taken
+}
+
+// Pending returns the lines queued
+func (q *GarbageQueue) Pending() int {
+	n := 0
+	for _, lines := range q.attacks {
+		n += lines
+	}
+	return n
+}
+
+// HolePolicy is how the holes of garbage rows are placed
+type HolePolicy uint8
+
+const (
+	// HolePerAttack puts the rows of an attack in a column, a column per attack
+	HolePerAttack HolePolicy = iota
+	// HolePerRow puts every row in a column of its own
+	HolePerRow
+	// HoleFixed puts every row in the same column, the garbage is cleared with I pieces
+	HoleFixed
+)
+
+// Holes places the holes of garbage rows, the same seed places the same holes
+type Holes struct {
+	policy HolePolicy
+	rng    rng
+	fixed  int
+}
+
+// NewHoles returns holes placed by the policy
+func NewHoles(policy HolePolicy, seed uint64) *Holes {
+	h := &Holes{policy: policy, rng: rng{state: seed}}
+	h.fixed = h.rng.intn(Width)
+	return h
+}
+
+// Next returns the hole column of each row of an attack
+func (h *Holes) Next(lines int) []int {
+	holes := make([]int, lines)
+	column := h.fixed
+	if h.policy == HolePerAttack {
+		column = h.rng.intn(Width)
+	}
+	for i := range holes {
+		if h.policy == HolePerRow {
+			column = h.rng.intn(Width)
+		}
+		holes[i] = column
+	}
+	return holes
+}
+
+// addGarbage pushes the stack up by a row per hole, the first hole is the bottom row.
+// It returns false if the stack would be pushed out of the well.
+func (b *Board) addGarbage(holes []int) bool {
+	n := len(holes)
+	if n == 0 {
+		return true
+	}
+	if n > Height {
+		return false
+	}
+	for y := Height - n; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			if b.cells[y][x] != CellEmpty {
+				return false
+			}
+		}
+	}
+	copy(b.cells[n:], b.cells[:Height-n])
+	for y, hole := range holes {
+		for x := 0; x < Width; x++ {
+			if x == hole {
+				b.cells[y][x] = CellEmpty
+			} else {
+				b.cells[y][x] = CellGarbage
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttack(t *testing.T) {
+	tests := []struct {
+		name  string
+		event ScoreEvent
+		want  int
+	}{
+		{"no lines", ScoreEvent{TSpin: TSpinFull, Combo: -1}, 0},
+		{"single", ScoreEvent{Lines: 1}, 0},
+		{"double", ScoreEvent{Lines: 2}, 1},
+		{"tetris", ScoreEvent{Lines: 4}, 4},
+		{"back-to-back tetris", ScoreEvent{Lines: 4, BackToBack: true}, 5},
+		{"T-spin double", ScoreEvent{Lines: 2, TSpin: TSpinFull}, 4},
+		{"T-spin triple", ScoreEvent{Lines: 3, TSpin: TSpinFull}, 6},
+		{"T-spin mini double", ScoreEvent{Lines: 2, TSpin: TSpinMini}, 1},
+		{"combo", ScoreEvent{Lines: 1, Combo: 5}, 2},
+		{"long combo", ScoreEvent{Lines: 1, Combo: 20}, 5},
+		{"perfect clear", ScoreEvent{Lines: 4, PerfectClear: true}, 14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Attack(tt.event); got != tt.want {
+				t.Errorf("Attack() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGarbageQueue(t *testing.T) {
+	var q GarbageQueue
+	q.Push(2)
+	q.Push(4)
+	q.Push(3)
+
+	// counter attack
+	if left := q.Cancel(3); left != 0 || q.Pending() != 6 {
+		t.Errorf("Cancel() = %d pending %d, want 0 pending 6", left, q.Pending())
+	}
+	if got, want := q.Take(4), []int{3, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Take() = %v, want %v", got, want)
+	}
+	if left := q.Cancel(5); left != 3 || q.Pending() != 0 {
+		t.Errorf("Cancel() = %d pending %d, want 3 pending 0", left, q.Pending())
+	}
+	if got := q.Take(8); got != nil {
+		t.Errorf("Take() = %v, want nothing", got)
+	}
+}
+
+func TestHoles(t *testing.T) {
+	same := func(holes []int) bool {
+		for _, h := range holes {
+			if h != holes[0] {
+				return false
+			}
+		}
+		return true
+	}
+
+	perAttack := NewHoles(HolePerAttack, 3)
+	if holes := perAttack.Next(4); !same(holes) {
+		t.Errorf("Next() = %v, want a column", holes)
+	}
+
+	perRow := NewHoles(HolePerRow, 3)
+	if holes := perRow.Next(20); same(holes) {
+		t.Errorf("Next() = %v, want a column per row", holes)
+	}
+
+	fixed := NewHoles(HoleFixed, 3)
+	if holes := append(fixed.Next(3), fixed.Next(5)...); !same(holes) {
+		t.Errorf("Next() = %v, want the same column", holes)
+	}
+
+	again := NewHoles(HolePerRow, 3)
+	if a, b := NewHoles(HolePerRow, 3).Next(20), again.Next(20); !reflect.DeepEqual(a, b) {
+		t.Errorf("holes of the same seed differ: %v %v", a, b)
+	}
+}
+
+func TestGame_AddGarbage(t *testing.T) {
+	g := newTestGame(Config{StartLevel: 20}, boardOf("##########"), PieceO)
+	g.Step(0)
+	before := g.Active()
+
+	events := g.AddGarbage([]int{0, 9})
+	if len(events) != 1 || events[0].Type != EventGarbage || events[0].Garbage != 2 {
+		t.Fatalf("AddGarbage() = %+v", events)
+	}
+	board := g.Board()
+	if want := boardOf(
+		"##########",
+		"#########.",
+		".#########",
+	); board != want {
+		t.Errorf("board:\n%s\nwant:\n%s", board.String(), want.String())
+	}
+	// the piece resting on the stack is pushed up
+	if got := g.Active(); got.Y != before.Y+2 {
+		t.Errorf("Active() = %+v, want pushed up from %+v", got, before)
+	}
+
+	// pushed out of the well
+	var full Board
+	for y := 0; y < Height-1; y++ {
+		full.Set(0, y, CellGarbage)
+	}
+	g = newTestGame(DefaultConfig, full, PieceO)
+	g.AddGarbage([]int{1, 1})
+	if g.Over() != TopOutGarbage {
+		t.Errorf("Over() = %v, want garbage top out", g.Over())
+	}
+}
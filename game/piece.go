@@ -0,0 +1,173 @@
+package game
+
+// Piece is a tetromino
+type Piece uint8
+
+const (
+	PieceNone Piece = iota
+	PieceI
+	PieceO
+	PieceT
+	PieceS
+	PieceZ
+	PieceJ
+	PieceL
+)
+
+// Pieces are the seven tetrominoes in a bag before shuffling
+var Pieces = [7]Piece{PieceI, PieceO, PieceT, PieceS, PieceZ, PieceJ, PieceL}
+
+func (p Piece) String() string {
+	if p == PieceNone || p > PieceL {
+		return "-"
+	}
+	return string("IOTSZJL"[p-1])
+}
+
+// Rotation is the orientation of a piece, clockwise from the spawn orientation
+type Rotation uint8
+
+const (
+	Rotation0 Rotation = iota // spawn
+	RotationR                 // clockwise from spawn
+	Rotation2                 // 180 from spawn
+	RotationL                 // counterclockwise from spawn
+)
+
+func (r Rotation) cw() Rotation {
+	return (r + 1) % 4
+}
+
+func (r Rotation) ccw() Rotation {
+	return (r + 3) % 4
+}
+
+// Point is a cell of the board, Y grows upwards from the bottom row
+type Point struct {
+	X, Y int
+}
+
+// shapes are the SRS orientations drawn in the bounding box of the piece, top row first
+var shapes = map[Piece][4][]string{
+	PieceI: {
+		{"....", "####", "....", "...."},
+		{"..#.", "..#.", "..#.", "..#."},
+		{"....", "....", "####", "...."},
+		{".#..", ".#..", ".#..", ".#.."},
+	},
+	PieceO: {
+		{".##.", ".##.", "...."},
+		{".##.", ".##.", "...."},
+		{".##.", ".##.", "...."},
+		{".##.", ".##.", "...."},
+	},
+	PieceT: {
+		{".#.", "###", "..."},
+		{".#.", ".##", ".#."},
+		{"...", "###", ".#."},
+		{".#.", "##.", ".#."},
+	},
+	PieceS: {
+		{".##", "##.", "..."},
+		{".#.", ".##", "..#"},
+		{"...", ".##", "##."},
+		{"#..", "##.", ".#."},
+	},
+	PieceZ: {
+		{"##.", ".##", "..."},
+		{"..#", ".##", ".#."},
+		{"...", "##.", ".##"},
+		{".#.", "##.", "#.."},
+	},
+	PieceJ: {
+		{"#..", "###", "..."},
+		{".##", ".#.", ".#."},
+		{"...", "###", "..#"},
+		{".#.", ".#.", "##."},
+	},
+	PieceL: {
+		{"..#", "###", "..."},
+		{".#.", ".#.", ".##"},
+		{"...", "###", "#.."},
+		{"##.", ".#.", ".#."},
+	},
+}
+
+// minos are the cells of each orientation relative to the top left of the bounding box, Y up
+var minos = func() map[Piece][4][4]Point {
+	m := make(map[Piece][4][4]Point, len(shapes))
+	for p, rotations := range shapes {
+		var cells [4][4]Point
+		for r, rows := range rotations {
+			i := 0
+			for y, row := range rows {
+				for x, c := range row {
+					if c == '#' {
+						cells[r][i] = Point{X: x, Y: -y}
+						i++
+					}
+				}
+			}
+		}
+		m[p] = cells
+	}
+	return m
+}()
+
+// ActivePiece is a piece placed on the board, X and Y locate the top left of its bounding box
+type ActivePiece struct {
+	Piece    Piece
+	Rotation Rotation
+	X, Y     int
+}
+
+// Cells returns the cells the piece covers
+func (a ActivePiece) Cells() [4]Point {
+	cells := minos[a.Piece][a.Rotation]
+	for i := range cells {
+		cells[i].X += a.X
+		cells[i].Y += a.Y
+	}
+	return cells
+}
+
+func (a ActivePiece) moved(dx, dy int) ActivePiece {
+	a.X += dx
+	a.Y += dy
+	return a
+}
+
+// kicks are the SRS offsets tried in order when a rotation is blocked, Y up
+var (
+	kicksJLSTZ = map[[2]Rotation][5]Point{
+		{Rotation0, RotationR}: {{0, 0}, {-1, 0}, {-1, 1}, {0, -2}, {-1, -2}},
+		{RotationR, Rotation0}: {{0, 0}, {1, 0}, {1, -1}, {0, 2}, {1, 2}},
+		{RotationR, Rotation2}: {{0, 0}, {1, 0}, {1, -1}, {0, 2}, {1, 2}},
+		{Rotation2, RotationR}: {{0, 0}, {-1, 0}, {-1, 1}, {0, -2}, {-1, -2}},
+		{Rotation2, RotationL}: {{0, 0}, {1, 0}, {1, 1}, {0, -2}, {1, -2}},
+		{RotationL, Rotation2}: {{0, 0}, {-1, 0}, {-1, -1}, {0, 2}, {-1, 2}},
+		{RotationL, Rotation0}: {{0, 0}, {-1, 0}, {-1, -1}, {0, 2}, {-1, 2}},
+		{Rotation0, RotationL}: {{0, 0}, {1, 0}, {1, 1}, {0, -2}, {1, -2}},
+	}
+	kicksI = map[[2]Rotation][5]Point{
+		{Rotation0, RotationR}: {{0, 0}, {-2, 0}, {1, 0}, {-2, -1}, {1, 2}},
+		{RotationR, Rotation0}: {{0, 0}, {2, 0}, {-1, 0}, {2, 1}, {-1, -2}},
+		{RotationR, Rotation2}: {{0, 0}, {-1, 0}, {2, 0}, {-1, 2}, {2, -1}},
+		{Rotation2, RotationR}: {{0, 0}, {1, 0}, {-2, 0}, {1, -2}, {-2, 1}},
+		{Rotation2, RotationL}: {{0, 0}, {2, 0}, {-1, 0}, {2, 1}, {-1, -2}},
+		{RotationL, Rotation2}: {{0, 0}, {-2, 0}, {1, 0}, {-2, -1}, {1, 2}},
+		{RotationL, Rotation0}: {{0, 0}, {1, 0}, {-2, 0}, {1, -2}, {-2, 1}},
+		{Rotation0, RotationL}: {{0, 0}, {-1, 0}, {2, 0}, {-1, 2}, {2, -1}},
+	}
+)
+
+func kickTable(p Piece, from, to Rotation) [5]Point {
+	switch p {
+	case PieceO:
+		return [5]Point{}
+	case PieceI:
+		return kicksI[[2]Rotation{from, to}]
+	default:
+		return kicksJLSTZ[[2]Rotation{from, to}]
+	}
+}
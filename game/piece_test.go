@@ -0,0 +1,55 @@
+package game
+
+import (
+	"testing"
+)
+
+func TestActivePiece_Cells(t *testing.T) {
+	tests := []struct {
+		name  string
+		piece ActivePiece
+		want  [4]Point
+	}{
+		{
+			name:  "T spawn",
+			piece: ActivePiece{Piece: PieceT, Rotation: Rotation0, X: 3, Y: 21},
+			want:  [4]Point{{4, 21}, {3, 20}, {4, 20}, {5, 20}},
+		},
+		{
+			name:  "I spawn",
+			piece: ActivePiece{Piece: PieceI, Rotation: Rotation0, X: 3, Y: 21},
+			want:  [4]Point{{3, 20}, {4, 20}, {5, 20}, {6, 20}},
+		},
+		{
+			name:  "I right",
+			piece: ActivePiece{Piece: PieceI, Rotation: RotationR, X: 3, Y: 21},
+			want:  [4]Point{{5, 21}, {5, 20}, {5, 19}, {5, 18}},
+		},
+		{
+			name:  "O does not move when rotated",
+			piece: ActivePiece{Piece: PieceO, Rotation: Rotation2, X: 3, Y: 21},
+			want:  [4]Point{{4, 21}, {5, 21}, {4, 20}, {5, 20}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.piece.Cells(); got != tt.want {
+				t.Errorf("Cells() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKickTables(t *testing.T) {
+	// a rotation back tries the opposite offsets
+	for _, table := range []map[[2]Rotation][5]Point{kicksJLSTZ, kicksI} {
+		for key, kicks := range table {
+			back := table[[2]Rotation{key[1], key[0]}]
+			for i := range kicks {
+				if kicks[i].X != -back[i].X || kicks[i].Y != -back[i].Y {
+					t.Errorf("kicks %v %d = %v, back %v", key, i, kicks[i], back[i])
+				}
+			}
+		}
+	}
+}
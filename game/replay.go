@@ -0,0 +1,330 @@
+package game
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// RulesVersion is the version of the rules of the engine. It changes whenever a change of the engine gives
+// another game for the same config, seed and inputs, replays of another version can not be played back.
+const RulesVersion = 1
+
+// ReplayFormatVersion is the version of the encoding of replays
+const ReplayFormatVersion = 1
+
+// replayMagic starts every encoded replay
+var replayMagic = []byte("TRPL")
+
+var (
+	ErrReplayFormat       = xerrors.New("invalid replay")
+	ErrReplayRulesVersion = xerrors.New("replay of other rules")
+)
+
+// Replay is everything needed to play games again: their rules, their seed and the inputs of every player.
+// The games of the players start with the same seed.
+type Replay struct {
+	RulesVersion int
+	Config       Config
+	Seed         uint64
+	Players      []ReplayPlayer
+}
+
+// ReplayPlayer is the game of a player in a replay
+type ReplayPlayer struct {
+	Name string
+	// Inputs are in the order of frames, frames without input are not recorded
+	Inputs []ReplayInput
+	// End is the last frame of the game, an input after it only raises the garbage the game ended with
+	End uint64
+}
+
+// ReplayInput is the input of a player at a frame
+type ReplayInput struct {
+	Frame uint64
+	Input Input
+	// Garbage are the holes of the garbage rows raised before the input
+	Garbage []int
+}
+
+// Recorder records the inputs of a game played with Step into a ReplayPlayer
+type Recorder struct {
+	player ReplayPlayer
+	frame  uint64
+	// garbage raised since the last step
+	garbage []int
+}
+
+// NewRecorder returns a recorder of the game of the player
+func NewRecorder(name string) *Recorder {
+	return &Recorder{player: ReplayPlayer{Name: name}}
+}
+
+// Garbage records garbage raised before the next step
+func (r *Recorder) Garbage(holes []int) {
+	r.garbage = append(r.garbage, holes...)
+}
+
+// Step records the input of a step to the frame, a step of a game that is over does not advance the frame and is not recorded
+func (r *Recorder) Step(frame uint64, in Input) {
+	if frame <= r.frame {
+		return
+	}
+	r.frame = frame
+	if in == 0 && len(r.garbage) == 0 {
+		return
+	}
+	r.player.Inputs = append(r.player.Inputs, ReplayInput{Frame: frame, Input: in, Garbage: r.garbage})
+	r.garbage = nil
+}
+
+// Player returns the game recorded so far, it ends at the last frame stepped.
+// Garbage raised after the last step, like the garbage topping out the game, is recorded at the frame after the end.
+func (r *Recorder) Player() ReplayPlayer {
+	p := r.player
+	p.Inputs = append([]ReplayInput(nil), r.player.Inputs...)
+	if len(r.garbage) > 0 {
+		p.Inputs = append(p.Inputs, ReplayInput{Frame: r.frame + 1, Garbage: append([]int(nil), r.garbage...)})
+	}
+	p.End = r.frame
+	return p
+}
+
+// MarshalBinary encodes the replay. Frames are encoded as the difference with the previous input in varints,
+// a replay takes a few bytes per input.
+func (r *Replay) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(replayMagic)
+	putUvarint(&b, ReplayFormatVersion)
+	putUvarint(&b, uint64(r.RulesVersion))
+	for _, v := range []int{r.Config.StartLevel, r.Config.NextCount, r.Config.LockDelay, r.Config.MaxLockResets, r.Config.SoftDropFactor} {
+		putVarint(&b, int64(v))
+	}
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], r.Seed)
+	b.Write(seed[:])
+
+	putUvarint(&b, uint64(len(r.Players)))
+	for _, p := range r.Players {
+		putUvarint(&b, uint64(len(p.Name)))
+		b.WriteString(p.Name)
+		putUvarint(&b, p.End)
+		putUvarint(&b, uint64(len(p.Inputs)))
+		var frame uint64
+		for _, in := range p.Inputs {
+			if in.Frame <= frame {
+				return nil, xerrors.Errorf("input of %s for frame %d after frame %d: %w", p.Name, in.Frame, frame, ErrReplayFormat)
+			}
+			putUvarint(&b, in.Frame-frame)
+			frame = in.Frame
+			b.WriteByte(byte(in.Input))
+			putUvarint(&b, uint64(len(in.Garbage)))
+			for _, hole := range in.Garbage {
+				if hole < 0 || hole >= Width {
+					return nil, xerrors.Errorf("garbage hole %d of %s: %w", hole, p.Name, ErrReplayFormat)
+				}
+				b.WriteByte(byte(hole))
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a replay encoded by MarshalBinary
+func (r *Replay) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, replayMagic) {
+		return xerrors.Errorf("no replay header: %w", ErrReplayFormat)
+	}
+	d := &replayDecoder{r: bytes.NewReader(data[len(replayMagic):])}
+	if v := d.uvarint(); d.err == nil && v != ReplayFormatVersion {
+		return xerrors.Errorf("format version %d: %w", v, ErrReplayFormat)
+	}
+
+	var replay Replay
+	replay.RulesVersion = int(d.uvarint())
+	for _, v := range []*int{&replay.Config.StartLevel, &replay.Config.NextCount, &replay.Config.LockDelay, &replay.Config.MaxLockResets, &replay.Config.SoftDropFactor} {
+		*v = int(d.varint())
+	}
+	replay.Seed = d.uint64()
+
+	players := d.count()
+	for i := 0; i < players && d.err == nil; i++ {
+		var p ReplayPlayer
+		p.Name = string(d.bytes(d.count()))
+		p.End = d.uvarint()
+		inputs := d.count()
+		var frame uint64
+		for j := 0; j < inputs && d.err == nil; j++ {
+			// every input is on a later frame than the one before, as MarshalBinary writes them
+			delta := d.uvarint()
+			if d.err == nil && delta == 0 {
+				d.err = xerrors.Errorf("input of %s on frame %d twice", p.Name, frame)
+			}
+			frame += delta
+			in := ReplayInput{Frame: frame, Input: Input(d.byte())}
+			if holes := d.bytes(d.count()); len(holes) > 0 {
+				in.Garbage = make([]int, len(holes))
+				for k, hole := range holes {
+					in.Garbage[k] = int(hole)
+				}
+			}
+			p.Inputs = append(p.Inputs, in)
+		}
+		replay.Players = append(replay.Players, p)
+	}
+	if d.err != nil {
+		return xerrors.Errorf("%v: %w", d.err, ErrReplayFormat)
+	}
+	*r = replay
+	return nil
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func putVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+// replayDecoder reads a replay, it keeps the first error and reads zeros after it
+type replayDecoder struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (d *replayDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	d.err = err
+	return v
+}
+
+func (d *replayDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	d.err = err
+	return v
+}
+
+func (d *replayDecoder) uint64() uint64 {
+	var b [8]byte
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b[:])
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (d *replayDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	c, err := d.r.ReadByte()
+	d.err = err
+	return c
+}
+
+// count reads a length, it can not be longer than what is left to read
+func (d *replayDecoder) count() int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(d.r.Len()) {
+		d.err = xerrors.Errorf("length %d past the end", n)
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *replayDecoder) bytes(n int) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
+
+// Playback plays the games of a replay again, frame by frame
+type Playback struct {
+	replay *Replay
+	games  []*Game
+	next   []int // index of the next input of each player
+	frame  uint64
+}
+
+// NewPlayback starts the games of the replay, it fails if the replay was recorded with other rules
+func NewPlayback(replay *Replay) (*Playback, error) {
+	if replay.RulesVersion != RulesVersion {
+		return nil, xerrors.Errorf("rules version %d, the engine plays %d: %w", replay.RulesVersion, RulesVersion, ErrReplayRulesVersion)
+	}
+	p := &Playback{
+		replay: replay,
+		games:  make([]*Game, len(replay.Players)),
+		next:   make([]int, len(replay.Players)),
+	}
+	for i := range replay.Players {
+		p.games[i] = New(replay.Config, replay.Seed)
+	}
+	return p, nil
+}
+
+// Frame returns the last frame stepped
+func (p *Playback) Frame() uint64 {
+	return p.frame
+}
+
+// Game returns the game of the ith player of the replay, as of the last frame stepped
+func (p *Playback) Game(i int) *Game {
+	return p.games[i]
+}
+
+// Done reports whether every game reached its end
+func (p *Playback) Done() bool {
+	for i, player := range p.replay.Players {
+		if p.games[i].Over() == TopOutNone && (p.frame < player.End || p.next[i] < len(player.Inputs)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Step steps every game that did not end by a frame with its input, it returns the events of each player
+func (p *Playback) Step() [][]Event {
+	p.frame++
+	events := make([][]Event, len(p.games))
+	for i, player := range p.replay.Players {
+		g := p.games[i]
+		if g.Over() != TopOutNone {
+			continue
+		}
+		var in Input
+		if n := p.next[i]; n < len(player.Inputs) && player.Inputs[n].Frame == p.frame {
+			if holes := player.Inputs[n].Garbage; len(holes) > 0 {
+				events[i] = append(events[i], g.AddGarbage(holes)...)
+			}
+			in = player.Inputs[n].Input
+			p.next[i]++
+		}
+		// the garbage raised after the end is not followed by a step
+		if g.Frame() < player.End {
+			events[i] = append(events[i], g.Step(in)...)
+		}
+	}
+	return events
+}
+
+// Seek steps the games to the frame without returning their events
+func (p *Playback) Seek(frame uint64) {
+	for p.frame < frame && !p.Done() {
+		p.Step()
+	}
+}
@@ -0,0 +1,171 @@
+package game
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestReplay(t *testing.T) {
+	// two players with the same seed, the second one gets garbage
+	games := []*Game{New(DefaultConfig, 42), New(DefaultConfig, 42)}
+	recorders := []*Recorder{NewRecorder("alice"), NewRecorder("bob")}
+	var played [][][]Event
+	inputs := rng{state: 3}
+	for frame := uint64(1); frame <= 3000; frame++ {
+		var events [][]Event
+		for i, g := range games {
+			var e []Event
+			if i == 1 && frame%200 == 0 {
+				holes := []int{int(frame/200) % Width, 0}
+				recorders[i].Garbage(holes)
+				e = append(e, g.AddGarbage(holes)...)
+			}
+			var in Input
+			if inputs.next()%30 == 0 {
+				in = Input(inputs.next() % 128)
+			}
+			if g.Over() == TopOutNone {
+				recorders[i].Step(frame, in)
+			}
+			events = append(events, append(e, g.Step(in)...))
+		}
+		played = append(played, events)
+	}
+
+	replay := &Replay{RulesVersion: RulesVersion, Config: DefaultConfig, Seed: 42}
+	for _, r := range recorders {
+		replay.Players = append(replay.Players, r.Player())
+	}
+	data, err := replay.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Replay
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, replay) {
+		t.Fatalf("decoded replay = %+v, want %+v", decoded, replay)
+	}
+	if inputs := len(replay.Players[0].Inputs) + len(replay.Players[1].Inputs); len(data) > 4*inputs+64 {
+		t.Errorf("replay of %d inputs takes %d bytes", inputs, len(data))
+	}
+
+	p, err := NewPlayback(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range played {
+		if p.Done() {
+			break
+		}
+		events := p.Step()
+		for i := range games {
+			if len(want[i]) == 0 && len(events[i]) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(events[i], want[i]) {
+				t.Fatalf("frame %d events of %s = %+v, want %+v", p.Frame(), replay.Players[i].Name, events[i], want[i])
+			}
+		}
+	}
+	if !p.Done() {
+		t.Error("playback is not done after the last frame")
+	}
+	for i, g := range games {
+		if got := p.Game(i); got.Board() != g.Board() || got.Score() != g.Score() || got.Over() != g.Over() {
+			t.Errorf("game of %s diverged", replay.Players[i].Name)
+		}
+	}
+}
+
+func TestPlayback_Seek(t *testing.T) {
+	replay := &Replay{
+		RulesVersion: RulesVersion,
+		Seed:         7,
+		Players:      []ReplayPlayer{{Name: "alice", End: 100, Inputs: []ReplayInput{{Frame: 10, Input: InputHardDrop}}}},
+	}
+	p, err := NewPlayback(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Seek(50)
+	if p.Frame() != 50 || p.Game(0).Frame() != 50 || p.Game(0).Lines() != 0 {
+		t.Errorf("frame after seek = %d", p.Frame())
+	}
+	p.Seek(1000)
+	if !p.Done() || p.Game(0).Frame() != 100 {
+		t.Errorf("game frame = %d, want the end of the replay", p.Game(0).Frame())
+	}
+
+	replay.RulesVersion = RulesVersion + 1
+	if _, err := NewPlayback(replay); !xerrors.Is(err, ErrReplayRulesVersion) {
+		t.Errorf("NewPlayback() error = %v, want %v", err, ErrReplayRulesVersion)
+	}
+}
+
+func TestRecorder_GarbageAfterLastStep(t *testing.T) {
+	g := New(DefaultConfig, 5)
+	r := NewRecorder("alice")
+	for i := 0; i < 10; i++ {
+		g.Step(0)
+		r.Step(g.Frame(), 0)
+	}
+	// the garbage tops the game out before its next step
+	holes := make([]int, Height)
+	for i := range holes {
+		holes[i] = i % Width
+	}
+	r.Garbage(holes)
+	if g.AddGarbage(holes); g.Over() != TopOutGarbage {
+		t.Fatalf("game over = %v, want %v", g.Over(), TopOutGarbage)
+	}
+	g.Step(InputLeft)
+	r.Step(g.Frame(), InputLeft)
+
+	player := r.Player()
+	if player.End != 10 {
+		t.Errorf("end = %d, want 10", player.End)
+	}
+	replay := &Replay{RulesVersion: RulesVersion, Config: DefaultConfig, Seed: 5, Players: []ReplayPlayer{player}}
+	data, err := replay.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Replay
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlayback(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Seek(100)
+	if got := p.Game(0); got.Over() != TopOutGarbage || got.Frame() != 10 || got.Board() != g.Board() {
+		t.Errorf("played back game over = %v at frame %d, want %v at frame 10", got.Over(), got.Frame(), TopOutGarbage)
+	}
+}
+
+func TestReplay_UnmarshalBinary(t *testing.T) {
+	replay := &Replay{RulesVersion: RulesVersion, Players: []ReplayPlayer{{Name: "alice", End: 3, Inputs: []ReplayInput{{Frame: 2, Input: InputLeft, Garbage: []int{4}}}}}}
+	data, err := replay.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the input is on frame 2, the delta of its frame is right before its input and the count of its garbage
+	zeroDelta := append([]byte(nil), data...)
+	zeroDelta[len(data)-4] = 0
+	for _, bad := range [][]byte{nil, []byte("TRPL\x02"), data[:len(data)-1], zeroDelta} {
+		var r Replay
+		if err := r.UnmarshalBinary(bad); !xerrors.Is(err, ErrReplayFormat) {
+			t.Errorf("UnmarshalBinary(%q) error = %v, want %v", bad, err, ErrReplayFormat)
+		}
+	}
+
+	replay.Players[0].Inputs = append(replay.Players[0].Inputs, ReplayInput{Frame: 2})
+	if _, err := replay.MarshalBinary(); !xerrors.Is(err, ErrReplayFormat) {
+		t.Errorf("MarshalBinary() error = %v, want inputs in the order of frames", err)
+	}
+}
@@ -0,0 +1,188 @@
+package game
+
+// TSpin is the kind of T-spin a lock made
+type TSpin uint8
+
+const (
+	TSpinNone TSpin = iota
+	TSpinMini
+	TSpinFull
+)
+
+func (t TSpin) String() string {
+	switch t {
+	case TSpinMini:
+		return "T-spin mini"
+	case TSpinFull:
+		return "T-spin"
+	}
+	return ""
+}
+
+// linesPerLevel is the fixed goal, the level goes up every 10 lines
+const linesPerLevel = 10
+
+// kickTSTIndex is the SRS test that moves a T a column over and two rows down, it makes any T-spin a full one
+const kickTSTIndex = 4
+
+// frontCorners are the corners of the box of a T on the side it points to, relative to its center
+var frontCorners = [4][2]Point{
+	Rotation0: {{-1, 1}, {1, 1}},
+	RotationR: {{1, 1}, {1, -1}},
+	Rotation2: {{-1, -1}, {1, -1}},
+	RotationL: {{-1, 1}, {-1, -1}},
+}
+
+// detectTSpin applies the 3-corner rule to a T that just locked on the board
+func detectTSpin(b *Board, a ActivePiece, rotated bool, kick int) TSpin {
+	if a.Piece != PieceT || !rotated {
+		return TSpinNone
+	}
+	cx, cy := a.X+1, a.Y-1
+	filled := func(p Point) bool {
+		return b.Cell(cx+p.X, cy+p.Y) != CellEmpty
+	}
+
+	corners := 0
+	for _, p := range []Point{{-1, 1}, {1, 1}, {-1, -1}, {1, -1}} {
+		if filled(p) {
+			corners++
+		}
+	}
+	if corners < 3 {
+		return TSpinNone
+	}
+	front := frontCorners[a.Rotation]
+	if filled(front[0]) && filled(front[1]) || kick == kickTSTIndex {
+		return TSpinFull
+	}
+	return TSpinMini
+}
+
+// ScoreEvent is the score a lock made, it has fixed-size fields so that every codec can send it
+type ScoreEvent struct {
+	Frame        uint64 `json:"frame"`
+	Lines        uint8  `json:"lines"`
+	TSpin        TSpin  `json:"tspin"`
+	Combo        int32  `json:"combo"` // consecutive locks clearing lines before this one, -1 if this one cleared none
+	BackToBack   bool   `json:"back_to_back"`
+	PerfectClear bool   `json:"perfect_clear"`
+	Points       int64  `json:"points"` // points of this lock, drops included
+	Score        int64  `json:"score"`
+	TotalLines   int32  `json:"total_lines"`
+	Level        int32  `json:"level"`
+	LevelUp      bool   `json:"level_up"`
+}
+
+// Difficult reports whether the clear counts for back-to-back: a tetris or a T-spin clearing lines
+func (e ScoreEvent) Difficult() bool {
+	return e.Lines == 4 || e.Lines > 0 && e.TSpin != TSpinNone
+}
+
+var (
+	linePoints      = [5]int64{0, 100, 300, 500, 800}
+	tSpinPoints     = [4]int64{400, 800, 1200, 1600}
+	tSpinMiniPoints = [3]int64{100, 200, 400}
+	// perfectClearPoints are added to the points of the clear
+	perfectClearPoints    = [5]int64{0, 800, 1200, 1800, 2000}
+	perfectClearB2BTetris = int64(3200)
+)
+
+// Scorer keeps the guideline score, lines and level of a game
+type Scorer struct {
+	score      int64
+	lines      int
+	startLevel int
+	combo      int
+	b2b        bool // the last clear was difficult
+	drops      int64
+}
+
+// NewScorer returns a scorer starting at the level
+func NewScorer(startLevel int) *Scorer {
+	return &Scorer{startLevel: startLevel, combo: -1}
+}
+
+// Drop scores cells dropped by soft or hard drop, they are reported with the next lock
+func (s *Scorer) Drop(rows int, hard bool) {
+	points := int64(rows)
+	if hard {
+		points *= 2
+	}
+	s.drops += points
+	s.score += points
+}
+
+// Lock scores a locked piece
+func (s *Scorer) Lock(frame uint64, lines int, tspin TSpin, perfectClear bool) ScoreEvent {
+	level := int64(s.Level())
+	if tspin == TSpinMini && lines > 2 {
+		// a mini can not clear three rows by the rules, count such a spin as a full one
+		tspin = TSpinFull
+	}
+	e := ScoreEvent{
+		Frame:        frame,
+		Lines:        uint8(lines),
+		TSpin:        tspin,
+		PerfectClear: perfectClear,
+	}
+
+	var points int64
+	switch tspin {
+	case TSpinFull:
+		points = tSpinPoints[lines]
+	case TSpinMini:
+		points = tSpinMiniPoints[lines]
+	default:
+		points = linePoints[lines]
+	}
+
+	if lines == 0 {
+		// a lock clearing nothing ends the combo, back-to-back is only broken by an easy clear
+		s.combo = -1
+	} else {
+		s.combo++
+		difficult := e.Difficult()
+		if difficult && s.b2b {
+			e.BackToBack = true
+			points = points * 3 / 2
+		}
+		s.b2b = difficult
+		points += 50 * int64(s.combo)
+	}
+	if perfectClear {
+		if lines == 4 && e.BackToBack {
+			points += perfectClearB2BTetris
+		} else {
+			points += perfectClearPoints[lines]
+		}
+	}
+	points *= level
+
+	s.score += points
+	e.Points = points + s.drops
+	s.drops = 0
+	e.Combo = int32(s.combo)
+
+	s.lines += lines
+	e.TotalLines = int32(s.lines)
+	e.Level = int32(s.Level())
+	e.LevelUp = int64(e.Level) > level
+	e.Score = s.score
+	return e
+}
+
+// Score returns the points scored
+func (s *Scorer) Score() int64 {
+	return s.score
+}
+
+// Lines returns the lines cleared
+func (s *Scorer) Lines() int {
+	return s.lines
+}
+
+// Level returns the level, it goes up every 10 lines
+func (s *Scorer) Level() int {
+	return s.startLevel + s.lines/linesPerLevel
+}
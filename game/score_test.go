@@ -0,0 +1,94 @@
+package game
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDetectTSpin(t *testing.T) {
+	// a T pointing down into a slot with both front corners filled
+	full := boardOf(
+		"..#.......",
+		"##...#####",
+		"###.######",
+	)
+	// a T pointing right against the left wall with a front corner open
+	mini := boardOf(
+		"..........",
+		"..........",
+		".#........",
+	)
+	tests := []struct {
+		name    string
+		board   Board
+		piece   ActivePiece
+		rotated bool
+		kick    int
+		want    TSpin
+	}{
+		{"full", full, ActivePiece{Piece: PieceT, Rotation: Rotation2, X: 2, Y: 2}, true, 0, TSpinFull},
+		{"not rotated", full, ActivePiece{Piece: PieceT, Rotation: Rotation2, X: 2, Y: 2}, false, 0, TSpinNone},
+		{"not a T", full, ActivePiece{Piece: PieceL, Rotation: Rotation2, X: 2, Y: 2}, true, 0, TSpinNone},
+		{"mini", mini, ActivePiece{Piece: PieceT, Rotation: RotationR, X: -1, Y: 2}, true, 0, TSpinMini},
+		{"mini upgraded by the TST kick", mini, ActivePiece{Piece: PieceT, Rotation: RotationR, X: -1, Y: 2}, true, kickTSTIndex, TSpinFull},
+		{"two corners", Board{}, ActivePiece{Piece: PieceT, Rotation: RotationR, X: -1, Y: 2}, true, 0, TSpinNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.board
+			b.place(tt.piece)
+			if got := detectTSpin(&b, tt.piece, tt.rotated, tt.kick); got != tt.want {
+				t.Errorf("detectTSpin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScorer_Lock(t *testing.T) {
+	s := NewScorer(1)
+	s.Drop(10, true)
+
+	tests := []struct {
+		lines int
+		tspin TSpin
+		want  ScoreEvent
+	}{
+		// tetris with 20 points of hard drop
+		{4, TSpinNone, ScoreEvent{Lines: 4, Points: 820, Score: 820, TotalLines: 4, Level: 1}},
+		// back-to-back tetris and a combo
+		{4, TSpinNone, ScoreEvent{Lines: 4, Combo: 1, BackToBack: true, Points: 1250, Score: 2070, TotalLines: 8, Level: 1}},
+		// a single breaks back-to-back
+		{1, TSpinNone, ScoreEvent{Lines: 1, Combo: 2, Points: 200, Score: 2270, TotalLines: 9, Level: 1}},
+		// T-spin double, the level goes up
+		{2, TSpinFull, ScoreEvent{Lines: 2, TSpin: TSpinFull, Combo: 3, Points: 1350, Score: 3620, TotalLines: 11, Level: 2, LevelUp: true}},
+		// no lines ends the combo but keeps back-to-back
+		{0, TSpinNone, ScoreEvent{Combo: -1, Score: 3620, TotalLines: 11, Level: 2}},
+		// back-to-back T-spin single at level 2
+		{1, TSpinFull, ScoreEvent{Lines: 1, TSpin: TSpinFull, BackToBack: true, Points: 2400, Score: 6020, TotalLines: 12, Level: 2}},
+		// T-spin mini without lines
+		{0, TSpinMini, ScoreEvent{TSpin: TSpinMini, Combo: -1, Points: 200, Score: 6220, TotalLines: 12, Level: 2}},
+	}
+	for i, tt := range tests {
+		got := s.Lock(0, tt.lines, tt.tspin, false)
+		if got != tt.want {
+			t.Errorf("Lock() %d = %+v, want %+v", i, got, tt.want)
+		}
+	}
+}
+
+func TestScorer_PerfectClear(t *testing.T) {
+	s := NewScorer(1)
+	s.Lock(0, 4, TSpinNone, false)
+	got := s.Lock(0, 4, TSpinNone, true)
+	// back-to-back tetris, combo and the back-to-back tetris perfect clear
+	if want := int64(1200 + 50 + 3200); got.Points != want || !got.PerfectClear {
+		t.Errorf("Lock() = %+v, want %d points", got, want)
+	}
+}
+
+func TestScoreEvent_FixedSize(t *testing.T) {
+	// the binary codec sends fixed-size values only
+	if binary.Size(ScoreEvent{}) < 0 {
+		t.Error("ScoreEvent is not fixed-size")
+	}
+}
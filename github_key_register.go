@@ -6,18 +6,27 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/xerrors"
 )
 
+// DefaultKeyCacheTTL is how long the keys retrieved from Github are trusted before they are retrieved again
+const DefaultKeyCacheTTL = time.Hour
+
 // GithubKeyRegister is public key register that retrieves from Github
 type GithubKeyRegister struct {
 	logger     *zap.Logger
 	httpClient *http.Client
+	baseURL    string
+	now        func() time.Time
 	mux        sync.RWMutex
-	cache      map[string]string // pubkey -> github user name
+	cache      map[string]string     // pubkey -> github user name
+	users      map[string]CachedKeys // github user name -> its keys
+	ttl        time.Duration
+	store      Store // keeps the cache across restarts, nil if not
 }
 
 // NewGithubKeyRegister returns a new GithubKeyRegister
@@ -25,9 +34,49 @@ func NewGithubKeyRegister(logger *zap.Logger) *GithubKeyRegister {
 	return &GithubKeyRegister{
 		logger:     logger,
 		httpClient: new(http.Client),
+		baseURL:    "https://github.com",
+		now:        time.Now,
 		mux:        sync.RWMutex{},
 		cache:      make(map[string]string),
+		users:      make(map[string]CachedKeys),
+		ttl:        DefaultKeyCacheTTL,
+	}
+}
+
+// SetCacheTTL sets how long the keys of a user are trusted, they are retrieved again at the next login afterwards
+// so that the keys removed from Github stop working
+func (r *GithubKeyRegister) SetCacheTTL(ttl time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.ttl = ttl
+}
+
+// SetStore loads the keys cached in the store, and caches the keys retrieved from now on in it
+func (r *GithubKeyRegister) SetStore(store Store) error {
+	users, err := store.Keys()
+	if err != nil {
+		return xerrors.Errorf("failed to load cached keys: %w", err)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for user, keys := range users {
+		r.setKeys(user, keys)
 	}
+	r.store = store
+	return nil
+}
+
+// setKeys replaces the keys cached for the user, a key registered to another user since is left to that user
+func (r *GithubKeyRegister) setKeys(user string, keys CachedKeys) {
+	for _, k := range r.users[user].Keys {
+		if r.cache[string(k)] == user {
+			delete(r.cache, string(k))
+		}
+	}
+	for _, k := range keys.Keys {
+		r.cache[string(k)] = user
+	}
+	r.users[user] = keys
 }
 
 func (r *GithubKeyRegister) Find(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
@@ -35,8 +84,8 @@ func (r *GithubKeyRegister) Find(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHU
 	accessKey := string(key.Marshal())
 	logger := r.logger.With(zap.String("user", user))
 
-	sshUser, err := r.getUserFromCache(user, accessKey)
-	if err == nil {
+	sshUser, fresh, err := r.getUserFromCache(user, accessKey)
+	if err == nil && fresh {
 		return sshUser, nil
 	}
 
@@ -46,33 +95,46 @@ func (r *GithubKeyRegister) Find(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHU
 		return SSHUser{}, err
 	}
 
-	r.mux.Lock()
-	for _, k := range keys {
-		r.cache[string(k.Marshal())] = user
+	cached := CachedKeys{Keys: make([][]byte, len(keys)), Fetched: r.now()}
+	for i, k := range keys {
+		cached.Keys[i] = k.Marshal()
 	}
+	r.mux.Lock()
+	r.setKeys(user, cached)
+	store := r.store
 	r.mux.Unlock()
+	if store != nil {
+		if err := store.SaveKeys(user, cached); err != nil {
+			// the keys are still cached in memory
+			logger.Error("failed to save keys", zap.Error(err))
+		}
+	}
 
-	return r.getUserFromCache(user, accessKey)
+	sshUser, _, err = r.getUserFromCache(user, accessKey)
+	return sshUser, err
 }
 
-func (r *GithubKeyRegister) getUserFromCache(userName, accessKey string) (SSHUser, error) {
+// getUserFromCache returns the user of the key, fresh is false once the keys of the user outlived the ttl
+func (r *GithubKeyRegister) getUserFromCache(userName, accessKey string) (user SSHUser, fresh bool, err error) {
 	r.mux.RLock()
 	githubUser, ok := r.cache[accessKey]
+	fetched := r.users[githubUser].Fetched
+	ttl := r.ttl
 	r.mux.RUnlock()
 	if ok {
 		if githubUser != userName {
-			return SSHUser{}, xerrors.New("key's username is not matched, please use github user name")
+			return SSHUser{}, false, xerrors.New("key's username is not matched, please use github user name")
 		}
-		return SSHUser{UserName: githubUser}, nil
+		return SSHUser{UserName: githubUser}, r.now().Sub(fetched) < ttl, nil
 	}
-	return SSHUser{}, xerrors.New("key not found, please register key on github")
+	return SSHUser{}, false, xerrors.New("key not found, please register key on github")
 }
 
 func (r *GithubKeyRegister) getKeysFromGithub(userName string) ([]ssh.PublicKey, error) {
-	res, err := r.httpClient.Get(fmt.Sprintf("https://github.com/%s.keys", userName))
+	res, err := r.httpClient.Get(fmt.Sprintf("%s/%s.keys", r.baseURL, userName))
 	switch {
 	case err != nil:
-		return nil, xerrors.Errorf("failed to GET from github: %w")
+		return nil, xerrors.Errorf("failed to GET from github: %w", err)
 	case res.StatusCode == 404:
 		return nil, xerrors.New("username is not found, please use github user name")
 	case res.StatusCode != 200:
@@ -1,8 +1,13 @@
 package tetris
 
 import (
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"go.uber.org/zap"
@@ -133,3 +138,73 @@ func parsePubKey(t *testing.T, key string) ssh.PublicKey {
 	}
 	return k
 }
+
+func TestGithubKeyRegister_TTL(t *testing.T) {
+	var mux sync.Mutex
+	served, fetches := reroreroKey, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if req.URL.Path != "/rerorero.keys" {
+			http.NotFound(w, req)
+			return
+		}
+		fetches++
+		fmt.Fprintln(w, served)
+	}))
+	defer server.Close()
+
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	r := NewGithubKeyRegister(zap.NewNop())
+	r.baseURL, r.now = server.URL, func() time.Time { return now }
+	r.SetCacheTTL(time.Hour)
+	if err := r.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	conn := &mockedConnMetadata{UserMock: func() string { return "rerorero" }}
+	rerorero, codehex := parsePubKey(t, reroreroKey), parsePubKey(t, codehexKey)
+
+	for i := 0; i < 2; i++ {
+		if user, err := r.Find(conn, rerorero); err != nil || user.UserName != "rerorero" {
+			t.Fatalf("Find() = %+v, %v", user, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched %d times, want the keys cached", fetches)
+	}
+	if keys, _ := store.Keys(); !keys["rerorero"].Fetched.Equal(now) {
+		t.Errorf("Keys() = %+v, want saved with the time they were fetched", keys)
+	}
+
+	// the key is removed from github, the cache lets it in until it is stale
+	mux.Lock()
+	served = codehexKey
+	mux.Unlock()
+	now = now.Add(30 * time.Minute)
+	if _, err := r.Find(conn, rerorero); err != nil {
+		t.Errorf("Find() error = %v, want cached", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := r.Find(conn, rerorero); err == nil {
+		t.Error("Find() must refuse a key removed from github once the cache is stale")
+	}
+	if user, err := r.Find(conn, codehex); err != nil || user.UserName != "rerorero" {
+		t.Errorf("Find() = %+v, %v, want the new key", user, err)
+	}
+	if keys, _ := store.Keys(); len(keys["rerorero"].Keys) != 1 {
+		t.Errorf("Keys() = %+v, want the keys replaced", keys)
+	}
+}
+
+func TestGithubKeyRegister_setKeys(t *testing.T) {
+	r := NewGithubKeyRegister(zap.NewNop())
+	key := []byte("key")
+	r.setKeys("alice", CachedKeys{Keys: [][]byte{key}})
+	// the key moved to bob on github, alice's keys are fetched again afterwards
+	r.setKeys("bob", CachedKeys{Keys: [][]byte{key}})
+	r.setKeys("alice", CachedKeys{})
+	if user := r.cache[string(key)]; user != "bob" {
+		t.Errorf("key is cached for %q, want bob", user)
+	}
+}
@@ -4,9 +4,9 @@ go 1.14
 
 require (
 	github.com/google/go-cmp v0.2.0
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.14.1
 	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
-	golang.org/x/sys v0.0.0-20190426135247-a129542de9ae // indirect
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
 )
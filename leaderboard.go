@@ -0,0 +1,353 @@
+package tetris
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrUnknownLeaderboard = xerrors.New("unknown leaderboard")
+	ErrInvalidRecord      = xerrors.New("invalid record")
+	ErrNoRecord           = xerrors.New("no record")
+)
+
+const (
+	// SprintLines is the number of lines a sprint clears
+	SprintLines = 40
+	// UltraFrames is how long an ultra lasts
+	UltraFrames = 2 * 60 * game.FramesPerSecond
+	// MarathonLines is the number of lines a marathon clears if it does not top out
+	MarathonLines = 150
+
+	defaultLeaderboardPageSize = 10
+	maxLeaderboardPageSize     = 100
+)
+
+// LeaderboardMode is what a leaderboard ranks
+type LeaderboardMode string
+
+const (
+	// LeaderboardSprint ranks the fastest sprints, clearing SprintLines
+	LeaderboardSprint LeaderboardMode = "sprint"
+	// LeaderboardUltra ranks the highest scores in UltraFrames
+	LeaderboardUltra LeaderboardMode = "ultra"
+	// LeaderboardMarathon ranks the highest scores of marathons
+	LeaderboardMarathon LeaderboardMode = "marathon"
+	// LeaderboardRanked ranks the ratings of the players of ranked matches
+	LeaderboardRanked LeaderboardMode = "ranked"
+)
+
+// LeaderboardModes are the leaderboards in the order they are shown
+var LeaderboardModes = []LeaderboardMode{LeaderboardSprint, LeaderboardUltra, LeaderboardMarathon, LeaderboardRanked}
+
+// LeaderboardWindow is the period a leaderboard covers
+type LeaderboardWindow string
+
+const (
+	// LeaderboardDaily covers the current day, in UTC
+	LeaderboardDaily LeaderboardWindow = "daily"
+	// LeaderboardWeekly covers the current week from Monday, in UTC
+	LeaderboardWeekly LeaderboardWindow = "weekly"
+	// LeaderboardAllTime covers everything
+	LeaderboardAllTime LeaderboardWindow = "all_time"
+)
+
+// LeaderboardWindows are the windows in the order they are shown
+var LeaderboardWindows = []LeaderboardWindow{LeaderboardDaily, LeaderboardWeekly, LeaderboardAllTime}
+
+// since returns when the window covering now starts
+func (w LeaderboardWindow) since(now time.Time) (time.Time, bool) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch w {
+	case LeaderboardDaily:
+		return day, true
+	case LeaderboardWeekly:
+		// weeks start on Monday
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7), true
+	case LeaderboardAllTime:
+		return time.Time{}, true
+	}
+	return time.Time{}, false
+}
+
+// Record is a finished single player game
+type Record struct {
+	User   string          `json:"user"`
+	Mode   LeaderboardMode `json:"mode"`
+	Score  int64           `json:"score"`
+	Lines  int             `json:"lines"`
+	Frames uint64          `json:"frames"` // the length of the game
+	Time   time.Time       `json:"time"`   // when the game ended
+	Replay string          `json:"replay,omitempty"`
+}
+
+func (r *Record) validate() error {
+	switch r.Mode {
+	case LeaderboardSprint:
+		if r.Lines < SprintLines {
+			return xerrors.Errorf("sprint of %d lines: %w", r.Lines, ErrInvalidRecord)
+		}
+	case LeaderboardUltra:
+		if r.Frames > UltraFrames {
+			return xerrors.Errorf("ultra of %d frames: %w", r.Frames, ErrInvalidRecord)
+		}
+	case LeaderboardMarathon:
+	default:
+		return ErrUnknownLeaderboard
+	}
+	if r.User == "" {
+		return xerrors.Errorf("record without user: %w", ErrInvalidRecord)
+	}
+	return nil
+}
+
+// better reports whether the record ranks before the other one of the same mode, the earlier one wins ties
+func (r *Record) better(other *Record) bool {
+	if r.Mode == LeaderboardSprint {
+		if r.Frames != other.Frames {
+			return r.Frames < other.Frames
+		}
+	} else if r.Score != other.Score {
+		return r.Score > other.Score
+	}
+	return r.Time.Before(other.Time)
+}
+
+// LeaderboardRequest asks for a page of a leaderboard, Page counts from 0
+type LeaderboardRequest struct {
+	Mode     LeaderboardMode   `json:"mode"`
+	Window   LeaderboardWindow `json:"window"`
+	Page     int               `json:"page,omitempty"`
+	PageSize int               `json:"page_size,omitempty"` // 10 if zero
+}
+
+// LeaderboardEntry is the best of a player in a leaderboard
+type LeaderboardEntry struct {
+	Rank   int       `json:"rank"` // from 1
+	User   string    `json:"user"`
+	Score  int64     `json:"score,omitempty"`
+	Lines  int       `json:"lines,omitempty"`
+	Frames uint64    `json:"frames,omitempty"`
+	Rating float64   `json:"rating,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// LeaderboardPage is a page of a leaderboard, Mine is the entry of the player asking if it is ranked
+type LeaderboardPage struct {
+	Mode    LeaderboardMode    `json:"mode"`
+	Window  LeaderboardWindow  `json:"window"`
+	Page    int                `json:"page"`
+	Pages   int                `json:"pages"`
+	Total   int                `json:"total"`
+	Entries []LeaderboardEntry `json:"entries"`
+	Mine    *LeaderboardEntry  `json:"mine,omitempty"`
+}
+
+// LeaderboardsConfig is how leaderboards are kept
+type LeaderboardsConfig struct {
+	// Store keeps the records, a MemoryStore if nil. Share it with Profiles to rank their ratings.
+	Store Store
+	// RankedMode is the mode of ranked matches LeaderboardRanked ranks, the 1v1 queue if empty
+	RankedMode string
+	// Now is the clock of the windows, time.Now if nil
+	Now func() time.Time
+}
+
+func (c LeaderboardsConfig) withDefaults() LeaderboardsConfig {
+	if c.Store == nil {
+		c.Store = NewMemoryStore()
+	}
+	if c.RankedMode == "" {
+		c.RankedMode = string(Queue1v1)
+	}
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	return c
+}
+
+// Leaderboards ranks the records of single player games and the ratings of ranked matches
+type Leaderboards struct {
+	config LeaderboardsConfig
+	logger *zap.Logger
+}
+
+// NewLeaderboards returns the leaderboards of the store. Submit the records ServerGameConfig.OnGameEnd
+// is called with to rank the games run by the server, and register Handler to query them.
+func NewLeaderboards(config LeaderboardsConfig, logger *zap.Logger) *Leaderboards {
+	return &Leaderboards{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+// Submit records a game, it returns true if the game is the personal best of the player
+func (lb *Leaderboards) Submit(record Record) (bool, error) {
+	if err := record.validate(); err != nil {
+		return false, err
+	}
+	pb, err := lb.config.Store.SaveRecord(record)
+	if err != nil {
+		return false, xerrors.Errorf("failed to save record: %w", err)
+	}
+	lb.logger.Info("record submitted", zap.String("user", record.User), zap.String("mode", string(record.Mode)), zap.Bool("personal_best", pb))
+	return pb, nil
+}
+
+// PersonalBest returns the best record of the user in the mode, ErrNoRecord if it has none
+func (lb *Leaderboards) PersonalBest(user string, mode LeaderboardMode) (Record, error) {
+	best, err := lb.config.Store.PersonalBest(user, mode)
+	if err != nil && !xerrors.Is(err, ErrNoRecord) {
+		return Record{}, xerrors.Errorf("failed to get personal best: %w", err)
+	}
+	return best, err
+}
+
+// Page returns a page of a leaderboard, user is the player asking for it
+func (lb *Leaderboards) Page(req LeaderboardRequest, user string) (*LeaderboardPage, error) {
+	since, ok := req.Window.since(lb.config.Now())
+	if !ok {
+		return nil, xerrors.Errorf("window %q: %w", req.Window, ErrUnknownLeaderboard)
+	}
+	size := req.PageSize
+	if size <= 0 {
+		size = defaultLeaderboardPageSize
+	}
+	if size > maxLeaderboardPageSize {
+		size = maxLeaderboardPageSize
+	}
+
+	var entries []LeaderboardEntry
+	var err error
+	if req.Mode == LeaderboardRanked {
+		entries, err = lb.rankRatings(since)
+	} else {
+		entries, err = lb.rankRecords(req.Mode, since)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := &LeaderboardPage{
+		Mode:   req.Mode,
+		Window: req.Window,
+		Page:   req.Page,
+		Pages:  (len(entries) + size - 1) / size,
+		Total:  len(entries),
+	}
+	if start := req.Page * size; req.Page >= 0 && start < len(entries) {
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		page.Entries = entries[start:end]
+	}
+	for i := range entries {
+		if entries[i].User == user {
+			mine := entries[i]
+			page.Mine = &mine
+			break
+		}
+	}
+	return page, nil
+}
+
+// rankRecords ranks the best record of each player in the window.
+// All time is ranked from the personal bests, the other windows from the records since they started.
+func (lb *Leaderboards) rankRecords(mode LeaderboardMode, since time.Time) ([]LeaderboardEntry, error) {
+	switch mode {
+	case LeaderboardSprint, LeaderboardUltra, LeaderboardMarathon:
+	default:
+		return nil, ErrUnknownLeaderboard
+	}
+	var ranked []*Record
+	if since.IsZero() {
+		bests, err := lb.config.Store.PersonalBests(mode)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get personal bests: %w", err)
+		}
+		for i := range bests {
+			ranked = append(ranked, &bests[i])
+		}
+	} else {
+		records, err := lb.config.Store.Records(mode, since)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get records: %w", err)
+		}
+		bests := make(map[string]*Record)
+		for i := range records {
+			r := &records[i]
+			if best, ok := bests[r.User]; !ok || r.better(best) {
+				bests[r.User] = r
+			}
+		}
+		for _, r := range bests {
+			ranked = append(ranked, r)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].better(ranked[j])
+	})
+
+	entries := make([]LeaderboardEntry, len(ranked))
+	for i, r := range ranked {
+		entries[i] = LeaderboardEntry{Rank: i + 1, User: r.User, Score: r.Score, Lines: r.Lines, Frames: r.Frames, Time: r.Time}
+	}
+	return entries, nil
+}
+
+// rankRatings ranks the players that played a ranked match in the window by their ratings
+func (lb *Leaderboards) rankRatings(since time.Time) ([]LeaderboardEntry, error) {
+	profiles, err := lb.config.Store.Profiles()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get profiles: %w", err)
+	}
+
+	var entries []LeaderboardEntry
+	for _, p := range profiles {
+		stats, ok := p.Modes[lb.config.RankedMode]
+		if !ok {
+			continue
+		}
+		var last time.Time
+		for _, res := range p.History {
+			if res.Mode == lb.config.RankedMode {
+				last = res.End
+				break
+			}
+		}
+		if last.Before(since) {
+			continue
+		}
+		entries = append(entries, LeaderboardEntry{User: p.User, Rating: stats.Rating.Rating, Time: last})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Rating > entries[j].Rating
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries, nil
+}
+
+// Handler answers LeaderboardRequests with a LeaderboardPage
+func (lb *Leaderboards) Handler() UnaryHandler {
+	return func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		codec := CodecFromContext(ctx)
+		var r LeaderboardRequest
+		if err := unmarshalPacket(codec, req, &r); err != nil {
+			return nil, err
+		}
+		page, err := lb.Page(r, user.UserName)
+		if err != nil {
+			return nil, err
+		}
+		return marshalPacket(codec, page)
+	}
+}
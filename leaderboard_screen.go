@@ -0,0 +1,157 @@
+package tetris
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/vkg/tetris/game"
+)
+
+const (
+	ansiClear   = "\x1b[H\x1b[2J"
+	ansiReverse = "\x1b[7m"
+	ansiReset   = "\x1b[0m"
+
+	// leaderboardChrome is the number of lines of the screen around the entries
+	leaderboardChrome = 7
+)
+
+// leaderboardScreen is what the leaderboard screen shows
+type leaderboardScreen struct {
+	mode   int // index in LeaderboardModes
+	window int // index in LeaderboardWindows
+	page   int
+}
+
+// handleKey moves the screen with a key, it returns true when the player leaves
+func (s *leaderboardScreen) handleKey(k Key, pages int) bool {
+	switch k.Code {
+	case KeyRight:
+		s.mode = (s.mode + 1) % len(LeaderboardModes)
+		s.page = 0
+	case KeyLeft:
+		s.mode = (s.mode + len(LeaderboardModes) - 1) % len(LeaderboardModes)
+		s.page = 0
+	case KeyTab:
+		s.window = (s.window + 1) % len(LeaderboardWindows)
+		s.page = 0
+	case KeyDown:
+		if s.page+1 < pages {
+			s.page++
+		}
+	case KeyUp:
+		if s.page > 0 {
+			s.page--
+		}
+	case KeyEscape, KeyCtrlC, KeyCtrlD:
+		return true
+	case KeyRune:
+		return k.Rune == 'q'
+	}
+	return false
+}
+
+func (s *leaderboardScreen) request(size WindowSize) LeaderboardRequest {
+	pageSize := size.Height - leaderboardChrome
+	if pageSize < 1 {
+		pageSize = 1
+	}
+	return LeaderboardRequest{
+		Mode:     LeaderboardModes[s.mode],
+		Window:   LeaderboardWindows[s.window],
+		Page:     s.page,
+		PageSize: pageSize,
+	}
+}
+
+// Screen shows the leaderboards on a terminal until the player leaves with q or escape.
+// Left and right switch the mode, tab switches the window, up and down turn the pages.
+func (lb *Leaderboards) Screen(ctx context.Context, term *Terminal) error {
+	s := &leaderboardScreen{}
+	for {
+		page, err := lb.Page(s.request(term.Size()), term.User().UserName)
+		if err != nil {
+			return err
+		}
+		if err := renderLeaderboard(term, page); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-term.Resized():
+		case k := <-term.Keys():
+			if k.Err != nil {
+				return k.Err
+			}
+			if s.handleKey(k.Key, page.Pages) {
+				_, err := io.WriteString(term, ansiClear)
+				return err
+			}
+		}
+	}
+}
+
+// renderLeaderboard draws a page of a leaderboard, the mode and the window shown are highlighted
+func renderLeaderboard(w io.Writer, page *LeaderboardPage) error {
+	var b strings.Builder
+	b.WriteString(ansiClear)
+	b.WriteString("LEADERBOARDS\r\n\r\n")
+	for _, m := range LeaderboardModes {
+		b.WriteString(tab(string(m), m == page.Mode))
+	}
+	b.WriteString("\r\n")
+	for _, win := range LeaderboardWindows {
+		b.WriteString(tab(strings.Replace(string(win), "_", " ", -1), win == page.Window))
+	}
+	b.WriteString("\r\n")
+
+	header := "SCORE"
+	switch page.Mode {
+	case LeaderboardSprint:
+		header = "TIME"
+	case LeaderboardRanked:
+		header = "RATING"
+	}
+	fmt.Fprintf(&b, "%5s  %-20s %12s\r\n", "RANK", "PLAYER", header)
+	for _, e := range page.Entries {
+		fmt.Fprintf(&b, "%5d  %-20s %12s\r\n", e.Rank, e.User, entryValue(page.Mode, &e))
+	}
+	if len(page.Entries) == 0 {
+		b.WriteString("  no records yet\r\n")
+	}
+
+	pages := page.Pages
+	if pages == 0 {
+		pages = 1
+	}
+	fmt.Fprintf(&b, "page %d/%d", page.Page+1, pages)
+	if page.Mine != nil {
+		fmt.Fprintf(&b, "  you: #%d %s", page.Mine.Rank, entryValue(page.Mode, page.Mine))
+	}
+	b.WriteString("\r\n<-/-> mode  tab window  up/down page  q quit")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func tab(name string, selected bool) string {
+	if selected {
+		return ansiReverse + " " + name + " " + ansiReset + " "
+	}
+	return " " + name + "  "
+}
+
+// entryValue is what an entry is ranked by, as shown
+func entryValue(mode LeaderboardMode, e *LeaderboardEntry) string {
+	switch mode {
+	case LeaderboardSprint:
+		return fmt.Sprintf("%.2fs", float64(e.Frames)/game.FramesPerSecond)
+	case LeaderboardRanked:
+		return fmt.Sprintf("%.0f", e.Rating)
+	}
+	return fmt.Sprintf("%d", e.Score)
+}
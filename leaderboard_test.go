@@ -0,0 +1,236 @@
+package tetris
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestLeaderboardWindow_since(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2020, 4, 1, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		window LeaderboardWindow
+		want   time.Time
+	}{
+		{LeaderboardDaily, time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{LeaderboardWeekly, time.Date(2020, 3, 30, 0, 0, 0, 0, time.UTC)},
+		{LeaderboardAllTime, time.Time{}},
+	}
+	for _, tt := range tests {
+		if got, ok := tt.window.since(now); !ok || !got.Equal(tt.want) {
+			t.Errorf("%s since = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+	// a Sunday belongs to the week started on Monday
+	sunday := time.Date(2020, 4, 5, 23, 0, 0, 0, time.UTC)
+	if got, _ := LeaderboardWeekly.since(sunday); !got.Equal(time.Date(2020, 3, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("weekly since = %v", got)
+	}
+}
+
+func TestLeaderboards(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	lb := NewLeaderboards(LeaderboardsConfig{Now: func() time.Time { return now }}, zap.NewNop())
+
+	if _, err := lb.Submit(Record{User: "alice", Mode: LeaderboardSprint, Lines: 39, Frames: 1000, Time: now}); !xerrors.Is(err, ErrInvalidRecord) {
+		t.Errorf("Submit() error = %v, an unfinished sprint must be rejected", err)
+	}
+
+	submit := func(user string, frames uint64, at time.Time) bool {
+		t.Helper()
+		pb, err := lb.Submit(Record{User: user, Mode: LeaderboardSprint, Lines: SprintLines, Frames: frames, Time: at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pb
+	}
+	lastWeek := now.AddDate(0, 0, -7)
+	yesterday := now.AddDate(0, 0, -1)
+	if !submit("alice", 3000, lastWeek) {
+		t.Error("the first record must be a personal best")
+	}
+	if submit("alice", 3100, now) {
+		t.Error("a slower sprint must not be a personal best")
+	}
+	submit("bob", 3050, yesterday)
+	submit("carol", 2900, now)
+	submit("dave", 3200, now)
+
+	if best, err := lb.PersonalBest("alice", LeaderboardSprint); err != nil || best.Frames != 3000 {
+		t.Errorf("PersonalBest() = %+v, %v", best, err)
+	}
+	if _, err := lb.PersonalBest("alice", LeaderboardUltra); !xerrors.Is(err, ErrNoRecord) {
+		t.Errorf("PersonalBest() error = %v, want %v", err, ErrNoRecord)
+	}
+
+	ranking := func(window LeaderboardWindow) string {
+		t.Helper()
+		page, err := lb.Page(LeaderboardRequest{Mode: LeaderboardSprint, Window: window, PageSize: 10}, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var users []string
+		for _, e := range page.Entries {
+			users = append(users, e.User)
+		}
+		return strings.Join(users, ",")
+	}
+	if got, want := ranking(LeaderboardAllTime), "carol,alice,bob,dave"; got != want {
+		t.Errorf("all time = %s, want %s", got, want)
+	}
+	// the best of alice this week is slower than bob
+	if got, want := ranking(LeaderboardWeekly), "carol,bob,alice,dave"; got != want {
+		t.Errorf("weekly = %s, want %s", got, want)
+	}
+	if got, want := ranking(LeaderboardDaily), "carol,alice,dave"; got != want {
+		t.Errorf("daily = %s, want %s", got, want)
+	}
+
+	page, err := lb.Page(LeaderboardRequest{Mode: LeaderboardSprint, Window: LeaderboardAllTime, Page: 1, PageSize: 3}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Pages != 2 || page.Total != 4 || len(page.Entries) != 1 || page.Entries[0].User != "dave" || page.Entries[0].Rank != 4 {
+		t.Errorf("page = %+v", page)
+	}
+	if page.Mine == nil || page.Mine.Rank != 2 || page.Mine.Frames != 3000 {
+		t.Errorf("mine = %+v, want alice on another page", page.Mine)
+	}
+
+	if _, err := lb.Page(LeaderboardRequest{Mode: "tetris", Window: LeaderboardAllTime}, "alice"); !xerrors.Is(err, ErrUnknownLeaderboard) {
+		t.Errorf("Page() error = %v, want %v", err, ErrUnknownLeaderboard)
+	}
+}
+
+func TestLeaderboards_ranked(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	ps := NewProfiles(ProfilesConfig{Store: store}, zap.NewNop())
+	lb := NewLeaderboards(LeaderboardsConfig{Store: store, Now: func() time.Time { return now }}, zap.NewNop())
+
+	match := func(winner, loser string, end time.Time) {
+		ps.RecordMatch(&MatchLog{
+			Mode:    string(Queue1v1),
+			Ranked:  true,
+			Players: []string{winner, loser},
+			Places:  map[string]int{winner: 1, loser: 2},
+			End:     end,
+		})
+	}
+	match("alice", "bob", now.AddDate(0, 0, -10))
+	match("carol", "dave", now)
+
+	page, err := lb.Page(LeaderboardRequest{Mode: LeaderboardRanked, Window: LeaderboardAllTime}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 4 || page.Entries[0].Rating <= page.Entries[3].Rating || page.Entries[3].Rank != 4 {
+		t.Errorf("entries = %+v", page.Entries)
+	}
+	if page.Mine == nil || page.Mine.User != "bob" || page.Mine.Rank < 3 {
+		t.Errorf("mine = %+v", page.Mine)
+	}
+
+	page, err = lb.Page(LeaderboardRequest{Mode: LeaderboardRanked, Window: LeaderboardWeekly}, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.Entries[0].User != "carol" || page.Mine != nil {
+		t.Errorf("page = %+v, want the players of this week", page)
+	}
+}
+
+func TestLeaderboards_Handler(t *testing.T) {
+	addr := "127.0.0.1:31130"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	lb := NewLeaderboards(LeaderboardsConfig{}, zap.NewNop())
+	for i, user := range []string{"alice", "bob", "carol"} {
+		if _, err := lb.Submit(Record{User: user, Mode: LeaderboardUltra, Score: int64(1000 * (i + 1)), Frames: UltraFrames, Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.RegisterUnaryHandler("leaderboard", lb.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("alice", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	sess, err := cli.NewUnarySession("leaderboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var page LeaderboardPage
+	if err := sess.SendAndRecvMsg(&LeaderboardRequest{Mode: LeaderboardUltra, Window: LeaderboardDaily, PageSize: 2}, &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Pages != 2 || len(page.Entries) != 2 || page.Entries[0].User != "carol" || page.Entries[0].Score != 3000 {
+		t.Errorf("page = %+v", page)
+	}
+	if page.Mine == nil || page.Mine.Rank != 3 {
+		t.Errorf("mine = %+v, want the entry of alice", page.Mine)
+	}
+}
+
+func TestLeaderboardScreen(t *testing.T) {
+	s := &leaderboardScreen{}
+	s.handleKey(Key{Code: KeyLeft}, 1)
+	if req := s.request(WindowSize{Width: 80, Height: 17}); req.Mode != LeaderboardRanked || req.PageSize != 10 {
+		t.Errorf("request = %+v, want ranked pages of 10", req)
+	}
+	s.handleKey(Key{Code: KeyTab}, 1)
+	s.handleKey(Key{Code: KeyDown}, 2)
+	s.handleKey(Key{Code: KeyDown}, 2)
+	if req := s.request(WindowSize{Width: 80, Height: 3}); req.Window != LeaderboardWeekly || req.Page != 1 || req.PageSize != 1 {
+		t.Errorf("request = %+v", req)
+	}
+	if s.handleKey(Key{Code: KeyRune, Rune: 'x'}, 2) || !s.handleKey(Key{Code: KeyRune, Rune: 'q'}, 2) {
+		t.Error("q must leave the screen")
+	}
+
+	var b bytes.Buffer
+	page := &LeaderboardPage{
+		Mode:    LeaderboardSprint,
+		Window:  LeaderboardAllTime,
+		Pages:   1,
+		Entries: []LeaderboardEntry{{Rank: 1, User: "carol", Frames: 2900}},
+		Mine:    &LeaderboardEntry{Rank: 1, User: "carol", Frames: 2900},
+	}
+	if err := renderLeaderboard(&b, page); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{ansiReverse + " sprint ", ansiReverse + " all time ", "carol", "48.33s", "page 1/1", "you: #1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("screen does not show %q:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "\r\n"); n != leaderboardChrome+len(page.Entries)-1 {
+		t.Errorf("screen has %d lines, want %d", n+1, leaderboardChrome+len(page.Entries))
+	}
+}
@@ -0,0 +1,490 @@
+package tetris
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrRoomNotFound   = xerrors.New("room not found")
+	ErrRoomFull       = xerrors.New("room is full")
+	ErrRoomPlaying    = xerrors.New("room is playing")
+	ErrWrongPassword  = xerrors.New("wrong password")
+	ErrNotRoomOwner   = xerrors.New("not the owner of the room")
+	ErrAlreadyInRoom  = xerrors.New("already in a room")
+	ErrNotInRoom      = xerrors.New("not in a room")
+	ErrInvalidOptions = xerrors.New("invalid room options")
+)
+
+const (
+	maxRoomPlayers = 8
+	maxRoomSpeed   = 20
+	// lobbySendQueue is the number of messages queued for a player, a player falling further behind is disconnected
+	lobbySendQueue = 64
+)
+
+// LobbyMessageType is the kind of a message of the lobby
+type LobbyMessageType string
+
+const (
+	// LobbyList asks for the Rooms
+	LobbyList LobbyMessageType = "list"
+	// LobbyCreate creates a room with Name, Options and an optional Password, the creator joins it as the owner
+	LobbyCreate LobbyMessageType = "create"
+	// LobbyJoin joins the room RoomID with its Password
+	LobbyJoin LobbyMessageType = "join"
+	// LobbyLeave leaves the room
+	LobbyLeave LobbyMessageType = "leave"
+	// LobbyOptions changes the Options of the room, only the owner may
+	LobbyOptions LobbyMessageType = "options"
+	// LobbyReady marks the player Ready or not, the room starts playing once every player is ready
+	LobbyReady LobbyMessageType = "ready"
+	// LobbyReply answers the request with the same ID, Error is set if it failed
+	LobbyReply LobbyMessageType = "reply"
+	// LobbyRoom is pushed to the players of a room whenever it changes
+	LobbyRoom LobbyMessageType = "room"
+)
+
+// LobbyMessage is a request to the lobby, a reply or an update pushed by it
+type LobbyMessage struct {
+	Type     LobbyMessageType `json:"type"`
+	ID       uint32           `json:"id,omitempty"`
+	RoomID   string           `json:"room_id,omitempty"`
+	Name     string           `json:"name,omitempty"`
+	Password string           `json:"password,omitempty"`
+	Options  *RoomOptions     `json:"options,omitempty"`
+	Ready    bool             `json:"ready,omitempty"`
+	Room     *Room            `json:"room,omitempty"`
+	Rooms    []Room           `json:"rooms,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// RoomOptions is how the games of a room are played
+type RoomOptions struct {
+	Mode       string `json:"mode"`
+	MaxPlayers int    `json:"max_players"`
+	Speed      int    `json:"speed"` // the start level
+}
+
+// DefaultRoomOptions are the options of rooms created without options
+var DefaultRoomOptions = RoomOptions{Mode: "versus", MaxPlayers: 2, Speed: 1}
+
+func (o RoomOptions) validate() error {
+	if o.Mode == "" || o.MaxPlayers < 2 || o.MaxPlayers > maxRoomPlayers || o.Speed < 1 || o.Speed > maxRoomSpeed {
+		return ErrInvalidOptions
+	}
+	return nil
+}
+
+// Room is a room as the players see it
+type Room struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Owner   string       `json:"owner"`
+	Options RoomOptions  `json:"options"`
+	Locked  bool         `json:"locked"` // a password is needed to join
+	Playing bool         `json:"playing"`
+	Members []RoomMember `json:"members"`
+}
+
+// RoomMember is a player in a room
+type RoomMember struct {
+	User  string `json:"user"`
+	Ready bool   `json:"ready"`
+}
+
+type room struct {
+	id       string
+	name     string
+	options  RoomOptions
+	password []byte // bcrypt hash, nil if the room is open
+	playing  bool
+	members  []*RoomMember // the first one owns the room
+}
+
+func (r *room) view() Room {
+	v := Room{
+		ID:      r.id,
+		Name:    r.name,
+		Options: r.options,
+		Locked:  r.password != nil,
+		Playing: r.playing,
+		Members: make([]RoomMember, len(r.members)),
+	}
+	for i, m := range r.members {
+		v.Members[i] = *m
+	}
+	if len(r.members) > 0 {
+		v.Owner = r.members[0].User
+	}
+	return v
+}
+
+func (r *room) member(user string) (int, *RoomMember) {
+	for i, m := range r.members {
+		if m.User == user {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+// Lobby lets players gather in rooms before they play
+type Lobby struct {
+	mux     sync.Mutex
+	rooms   map[string]*room
+	players map[string]*lobbyPlayer // user name -> player
+	nextID  int
+	onStart func(Room)
+	logger  *zap.Logger
+}
+
+type lobbyPlayer struct {
+	queue *sendQueue // the replies and pushes to the latest stream of the player
+	room  *room
+}
+
+// NewLobby returns a lobby, onStart is called with a room once all of its players are ready. It must not block.
+func NewLobby(onStart func(Room), logger *zap.Logger) *Lobby {
+	return &Lobby{
+		rooms:   make(map[string]*room),
+		players: make(map[string]*lobbyPlayer),
+		onStart: onStart,
+		logger:  logger,
+	}
+}
+
+// A player connecting again takes over its room from the older stream, which is closed.
+// A player connecting again takes over its room from the older stream.
+func (l *Lobby) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		user := stream.User().UserName
+		q := l.enter(user, stream)
+		defer q.flush(ctx)
+		defer l.exit(user, q)
+
+		for {
+			var req LobbyMessage
+			if err := stream.RecvMsgContext(ctx, &req); err != nil {
+				if !xerrors.Is(err, io.EOF) && !xerrors.Is(err, context.Canceled) {
+					l.logger.Info("failed to receive lobby request", zap.String("user", user), zap.Error(err))
+				}
+				return
+			}
+			l.handle(user, q, &req)
+		}
+	}
+}
+
+func (l *Lobby) enter(user string, stream *ServerStream) *sendQueue {
+	q := newSendQueue(stream, lobbySendQueue, l.logger.With(zap.String("user", user)))
+	l.mux.Lock()
+	p, ok := l.players[user]
+	var older *sendQueue
+	if ok {
+		older = p.queue
+	} else {
+		p = &lobbyPlayer{}
+		l.players[user] = p
+	}
+	p.queue = q
+	l.mux.Unlock()
+
+	// the older stream is taken over, it is closed outside the lock as closing it may write to the client
+	if older != nil {
+		older.stream.Close()
+	}
+	return q
+}
+
+func (l *Lobby) exit(user string, q *sendQueue) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	q.close()
+	p, ok := l.players[user]
+	if !ok || p.queue != q {
+		// taken over by a newer stream
+		return
+	}
+	l.leave(user, p)
+	delete(l.players, user)
+}
+
+// handle answers a request of the player on the stream of q
+func (l *Lobby) handle(user string, q *sendQueue, req *LobbyMessage) {
+	// bcrypt is slow on purpose, the passwords are hashed and checked before the lobby is locked
+	password, err := l.password(req)
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	reply := &LobbyMessage{Type: LobbyReply, ID: req.ID}
+	defer q.send(reply)
+	if err != nil {
+		reply.Error = err.Error()
+		return
+	}
+
+	p, ok := l.players[user]
+	if !ok || p.queue != q {
+		// the stream was taken over, the request is left to the newer stream
+		reply.Error = ErrNotInRoom.Error()
+		return
+	}
+	switch req.Type {
+	case LobbyList:
+		reply.Rooms = l.list()
+	case LobbyCreate:
+		err = l.create(user, p, req, password)
+	case LobbyJoin:
+		err = l.join(user, p, req, password)
+	case LobbyLeave:
+		if p.room == nil {
+			err = ErrNotInRoom
+			break
+		}
+		l.leave(user, p)
+	case LobbyOptions:
+		err = l.setOptions(user, p, req.Options)
+	case LobbyReady:
+		err = l.setReady(user, p, req.Ready)
+	default:
+		err = xerrors.Errorf("unknown lobby request %q", req.Type)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		return
+	}
+	if p.room != nil && req.Type != LobbyList {
+		v := p.room.view()
+		reply.Room = &v
+	}
+}
+
+// password returns the hash of the password of a room to create, or the hash of the room to join
+// once the password of the request matches it
+func (l *Lobby) password(req *LobbyMessage) ([]byte, error) {
+	switch req.Type {
+	case LobbyCreate:
+		if req.Password == "" {
+			return nil, nil
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to hash room password: %w", err)
+		}
+		return hash, nil
+	case LobbyJoin:
+		l.mux.Lock()
+		var hash []byte
+		if r, ok := l.rooms[req.RoomID]; ok {
+			hash = r.password
+		}
+		l.mux.Unlock()
+		if hash != nil && bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil {
+			return nil, ErrWrongPassword
+		}
+		return hash, nil
+	}
+	return nil, nil
+}
+
+func (l *Lobby) list() []Room {
+	rooms := make([]Room, 0, len(l.rooms))
+	for _, r := range l.rooms {
+		rooms = append(rooms, r.view())
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		a, _ := strconv.Atoi(rooms[i].ID)
+		b, _ := strconv.Atoi(rooms[j].ID)
+		return a < b
+	})
+	return rooms
+}
+
+func (l *Lobby) create(user string, p *lobbyPlayer, req *LobbyMessage, password []byte) error {
+	if p.room != nil {
+		return ErrAlreadyInRoom
+	}
+	options := DefaultRoomOptions
+	if req.Options != nil {
+		options = *req.Options
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+
+	l.nextID++
+	r := &room{
+		id:       strconv.Itoa(l.nextID),
+		name:     req.Name,
+		options:  options,
+		members:  []*RoomMember{{User: user}},
+		password: password,
+	}
+	l.rooms[r.id] = r
+	p.room = r
+	l.logger.Info("room created", zap.String("room", r.id), zap.String("owner", user))
+	return nil
+}
+
+// join adds the player to a room, checked is the hash of the room the password of the request was checked against
+func (l *Lobby) join(user string, p *lobbyPlayer, req *LobbyMessage, checked []byte) error {
+	if p.room != nil {
+		return ErrAlreadyInRoom
+	}
+	r, ok := l.rooms[req.RoomID]
+	switch {
+	case !ok:
+		return ErrRoomNotFound
+	case r.playing:
+		return ErrRoomPlaying
+	case len(r.members) >= r.options.MaxPlayers:
+		return ErrRoomFull
+	}
+	if r.password != nil && !bytes.Equal(r.password, checked) {
+		return ErrWrongPassword
+	}
+	r.members = append(r.members, &RoomMember{User: user})
+	p.room = r
+	l.push(r)
+	return nil
+}
+
+// leave takes the player out of its room, the next player owns the room if the owner leaves
+func (l *Lobby) leave(user string, p *lobbyPlayer) {
+	r := p.room
+	if r == nil {
+		return
+	}
+	p.room = nil
+	i, _ := r.member(user)
+	if i < 0 {
+		return
+	}
+	r.members = append(r.members[:i], r.members[i+1:]...)
+	if len(r.members) == 0 {
+		delete(l.rooms, r.id)
+		l.logger.Info("room closed", zap.String("room", r.id))
+		return
+	}
+	l.push(r)
+}
+
+func (l *Lobby) setOptions(user string, p *lobbyPlayer, options *RoomOptions) error {
+	r := p.room
+	switch {
+	case r == nil:
+		return ErrNotInRoom
+	case r.members[0].User != user:
+		return ErrNotRoomOwner
+	case r.playing:
+		return ErrRoomPlaying
+	case options == nil:
+		return ErrInvalidOptions
+	}
+	if err := options.validate(); err != nil {
+		return err
+	}
+	if options.MaxPlayers < len(r.members) {
+		return xerrors.Errorf("%d players are in the room: %w", len(r.members), ErrInvalidOptions)
+	}
+	r.options = *options
+	// the players agreed to other options
+	for _, m := range r.members {
+		m.Ready = false
+	}
+	l.push(r)
+	return nil
+}
+
+func (l *Lobby) setReady(user string, p *lobbyPlayer, ready bool) error {
+	r := p.room
+	switch {
+	case r == nil:
+		return ErrNotInRoom
+	case r.playing:
+		return ErrRoomPlaying
+	}
+	_, m := r.member(user)
+	m.Ready = ready
+
+	all := len(r.members) >= 2
+	for _, m := range r.members {
+		all = all && m.Ready
+	}
+	if all {
+		r.playing = true
+		l.logger.Info("room started playing", zap.String("room", r.id))
+		if l.onStart != nil {
+			l.onStart(r.view())
+		}
+	}
+	l.push(r)
+	return nil
+}
+
+// EndGame brings a room back from playing, its players have to get ready again
+func (l *Lobby) EndGame(roomID string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	r, ok := l.rooms[roomID]
+	if !ok {
+		return ErrRoomNotFound
+	}
+	r.playing = false
+	for _, m := range r.members {
+		m.Ready = false
+	}
+	l.push(r)
+	return nil
+}
+
+// Room returns the room with the id
+func (l *Lobby) Room(id string) (Room, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	r, ok := l.rooms[id]
+	if !ok {
+		return Room{}, false
+	}
+	return r.view(), true
+}
+
+// RoomID returns the id of the room every player is in, empty if they are not all in the same room.
+// Set it as VersusConfig.RoomID to watch the matches of rooms by their id.
+func (l *Lobby) RoomID(players []string) string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(players) == 0 {
+		return ""
+	}
+	p, ok := l.players[players[0]]
+	if !ok || p.room == nil {
+		return ""
+	}
+	for _, user := range players[1:] {
+		if i, _ := p.room.member(user); i < 0 {
+			return ""
+		}
+	}
+	return p.room.id
+}
+
+// push queues the room for its players
+func (l *Lobby) push(r *room) {
+	v := r.view()
+	msg := &LobbyMessage{Type: LobbyRoom, Room: &v}
+	for _, m := range r.members {
+		if p, ok := l.players[m.User]; ok {
+			p.queue.send(msg)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package tetris
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// lobbyClient splits the replies of the lobby from the rooms it pushes
+type lobbyClient struct {
+	t       *testing.T
+	stream  *ClientStream
+	lastID  uint32
+	replies chan *LobbyMessage
+	rooms   chan *Room
+}
+
+func newLobbyClient(t *testing.T, addr, user string) *lobbyClient {
+	cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	stream, err := cli.NewStreamSession(context.Background(), "lobby", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &lobbyClient{
+		t:       t,
+		stream:  stream,
+		replies: make(chan *LobbyMessage, 16),
+		rooms:   make(chan *Room, 16),
+	}
+	go func() {
+		for {
+			var msg LobbyMessage
+			if err := stream.RecvMsg(&msg); err != nil {
+				return
+			}
+			if msg.Type == LobbyRoom {
+				c.rooms <- msg.Room
+			} else {
+				c.replies <- &msg
+			}
+		}
+	}()
+	return c
+}
+
+func (c *lobbyClient) request(req *LobbyMessage) *LobbyMessage {
+	c.t.Helper()
+	c.lastID++
+	req.ID = c.lastID
+	if err := c.stream.SendMsg(req); err != nil {
+		c.t.Fatal(err)
+	}
+	select {
+	case reply := <-c.replies:
+		if reply.ID != req.ID {
+			c.t.Fatalf("reply to %d, want %d", reply.ID, req.ID)
+		}
+		return reply
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("no reply to %s", req.Type)
+		return nil
+	}
+}
+
+// room waits for a room pushed by the lobby
+func (c *lobbyClient) room() *Room {
+	c.t.Helper()
+	select {
+	case r := <-c.rooms:
+		return r
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no room is pushed")
+		return nil
+	}
+}
+
+func TestLobby(t *testing.T) {
+	addr := "127.0.0.1:31126"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	started := make(chan Room, 1)
+	lobby := NewLobby(func(r Room) {
+		started <- r
+	}, zap.NewNop())
+	server.RegisterHandler("lobby", lobby.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	alice := newLobbyClient(t, addr, "alice")
+	bob := newLobbyClient(t, addr, "bob")
+
+	created := alice.request(&LobbyMessage{Type: LobbyCreate, Name: "friends", Password: "secret"})
+	if created.Error != "" || created.Room.Owner != "alice" || !created.Room.Locked {
+		t.Fatalf("create = %+v", created)
+	}
+	id := created.Room.ID
+
+	list := bob.request(&LobbyMessage{Type: LobbyList})
+	if len(list.Rooms) != 1 || list.Rooms[0].ID != id || list.Rooms[0].Options != DefaultRoomOptions {
+		t.Errorf("list = %+v", list.Rooms)
+	}
+
+	if reply := bob.request(&LobbyMessage{Type: LobbyJoin, RoomID: id, Password: "guess"}); reply.Error != ErrWrongPassword.Error() {
+		t.Errorf("join error = %q, want %q", reply.Error, ErrWrongPassword)
+	}
+	if reply := bob.request(&LobbyMessage{Type: LobbyJoin, RoomID: id, Password: "secret"}); reply.Error != "" || len(reply.Room.Members) != 2 {
+		t.Errorf("join = %+v", reply)
+	}
+	if r := alice.room(); len(r.Members) != 2 || r.Members[1].User != "bob" {
+		t.Errorf("room = %+v, want bob joined", r)
+	}
+	bob.room()
+
+	// only the owner changes the options
+	options := RoomOptions{Mode: "versus", MaxPlayers: 4, Speed: 5}
+	if reply := bob.request(&LobbyMessage{Type: LobbyOptions, Options: &options}); reply.Error != ErrNotRoomOwner.Error() {
+		t.Errorf("options error = %q, want %q", reply.Error, ErrNotRoomOwner)
+	}
+	if reply := alice.request(&LobbyMessage{Type: LobbyOptions, Options: &options}); reply.Error != "" || reply.Room.Options != options {
+		t.Errorf("options = %+v", reply)
+	}
+	if r := bob.room(); r.Options != options {
+		t.Errorf("room = %+v, want new options", r)
+	}
+	alice.room()
+
+	bob.request(&LobbyMessage{Type: LobbyReady, Ready: true})
+	alice.room()
+	bob.room()
+	alice.request(&LobbyMessage{Type: LobbyReady, Ready: true})
+	select {
+	case r := <-started:
+		if r.ID != id || len(r.Members) != 2 {
+			t.Errorf("started = %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("room must start once everyone is ready")
+	}
+	if r := bob.room(); !r.Playing {
+		t.Errorf("room = %+v, want playing", r)
+	}
+	if got := lobby.RoomID([]string{"bob", "alice"}); got != id {
+		t.Errorf("RoomID() = %q, want %q", got, id)
+	}
+	if got := lobby.RoomID([]string{"alice", "carol"}); got != "" {
+		t.Errorf("RoomID() = %q, want none", got)
+	}
+	alice.room()
+
+	if err := lobby.EndGame(id); err != nil {
+		t.Fatal(err)
+	}
+	if r := alice.room(); r.Playing || r.Members[0].Ready {
+		t.Errorf("room = %+v, want back from playing", r)
+	}
+	bob.room()
+
+	// the room goes to bob when alice leaves, it is closed when bob leaves
+	alice.stream.CloseSend()
+	if r := bob.room(); r.Owner != "bob" || len(r.Members) != 1 {
+		t.Errorf("room = %+v, want owned by bob", r)
+	}
+	bob.request(&LobbyMessage{Type: LobbyLeave})
+	if _, ok := lobby.Room(id); ok {
+		t.Error("room must be closed")
+	}
+}
+
+func TestLobby_SlowPlayer(t *testing.T) {
+	lobby := NewLobby(nil, zap.NewNop())
+	owner := lobby.enter("alice", discardStream(t))
+	slow := lobby.enter("bob", stuckStream(t))
+	lobby.handle("alice", owner, &LobbyMessage{Type: LobbyCreate, Name: "friends", Password: "secret"})
+	lobby.handle("bob", slow, &LobbyMessage{Type: LobbyJoin, RoomID: "1", Password: "secret"})
+	if r, _ := lobby.Room("1"); len(r.Members) != 2 {
+		t.Fatalf("room = %+v, want bob joined", r)
+	}
+
+	// every change is pushed to bob, who never reads them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*lobbySendQueue; i++ {
+			lobby.handle("alice", owner, &LobbyMessage{Type: LobbyOptions, Options: &RoomOptions{Mode: "versus", MaxPlayers: 2 + i%2, Speed: 1}})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lobby is blocked by a player that does not read")
+	}
+	select {
+	case <-slow.stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a player falling behind must be disconnected")
+	}
+}
+
+func TestLobby_TakeOver(t *testing.T) {
+	lobby := NewLobby(nil, zap.NewNop())
+	older := lobby.enter("alice", discardStream(t))
+	newer := lobby.enter("alice", discardStream(t))
+	select {
+	case <-older.stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the stream taken over must be closed")
+	}
+
+	// the newer stream leaves while a request of the older one is still served
+	lobby.exit("alice", newer)
+	lobby.handle("alice", older, &LobbyMessage{Type: LobbyCreate, Name: "friends"})
+	if _, ok := lobby.Room("1"); ok {
+		t.Error("a stream taken over must not create a room")
+	}
+}
@@ -0,0 +1,594 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrUnknownQueue  = xerrors.New("unknown queue")
+	ErrAlreadyQueued = xerrors.New("already in a queue")
+	ErrNotQueued     = xerrors.New("not in a queue")
+	ErrNoMatchFound  = xerrors.New("no match is found")
+	ErrQueuePenalty  = xerrors.New("not allowed to queue yet")
+)
+
+// matchmakingSendQueue is the number of messages queued for a player, a player falling further behind is disconnected
+const matchmakingSendQueue = 16
+
+// QueueType is a kind of matches players queue for
+type QueueType string
+
+const (
+	// Queue1v1 matches two players
+	Queue1v1 QueueType = "1v1"
+	// QueueFFA matches MatchmakingConfig.FFAPlayers players, the last one standing wins
+	QueueFFA QueueType = "ffa"
+)
+
+// MatchmakingMessageType is the kind of a message of the matchmaking
+type MatchmakingMessageType string
+
+const (
+	// MatchmakingQueue is sent by a player to search a match of Queue
+	MatchmakingQueue MatchmakingMessageType = "queue"
+	// MatchmakingCancel is sent by a player to leave the queue, cancelling a match found is dodging it
+	MatchmakingCancel MatchmakingMessageType = "cancel"
+	// MatchmakingAccept is sent by a player to play the match found, the player can not cancel afterwards
+	MatchmakingAccept MatchmakingMessageType = "accept"
+	// MatchmakingDecline is sent by a player to dodge the match found
+	MatchmakingDecline MatchmakingMessageType = "decline"
+	// MatchmakingQueued tells a player that it searches a match of Queue with its Rating
+	MatchmakingQueued MatchmakingMessageType = "queued"
+	// MatchmakingFound tells a player that a match with Players is found, every player must accept it before Deadline.
+	// Once all of them accepted, the stream carries the messages of the versus match, starting with VersusStart.
+	MatchmakingFound MatchmakingMessageType = "found"
+	// MatchmakingRequeued tells a player that another player dodged the match found, the player searches again
+	MatchmakingRequeued MatchmakingMessageType = "requeued"
+	// MatchmakingCancelled tells a player that it left the queue, it may queue again after Until
+	MatchmakingCancelled MatchmakingMessageType = "cancelled"
+	// MatchmakingPenalized tells a player that it dodged the match found, it may queue again after Until
+	MatchmakingPenalized MatchmakingMessageType = "penalized"
+	// MatchmakingError tells a player why its message failed, Until is set if it may not queue yet
+	MatchmakingError MatchmakingMessageType = "error"
+)
+
+// MatchmakingMessage is a message of the matchmaking, the fields set depend on Type
+type MatchmakingMessage struct {
+	Type     MatchmakingMessageType `json:"type"`
+	Queue    QueueType              `json:"queue,omitempty"`
+	Rating   float64                `json:"rating,omitempty"`
+	Players  []string               `json:"players,omitempty"`
+	Deadline time.Time              `json:"deadline,omitempty"`
+	Until    time.Time              `json:"until,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// MatchmakingConfig is how players are matched
+type MatchmakingConfig struct {
+	// Now is the clock of the matchmaking, time.Now if nil
+	Now func() time.Time
+	// Interval is the time between searches of Run, a second if zero
+	Interval time.Duration
+	// Rating returns the rating of a player in a queue, 1500 for everyone if nil
+	Rating func(user string, queue QueueType) float64
+	// InitialWindow is how far apart the ratings of players matched as soon as they queue may be, 50 if zero
+	InitialWindow float64
+	// WindowGrowth widens the window of a player per second it waits, 10 if zero
+	WindowGrowth float64
+	// MaxWindow caps the window, 400 if zero
+	MaxWindow float64
+	// FFAPlayers is the number of players of a free-for-all match, 4 if less than 3
+	FFAPlayers int
+	// AcceptTimeout is the time players have to accept a match, the players that did not accept it dodged it. 10s if zero.
+	AcceptTimeout time.Duration
+	// CancelCooldown is the time a player waits to queue again after cancelling, 5s if zero
+	CancelCooldown time.Duration
+	// DodgePenalty is the time a player waits to queue again after dodging a match, 1m if zero.
+	// It doubles with every dodge until the player plays a match.
+	DodgePenalty time.Duration
+	// MaxDodgePenalty caps the penalty, 30m if zero
+	MaxDodgePenalty time.Duration
+	// Versus is the rules of the matches. Players is ignored, the matches are ranked with the queue as their mode.
+	Versus VersusConfig
+}
+
+func (c MatchmakingConfig) withDefaults() MatchmakingConfig {
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+	if c.Rating == nil {
+		c.Rating = func(string, QueueType) float64 {
+			return 1500
+		}
+	}
+	if c.InitialWindow <= 0 {
+		c.InitialWindow = 50
+	}
+	if c.WindowGrowth <= 0 {
+		c.WindowGrowth = 10
+	}
+	if c.MaxWindow <= 0 {
+		c.MaxWindow = 400
+	}
+	if c.FFAPlayers < 3 {
+		c.FFAPlayers = 4
+	}
+	if c.AcceptTimeout <= 0 {
+		c.AcceptTimeout = 10 * time.Second
+	}
+	if c.CancelCooldown <= 0 {
+		c.CancelCooldown = 5 * time.Second
+	}
+	if c.DodgePenalty <= 0 {
+		c.DodgePenalty = time.Minute
+	}
+	if c.MaxDodgePenalty <= 0 {
+		c.MaxDodgePenalty = 30 * time.Minute
+	}
+	return c
+}
+
+// Matchmaker pairs queued players of close ratings into versus matches.
+// The window of ratings a player accepts widens while it waits, call Tick or Run to search matches.
+type Matchmaker struct {
+	config    MatchmakingConfig
+	logger    *zap.Logger
+	versus    map[QueueType]*Versus
+	mux       sync.Mutex
+	queues    map[QueueType][]*matchmakingPlayer // in the order of queueing
+	penalties map[string]*queuePenalty           // user name -> penalty
+}
+
+type matchmakingPlayer struct {
+	name     string
+	stream   *ServerStream
+	out      *sendQueue // the matchmaking messages, the versus match queues its own
+	versus   *versusPlayer
+	queue    QueueType // empty unless queued
+	rating   float64
+	since    time.Time   // when the player queued, kept when requeued
+	found    *foundMatch // the match found for the player, it stays in the queue until the match starts
+	accepted bool
+	started  bool
+	requeued chan struct{} // signals an accepted player that the match was dodged
+}
+
+type foundMatch struct {
+	players  []*matchmakingPlayer
+	deadline time.Time
+}
+
+type queuePenalty struct {
+	until  time.Time
+	dodges int // dodges since the last match played
+}
+
+// NewMatchmaker returns a matchmaking, register Handler to serve it and Run to search matches
+func NewMatchmaker(config MatchmakingConfig, logger *zap.Logger) *Matchmaker {
+	config = config.withDefaults()
+	mm := &Matchmaker{
+		config:    config,
+		logger:    logger,
+		versus:    make(map[QueueType]*Versus),
+		queues:    make(map[QueueType][]*matchmakingPlayer),
+		penalties: make(map[string]*queuePenalty),
+	}
+	for _, queue := range []QueueType{Queue1v1, QueueFFA} {
+		versus := config.Versus
+		versus.Mode, versus.Ranked = string(queue), true
+		mm.versus[queue] = NewVersus(versus, logger)
+	}
+	return mm
+}
+
+func (mm *Matchmaker) size(queue QueueType) int {
+	switch queue {
+	case Queue1v1:
+		return 2
+	case QueueFFA:
+		return mm.config.FFAPlayers
+	}
+	return 0
+}
+
+// Handler serves a player until its match is over or it leaves
+func (mm *Matchmaker) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		p := &matchmakingPlayer{
+			name:   stream.User().UserName,
+			stream: stream,
+			versus: &versusPlayer{
+				stream:  stream,
+				name:    stream.User().UserName,
+				matched: make(chan *versusMatch, 1),
+			},
+			requeued: make(chan struct{}, 1),
+		}
+		p.out = newSendQueue(stream, matchmakingSendQueue, mm.logger.With(zap.String("user", p.name)))
+		defer p.out.flush(ctx)
+		defer mm.closeQueue(p)
+
+		for {
+			var msg MatchmakingMessage
+			if err := stream.RecvMsgContext(ctx, &msg); err != nil {
+				if !xerrors.Is(err, io.EOF) && !xerrors.Is(err, context.Canceled) {
+					mm.logger.Info("failed to receive matchmaking message", zap.String("user", p.name), zap.Error(err))
+				}
+				mm.leave(p)
+				return
+			}
+
+			var err error
+			switch msg.Type {
+			case MatchmakingQueue:
+				err = mm.enqueue(p, msg.Queue)
+			case MatchmakingCancel:
+				err = mm.cancel(p)
+			case MatchmakingDecline:
+				err = mm.decline(p)
+			case MatchmakingAccept:
+				if err = mm.accept(p); err != nil {
+					break
+				}
+				var m *versusMatch
+				select {
+				case m = <-p.versus.matched:
+				case <-p.requeued:
+					continue
+				case <-ctx.Done():
+				case <-stream.Done():
+				}
+				if m == nil && !mm.leave(p) {
+					// started while leaving, the match sees the player gone
+					m = <-p.versus.matched
+					m.eliminate(p.versus)
+					return
+				}
+				if m != nil {
+					m.serve(ctx, p.versus)
+				}
+				return
+			default:
+				err = xerrors.Errorf("unexpected matchmaking message %q", msg.Type)
+			}
+			if err != nil {
+				reply := &MatchmakingMessage{Type: MatchmakingError, Error: err.Error()}
+				if xerrors.Is(err, ErrQueuePenalty) {
+					reply.Until = mm.penaltyUntil(p.name)
+				}
+				mm.reply(p, reply)
+			}
+		}
+	}
+}
+
+func (mm *Matchmaker) reply(p *matchmakingPlayer, msg *MatchmakingMessage) {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	mm.send(p, msg)
+}
+
+func (mm *Matchmaker) closeQueue(p *matchmakingPlayer) {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	p.out.close()
+}
+
+func (mm *Matchmaker) penaltyUntil(user string) time.Time {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	if penalty, ok := mm.penalties[user]; ok {
+		return penalty.until
+	}
+	return time.Time{}
+}
+
+func (mm *Matchmaker) enqueue(p *matchmakingPlayer, queue QueueType) error {
+	if mm.size(queue) == 0 {
+		return ErrUnknownQueue
+	}
+	// the rating may be read from the store, it is not read under the lock
+	rating := mm.config.Rating(p.name, queue)
+
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	now := mm.config.Now()
+	switch {
+	case p.queue != "" || mm.queued(p.name):
+		return ErrAlreadyQueued
+	}
+	if penalty, ok := mm.penalties[p.name]; ok && now.Before(penalty.until) {
+		return ErrQueuePenalty
+	}
+
+	p.queue = queue
+	p.rating = rating
+	p.since = now
+	mm.queues[queue] = append(mm.queues[queue], p)
+	mm.send(p, &MatchmakingMessage{Type: MatchmakingQueued, Queue: queue, Rating: p.rating})
+	return nil
+}
+
+// queued reports whether the user searches a match in any queue, from this stream or another one
+func (mm *Matchmaker) queued(user string) bool {
+	for _, waiting := range mm.queues {
+		for _, w := range waiting {
+			if w.name == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cancel takes a searching player out of its queue, a player cancelling a match found dodges it
+func (mm *Matchmaker) cancel(p *matchmakingPlayer) error {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	switch {
+	case p.queue == "":
+		return ErrNotQueued
+	case p.found != nil:
+		mm.dodge(p.found, []*matchmakingPlayer{p})
+		return nil
+	}
+
+	mm.remove(p)
+	until := mm.config.Now().Add(mm.config.CancelCooldown)
+	penalty := mm.penalty(p.name)
+	if until.After(penalty.until) {
+		penalty.until = until
+	}
+	mm.send(p, &MatchmakingMessage{Type: MatchmakingCancelled, Until: penalty.until})
+	return nil
+}
+
+func (mm *Matchmaker) decline(p *matchmakingPlayer) error {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	if p.found == nil {
+		return ErrNoMatchFound
+	}
+	mm.dodge(p.found, []*matchmakingPlayer{p})
+	return nil
+}
+
+// accept marks a player ready to play the match found, the match starts once every player accepted it
+func (mm *Matchmaker) accept(p *matchmakingPlayer) error {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	found := p.found
+	if found == nil {
+		return ErrNoMatchFound
+	}
+	p.accepted = true
+	for _, w := range found.players {
+		if !w.accepted {
+			return nil
+		}
+	}
+
+	queue := p.queue
+	players := make([]*versusPlayer, len(found.players))
+	for i, w := range found.players {
+		mm.remove(w)
+		w.found, w.accepted, w.started = nil, false, true
+		if penalty, ok := mm.penalties[w.name]; ok {
+			penalty.dodges = 0
+		}
+		players[i] = w.versus
+	}
+	mm.versus[queue].start(players)
+	return nil
+}
+
+// leave takes a player out of the matchmaking when its stream ends, it returns false if its match started
+func (mm *Matchmaker) leave(p *matchmakingPlayer) bool {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	if p.started {
+		return false
+	}
+	if p.found != nil {
+		mm.dodge(p.found, []*matchmakingPlayer{p})
+	} else if p.queue != "" {
+		mm.remove(p)
+	}
+	return true
+}
+
+// remove takes a player out of its queue
+func (mm *Matchmaker) remove(p *matchmakingPlayer) {
+	waiting := mm.queues[p.queue]
+	for i, w := range waiting {
+		if w == p {
+			mm.queues[p.queue] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	p.queue = ""
+}
+
+func (mm *Matchmaker) penalty(user string) *queuePenalty {
+	penalty, ok := mm.penalties[user]
+	if !ok {
+		penalty = &queuePenalty{}
+		mm.penalties[user] = penalty
+	}
+	return penalty
+}
+
+// dodge cancels a match found, the dodgers leave the queue with a penalty.
+// The other players stay where they were in the queue and search again.
+func (mm *Matchmaker) dodge(found *foundMatch, dodgers []*matchmakingPlayer) {
+	now := mm.config.Now()
+	for _, p := range found.players {
+		p.found = nil
+		accepted := p.accepted
+		p.accepted = false
+
+		dodged := false
+		for _, d := range dodgers {
+			dodged = dodged || d == p
+		}
+		if !dodged {
+			mm.send(p, &MatchmakingMessage{Type: MatchmakingRequeued, Queue: p.queue})
+			if accepted {
+				p.requeued <- struct{}{}
+			}
+			continue
+		}
+
+		penalty := mm.penalty(p.name)
+		d := mm.config.dodgePenalty(penalty.dodges)
+		penalty.dodges++
+		penalty.until = now.Add(d)
+		mm.remove(p)
+		mm.logger.Info("match dodged", zap.String("user", p.name), zap.Duration("penalty", d))
+		mm.send(p, &MatchmakingMessage{Type: MatchmakingPenalized, Until: penalty.until})
+	}
+}
+
+// dodgePenalty is the penalty of a player who dodged dodges times since its last match,
+// the doubling stops at the cap so that the penalty of a serial dodger never overflows
+func (c MatchmakingConfig) dodgePenalty(dodges int) time.Duration {
+	d := c.DodgePenalty
+	for i := 0; i < dodges && d < c.MaxDodgePenalty; i++ {
+		if d > c.MaxDodgePenalty>>1 {
+			return c.MaxDodgePenalty
+		}
+		d <<= 1
+	}
+	if d > c.MaxDodgePenalty {
+		d = c.MaxDodgePenalty
+	}
+	return d
+}
+
+// Run searches matches every interval until ctx is done
+func (mm *Matchmaker) Run(ctx context.Context) {
+	ticker := time.NewTicker(mm.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mm.Tick()
+		}
+	}
+}
+
+// Tick penalizes the players that did not accept their match in time and searches matches for the queued players
+func (mm *Matchmaker) Tick() {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	now := mm.config.Now()
+
+	var expired []*foundMatch
+	for _, waiting := range mm.queues {
+		for _, p := range waiting {
+			if p.found != nil && !now.Before(p.found.deadline) && !containsFound(expired, p.found) {
+				expired = append(expired, p.found)
+			}
+		}
+	}
+	for _, found := range expired {
+		var dodgers []*matchmakingPlayer
+		for _, p := range found.players {
+			if !p.accepted {
+				dodgers = append(dodgers, p)
+			}
+		}
+		mm.dodge(found, dodgers)
+	}
+
+	for _, queue := range []QueueType{Queue1v1, QueueFFA} {
+		mm.search(queue, now)
+	}
+}
+
+func containsFound(matches []*foundMatch, found *foundMatch) bool {
+	for _, m := range matches {
+		if m == found {
+			return true
+		}
+	}
+	return false
+}
+
+// window is how far from its rating a player accepts opponents after waiting until now
+func (mm *Matchmaker) window(p *matchmakingPlayer, now time.Time) float64 {
+	w := mm.config.InitialWindow + mm.config.WindowGrowth*now.Sub(p.since).Seconds()
+	if w > mm.config.MaxWindow {
+		return mm.config.MaxWindow
+	}
+	return w
+}
+
+// search matches the players waiting the longest first with the closest ratings that both windows accept
+func (mm *Matchmaker) search(queue QueueType, now time.Time) {
+	size := mm.size(queue)
+	for _, anchor := range mm.queues[queue] {
+		if anchor.found != nil {
+			continue
+		}
+
+		var candidates []*matchmakingPlayer
+		for _, p := range mm.queues[queue] {
+			// a user is never matched against itself
+			if p.name == anchor.name || p.found != nil {
+				continue
+			}
+			diff := p.rating - anchor.rating
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff <= mm.window(anchor, now) && diff <= mm.window(p, now) {
+				candidates = append(candidates, p)
+			}
+		}
+		if len(candidates) < size-1 {
+			continue
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return abs(candidates[i].rating-anchor.rating) < abs(candidates[j].rating-anchor.rating)
+		})
+
+		found := &foundMatch{
+			players:  append([]*matchmakingPlayer{anchor}, candidates[:size-1]...),
+			deadline: now.Add(mm.config.AcceptTimeout),
+		}
+		names := make([]string, len(found.players))
+		for i, p := range found.players {
+			p.found = found
+			names[i] = p.name
+		}
+		mm.logger.Info("match found", zap.String("queue", string(queue)), zap.Strings("players", names))
+		for _, p := range found.players {
+			mm.send(p, &MatchmakingMessage{Type: MatchmakingFound, Queue: queue, Players: names, Deadline: found.deadline})
+		}
+	}
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// send queues a message for a player, the messages are sent after the matchmaking is unlocked
+func (mm *Matchmaker) send(p *matchmakingPlayer, msg *MatchmakingMessage) {
+	p.out.send(msg)
+}
@@ -0,0 +1,223 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeClock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// expectMatchmaking receives messages until one of the type
+func expectMatchmaking(t *testing.T, stream *ClientStream, typ MatchmakingMessageType) *MatchmakingMessage {
+	t.Helper()
+	for {
+		var msg MatchmakingMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatalf("RecvMsg() error = %v, waiting for %s", err, typ)
+		}
+		if msg.Type == typ {
+			return &msg
+		}
+	}
+}
+
+func TestMatchmaker(t *testing.T) {
+	addr := "127.0.0.1:31127"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)}
+	ratings := map[string]float64{"alice": 1500, "bob": 1520, "carol": 1800, "dave": 1510}
+	mm := NewMatchmaker(MatchmakingConfig{
+		Now: clock.Now,
+		Rating: func(user string, queue QueueType) float64 {
+			return ratings[user]
+		},
+		Versus: VersusConfig{
+			Seed: func() uint64 {
+				return 42
+			},
+		},
+	}, zap.NewNop())
+	server.RegisterHandler("matchmaking", mm.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	join := func(user string) *ClientStream {
+		cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		stream, err := cli.NewStreamSession(context.Background(), "matchmaking", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	send := func(stream *ClientStream, msg *MatchmakingMessage) {
+		if err := stream.SendMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue := func(stream *ClientStream) {
+		send(stream, &MatchmakingMessage{Type: MatchmakingQueue, Queue: Queue1v1})
+		expectMatchmaking(t, stream, MatchmakingQueued)
+	}
+
+	alice := join("alice")
+	bob := join("bob")
+	carol := join("carol")
+
+	queue(alice)
+	queue(carol)
+	mm.Tick()
+
+	// bob is close enough to alice as soon as he queues
+	clock.Add(time.Second)
+	queue(bob)
+	mm.Tick()
+	for _, stream := range []*ClientStream{alice, bob} {
+		if found := expectMatchmaking(t, stream, MatchmakingFound); !reflect.DeepEqual(found.Players, []string{"alice", "bob"}) {
+			t.Errorf("found = %+v", found)
+		}
+	}
+
+	// bob dodges, alice searches again
+	send(alice, &MatchmakingMessage{Type: MatchmakingAccept})
+	send(bob, &MatchmakingMessage{Type: MatchmakingDecline})
+	penalized := expectMatchmaking(t, bob, MatchmakingPenalized)
+	if want := clock.Now().Add(time.Minute); !penalized.Until.Equal(want) {
+		t.Errorf("penalized until %v, want %v", penalized.Until, want)
+	}
+	expectMatchmaking(t, alice, MatchmakingRequeued)
+	send(bob, &MatchmakingMessage{Type: MatchmakingQueue, Queue: Queue1v1})
+	if reply := expectMatchmaking(t, bob, MatchmakingError); reply.Error != ErrQueuePenalty.Error() {
+		t.Errorf("error = %+v, want penalty", reply)
+	}
+
+	// the windows of alice and carol widen to 350 after 30s
+	clock.Add(29 * time.Second)
+	mm.Tick()
+	clock.Add(time.Second)
+	mm.Tick()
+	for _, stream := range []*ClientStream{alice, carol} {
+		if found := expectMatchmaking(t, stream, MatchmakingFound); !reflect.DeepEqual(found.Players, []string{"alice", "carol"}) {
+			t.Errorf("found = %+v", found)
+		}
+		send(stream, &MatchmakingMessage{Type: MatchmakingAccept})
+	}
+	for _, stream := range []*ClientStream{alice, carol} {
+		if start := expectVersus(t, stream, VersusStart); start.Seed != 42 || !reflect.DeepEqual(start.Players, []string{"alice", "carol"}) {
+			t.Errorf("start = %+v", start)
+		}
+	}
+
+	// players that do not accept in time dodge, the penalty doubles with every dodge
+	clock.Add(time.Minute)
+	dave := join("dave")
+	queue(bob)
+	queue(dave)
+	mm.Tick()
+	expectMatchmaking(t, bob, MatchmakingFound)
+	expectMatchmaking(t, dave, MatchmakingFound)
+	clock.Add(10 * time.Second)
+	mm.Tick()
+	if penalized := expectMatchmaking(t, bob, MatchmakingPenalized); penalized.Until.Sub(clock.Now()) != 2*time.Minute {
+		t.Errorf("penalized until %v, want 2m later", penalized.Until)
+	}
+	if penalized := expectMatchmaking(t, dave, MatchmakingPenalized); penalized.Until.Sub(clock.Now()) != time.Minute {
+		t.Errorf("penalized until %v, want 1m later", penalized.Until)
+	}
+}
+
+func TestMatchmaker_SameUser(t *testing.T) {
+	mm := NewMatchmaker(MatchmakingConfig{}, zap.NewNop())
+	player := func(name string) *matchmakingPlayer {
+		stream := discardStream(t)
+		return &matchmakingPlayer{
+			name:   name,
+			stream: stream,
+			out:    newSendQueue(stream, matchmakingSendQueue, zap.NewNop()),
+		}
+	}
+
+	alice, alice2 := player("alice"), player("alice")
+	if err := mm.enqueue(alice, Queue1v1); err != nil {
+		t.Fatal(err)
+	}
+	for _, queue := range []QueueType{Queue1v1, QueueFFA} {
+		if err := mm.enqueue(alice2, queue); err != ErrAlreadyQueued {
+			t.Errorf("enqueue(%s) error = %v, want ErrAlreadyQueued", queue, err)
+		}
+	}
+
+	// even queued twice, alice is not matched against herself
+	mm.queues[Queue1v1] = append(mm.queues[Queue1v1], alice2)
+	mm.Tick()
+	if alice.found != nil || alice2.found != nil {
+		t.Fatal("alice is matched against herself")
+	}
+	bob := player("bob")
+	if err := mm.enqueue(bob, Queue1v1); err != nil {
+		t.Fatal(err)
+	}
+	mm.Tick()
+	if alice.found == nil || bob.found != alice.found || alice2.found != nil {
+		t.Errorf("want alice matched with bob")
+	}
+}
+
+func TestMatchmakingConfig_dodgePenalty(t *testing.T) {
+	config := MatchmakingConfig{}.withDefaults()
+	tests := []struct {
+		dodges int
+		want   time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{4, 16 * time.Minute},
+		{5, 30 * time.Minute},
+		{40, 30 * time.Minute},
+		{1000, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := config.dodgePenalty(tt.dodges); got != tt.want {
+			t.Errorf("dodgePenalty(%d) = %v, want %v", tt.dodges, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package tetris
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+var ErrProfileNotFound = xerrors.New("profile not found")
+
+// Profile is the record of a player, keyed by the user name its key authenticated as
+type Profile struct {
+	User    string               `json:"user"`
+	Created time.Time            `json:"created"`
+	Modes   map[string]ModeStats `json:"modes"`
+	History []MatchResult        `json:"history"` // the latest match first
+}
+
+// ModeStats is the record of a player in a mode
+type ModeStats struct {
+	Rating Rating `json:"rating"`
+	Played int    `json:"played"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+}
+
+// MatchResult is a ranked match a player played
+type MatchResult struct {
+	Mode    string    `json:"mode"`
+	End     time.Time `json:"end"`
+	Players []string  `json:"players"`
+	Place   int       `json:"place"`
+	Won     bool      `json:"won"`
+	Before  Rating    `json:"before"`
+	After   Rating    `json:"after"`
+}
+
+func (p *Profile) clone() Profile {
+	c := *p
+	c.Modes = make(map[string]ModeStats, len(p.Modes))
+	for mode, stats := range p.Modes {
+		c.Modes[mode] = stats
+	}
+	c.History = make([]MatchResult, len(p.History))
+	for i, res := range p.History {
+		res.Players = append([]string(nil), res.Players...)
+		c.History[i] = res
+	}
+	return c
+}
+
+func sortProfiles(profiles []Profile) {
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].User < profiles[j].User
+	})
+}
+
+// ProfileRequest asks for the profile of User, the profile of the caller if empty
+type ProfileRequest struct {
+	User string `json:"user,omitempty"`
+}
+
+// ProfilesConfig is how profiles are rated
+type ProfilesConfig struct {
+	// Tau constrains how fast the volatility of ratings changes, 0.5 if zero
+	Tau float64
+	// HistorySize is the number of matches kept in the history of a profile, 20 if zero
+	HistorySize int
+	// Now is the clock profiles are created with, time.Now if nil
+	Now func() time.Time
+	// Store keeps the profiles and the logs of matches, a MemoryStore if nil
+	Store Store
+}
+
+func (c ProfilesConfig) withDefaults() ProfilesConfig {
+	if c.Tau <= 0 {
+		c.Tau = 0.5
+	}
+	if c.HistorySize <= 0 {
+		c.HistorySize = 20
+	}
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	if c.Store == nil {
+		c.Store = NewMemoryStore()
+	}
+	return c
+}
+
+// Profiles keeps the profiles of players and rates them with the ranked matches they play.
+// Set RecordMatch as VersusConfig.OnMatchEnd and MatchmakingRating as MatchmakingConfig.Rating to use them.
+type Profiles struct {
+	config ProfilesConfig
+	logger *zap.Logger
+	mux    sync.Mutex // serializes rating matches
+}
+
+// NewProfiles returns the profiles of the store, register Handler to query them
+func NewProfiles(config ProfilesConfig, logger *zap.Logger) *Profiles {
+	return &Profiles{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+// Profile returns the profile of the user, ErrProfileNotFound if the user did not play a ranked match
+func (ps *Profiles) Profile(user string) (Profile, error) {
+	return ps.config.Store.Profile(user)
+}
+
+// Rating returns the rating of the user in the mode, DefaultRating if the user did not play it
+func (ps *Profiles) Rating(user, mode string) Rating {
+	p, err := ps.config.Store.Profile(user)
+	if err != nil {
+		if !xerrors.Is(err, ErrProfileNotFound) {
+			ps.logger.Error("failed to get profile", zap.String("user", user), zap.Error(err))
+		}
+		return DefaultRating
+	}
+	if stats, ok := p.Modes[mode]; ok {
+		return stats.Rating
+	}
+	return DefaultRating
+}
+
+// MatchmakingRating is the rating of the user in the mode of the queue
+func (ps *Profiles) MatchmakingRating(user string, queue QueueType) float64 {
+	return ps.Rating(user, string(queue)).Rating
+}
+
+// RecordMatch saves the log of a match, the players of a ranked match are rated by it.
+// Every player wins against the players placed after it and loses against the ones placed before.
+// It returns once the store saved the match, a log listing a player twice is ignored.
+func (ps *Profiles) RecordMatch(log *MatchLog) {
+	if user, ok := duplicatePlayer(log.Players); ok {
+		ps.logger.Warn("match log lists a player twice", zap.String("user", user), zap.Strings("players", log.Players))
+		return
+	}
+
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	var profiles []Profile
+	if log.Ranked && len(log.Players) >= 2 {
+		profiles = ps.rate(log)
+	}
+	if err := ps.config.Store.SaveMatch(log, profiles); err != nil {
+		ps.logger.Error("failed to save match", zap.Strings("players", log.Players), zap.Error(err))
+		return
+	}
+	if profiles != nil {
+		ps.logger.Info("ranked match rated", zap.String("mode", log.Mode), zap.Strings("players", log.Players))
+	}
+}
+
+func duplicatePlayer(players []string) (string, bool) {
+	seen := make(map[string]bool, len(players))
+	for _, user := range players {
+		if seen[user] {
+			return user, true
+		}
+		seen[user] = true
+	}
+	return "", false
+}
+
+// rate returns the profiles of the players updated with the match
+func (ps *Profiles) rate(log *MatchLog) []Profile {
+	profiles := make([]Profile, len(log.Players))
+	before := make([]Rating, len(log.Players))
+	for i, user := range log.Players {
+		p, err := ps.config.Store.Profile(user)
+		if err != nil {
+			if !xerrors.Is(err, ErrProfileNotFound) {
+				ps.logger.Error("failed to get profile", zap.String("user", user), zap.Error(err))
+			}
+			p = Profile{User: user, Created: ps.config.Now()}
+		}
+		if p.Modes == nil {
+			p.Modes = make(map[string]ModeStats)
+		}
+		profiles[i] = p
+		before[i] = DefaultRating
+		if stats, ok := p.Modes[log.Mode]; ok {
+			before[i] = stats.Rating
+		}
+	}
+
+	for i := range profiles {
+		p := &profiles[i]
+		place := log.Places[p.User]
+		var results []RatingResult
+		for j, opponent := range log.Players {
+			if i == j {
+				continue
+			}
+			res := RatingResult{Opponent: before[j], Score: 0.5}
+			switch other := log.Places[opponent]; {
+			case place < other:
+				res.Score = 1
+			case place > other:
+				res.Score = 0
+			}
+			results = append(results, res)
+		}
+		after := before[i].Update(results, ps.config.Tau)
+
+		won := place == 1
+		stats := p.Modes[log.Mode]
+		stats.Rating = after
+		stats.Played++
+		if won {
+			stats.Wins++
+		} else {
+			stats.Losses++
+		}
+		p.Modes[log.Mode] = stats
+
+		p.History = append([]MatchResult{{
+			Mode:    log.Mode,
+			End:     log.End,
+			Players: append([]string(nil), log.Players...),
+			Place:   place,
+			Won:     won,
+			Before:  before[i],
+			After:   after,
+		}}, p.History...)
+		if len(p.History) > ps.config.HistorySize {
+			p.History = p.History[:ps.config.HistorySize]
+		}
+	}
+	return profiles
+}
+
+// Handler answers ProfileRequests with the Profile asked for
+func (ps *Profiles) Handler() UnaryHandler {
+	return func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		codec := CodecFromContext(ctx)
+		var r ProfileRequest
+		if err := unmarshalPacket(codec, req, &r); err != nil {
+			return nil, err
+		}
+		name := r.User
+		if name == "" {
+			name = user.UserName
+		}
+		p, err := ps.Profile(name)
+		if err != nil {
+			return nil, err
+		}
+		return marshalPacket(codec, &p)
+	}
+}
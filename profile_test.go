@@ -0,0 +1,126 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestProfiles_RecordMatch(t *testing.T) {
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	ps := NewProfiles(ProfilesConfig{HistorySize: 2, Now: func() time.Time { return now }}, zap.NewNop())
+
+	ps.RecordMatch(&MatchLog{Mode: "versus", Players: []string{"alice", "bob"}, Places: map[string]int{"alice": 1, "bob": 2}})
+	if _, err := ps.Profile("alice"); !xerrors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Profile() error = %v, unranked matches must not be rated", err)
+	}
+
+	ffa := &MatchLog{
+		Mode:    string(QueueFFA),
+		Ranked:  true,
+		Players: []string{"alice", "bob", "carol"},
+		Places:  map[string]int{"alice": 2, "bob": 1, "carol": 3},
+		End:     now,
+	}
+	for i := 0; i < 3; i++ {
+		ps.RecordMatch(ffa)
+	}
+
+	bob, _ := ps.Profile("bob")
+	alice, _ := ps.Profile("alice")
+	carol, _ := ps.Profile("carol")
+	if stats := bob.Modes["ffa"]; stats.Played != 3 || stats.Wins != 3 || stats.Losses != 0 {
+		t.Errorf("bob = %+v", stats)
+	}
+	if stats := alice.Modes["ffa"]; stats.Wins != 0 || stats.Losses != 3 {
+		t.Errorf("alice = %+v", stats)
+	}
+	b, a, c := bob.Modes["ffa"].Rating, alice.Modes["ffa"].Rating, carol.Modes["ffa"].Rating
+	if !(b.Rating > a.Rating && a.Rating > c.Rating) || b.Deviation >= DefaultRating.Deviation {
+		t.Errorf("ratings bob %+v, alice %+v, carol %+v", b, a, c)
+	}
+	if len(alice.History) != 2 || alice.History[0].Place != 2 || alice.History[0].After != a || alice.History[1].After != alice.History[0].Before {
+		t.Errorf("history = %+v", alice.History)
+	}
+	if _, ok := alice.Modes["1v1"]; ok || ps.Rating("alice", "1v1") != DefaultRating {
+		t.Error("modes must be rated apart")
+	}
+	if got := ps.MatchmakingRating("bob", QueueFFA); got != b.Rating {
+		t.Errorf("MatchmakingRating() = %v, want %v", got, b.Rating)
+	}
+
+	// a player rated against itself
+	ps.RecordMatch(&MatchLog{Mode: "1v1", Ranked: true, Players: []string{"dave", "dave"}, Places: map[string]int{"dave": 1}})
+	if _, err := ps.Profile("dave"); !xerrors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Profile() error = %v, a log listing a player twice must be ignored", err)
+	}
+}
+
+func TestProfiles_Handler(t *testing.T) {
+	addr := "127.0.0.1:31128"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	ps := NewProfiles(ProfilesConfig{Now: func() time.Time { return now }}, zap.NewNop())
+	ps.RecordMatch(&MatchLog{
+		Mode:    string(Queue1v1),
+		Ranked:  true,
+		Players: []string{"alice", "bob"},
+		Places:  map[string]int{"alice": 1, "bob": 2},
+	})
+	server.RegisterUnaryHandler("profile", ps.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("alice", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetCodec("profile", GobCodec{})
+	sess, err := cli.NewUnarySession("profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mine Profile
+	if err := sess.SendAndRecvMsg(&ProfileRequest{}, &mine); err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := ps.Profile("alice"); !reflect.DeepEqual(mine, want) {
+		t.Errorf("profile = %+v, want %+v", mine, want)
+	}
+
+	var bob Profile
+	if err := sess.SendAndRecvMsg(&ProfileRequest{User: "bob"}, &bob); err != nil {
+		t.Fatal(err)
+	}
+	if bob.User != "bob" || bob.Modes["1v1"].Losses != 1 {
+		t.Errorf("profile = %+v", bob)
+	}
+
+	var remote *RemoteError
+	err = sess.SendAndRecvMsg(&ProfileRequest{User: "carol"}, &Profile{})
+	if !xerrors.As(err, &remote) || remote.Message != ErrProfileNotFound.Error() {
+		t.Errorf("SendAndRecvMsg() error = %v, want %v", err, ErrProfileNotFound)
+	}
+}
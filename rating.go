@@ -0,0 +1,102 @@
+package tetris
+
+import (
+	"math"
+)
+
+// glickoScale converts ratings between the Glicko and the Glicko-2 scales
+const glickoScale = 173.7178
+
+// Rating is the Glicko-2 rating of a player
+type Rating struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`  // how uncertain Rating is
+	Volatility float64 `json:"volatility"` // how erratic the results of the player are
+}
+
+// DefaultRating is the rating of a player that has not played yet
+var DefaultRating = Rating{Rating: 1500, Deviation: 350, Volatility: 0.06}
+
+// RatingResult is the result of a game against an opponent
+type RatingResult struct {
+	Opponent Rating
+	Score    float64 // 1 for a win, 0.5 for a draw, 0 for a loss
+}
+
+// Update returns the rating after a rating period with the results, tau constrains the change of the volatility.
+// The deviation of a player without results grows.
+func (r Rating) Update(results []RatingResult, tau float64) Rating {
+	mu := (r.Rating - 1500) / glickoScale
+	phi := r.Deviation / glickoScale
+	sigma := r.Volatility
+
+	if len(results) == 0 {
+		return Rating{
+			Rating:     r.Rating,
+			Deviation:  math.Sqrt(phi*phi+sigma*sigma) * glickoScale,
+			Volatility: sigma,
+		}
+	}
+
+	var vInv, improvement float64
+	for _, res := range results {
+		muJ := (res.Opponent.Rating - 1500) / glickoScale
+		g := glickoG(res.Opponent.Deviation / glickoScale)
+		e := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		vInv += g * g * e * (1 - e)
+		improvement += g * (res.Score - e)
+	}
+	v := 1 / vInv
+	delta := v * improvement
+
+	sigma = glickoVolatility(phi, sigma, v, delta, tau)
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * improvement
+
+	return Rating{
+		Rating:     mu*glickoScale + 1500,
+		Deviation:  phi * glickoScale,
+		Volatility: sigma,
+	}
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+// glickoVolatility finds the new volatility with the Illinois algorithm
+func glickoVolatility(phi, sigma, v, delta, tau float64) float64 {
+	const epsilon = 0.000001
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(tau*tau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*tau) < 0 {
+			k++
+		}
+		B = a - k*tau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > epsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
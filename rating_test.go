@@ -0,0 +1,25 @@
+package tetris
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRating_Update(t *testing.T) {
+	// the example of Glickman's paper
+	r := Rating{Rating: 1500, Deviation: 200, Volatility: 0.06}
+	got := r.Update([]RatingResult{
+		{Opponent: Rating{Rating: 1400, Deviation: 30}, Score: 1},
+		{Opponent: Rating{Rating: 1550, Deviation: 100}, Score: 0},
+		{Opponent: Rating{Rating: 1700, Deviation: 300}, Score: 0},
+	}, 0.5)
+	want := Rating{Rating: 1464.06, Deviation: 151.52, Volatility: 0.05999}
+	if math.Abs(got.Rating-want.Rating) > 0.01 || math.Abs(got.Deviation-want.Deviation) > 0.01 || math.Abs(got.Volatility-want.Volatility) > 0.00001 {
+		t.Errorf("Update() = %+v, want %+v", got, want)
+	}
+
+	// an idle player becomes uncertain
+	if idle := r.Update(nil, 0.5); idle.Rating != r.Rating || idle.Deviation <= r.Deviation {
+		t.Errorf("Update(nil) = %+v", idle)
+	}
+}
@@ -0,0 +1,159 @@
+package tetris
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// ReplayRequest is the first message of a replay stream, it names the replay to play
+type ReplayRequest struct {
+	ID string `json:"id"`
+}
+
+// ReplaysConfig is how replays are kept and played
+type ReplaysConfig struct {
+	// Store keeps the replays, a MemoryStore if nil
+	Store Store
+	// TickInterval is the duration of a frame played back, 1/60s if zero
+	TickInterval time.Duration
+	// SnapshotEvery is the number of frames between snapshots, 60 if zero
+	SnapshotEvery uint64
+}
+
+func (c ReplaysConfig) withDefaults() ReplaysConfig {
+	if c.Store == nil {
+		c.Store = NewMemoryStore()
+	}
+	if c.TickInterval <= 0 {
+		c.TickInterval = time.Second / game.FramesPerSecond
+	}
+	if c.SnapshotEvery == 0 {
+		c.SnapshotEvery = 60
+	}
+	return c
+}
+
+// Replays saves the replays of games and plays them back. Set it in ServerGameConfig or VersusConfig
+// to record their games, and register Handler to watch them.
+type Replays struct {
+	config ReplaysConfig
+	logger *zap.Logger
+}
+
+// NewReplays returns the replays of the store
+func NewReplays(config ReplaysConfig, logger *zap.Logger) *Replays {
+	return &Replays{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+// randomID returns a new id of replays and matches
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Save saves a replay, it returns the id to load it with
+func (r *Replays) Save(replay *game.Replay) (string, error) {
+	data, err := replay.MarshalBinary()
+	if err != nil {
+		return "", xerrors.Errorf("failed to encode replay: %w", err)
+	}
+	id := randomID()
+	if err := r.config.Store.SaveReplay(id, data); err != nil {
+		return "", xerrors.Errorf("failed to save replay: %w", err)
+	}
+	return id, nil
+}
+
+// Load returns the replay saved under the id
+func (r *Replays) Load(id string) (*game.Replay, error) {
+	data, err := r.config.Store.Replay(id)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load replay %s: %w", id, err)
+	}
+	var replay game.Replay
+	if err := replay.UnmarshalBinary(data); err != nil {
+		return nil, xerrors.Errorf("failed to decode replay %s: %w", id, err)
+	}
+	return &replay, nil
+}
+
+// Handler plays the replay of the ReplayRequest a client sends first, it returns when the replay is over
+func (r *Replays) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		logger := r.logger.With(zap.String("user", stream.User().UserName))
+		var req ReplayRequest
+		if err := stream.RecvMsgContext(ctx, &req); err != nil {
+			logger.Info("failed to receive replay request", zap.Error(err))
+			return
+		}
+		replay, err := r.Load(req.ID)
+		if err != nil {
+			logger.Info("failed to load replay", zap.Error(err))
+			return
+		}
+		if err := r.Stream(ctx, stream, replay); err != nil && !xerrors.Is(err, context.Canceled) {
+			logger.Info("failed to play replay", zap.String("replay", req.ID), zap.Error(err))
+		}
+	}
+}
+
+// Stream plays a replay on the clock as if its games were live, with the messages ServerGame sends.
+// The messages are those of every player of the replay, told apart by their Player.
+func (r *Replays) Stream(ctx context.Context, stream *ServerStream, replay *game.Replay) error {
+	p, err := game.NewPlayback(replay)
+	if err != nil {
+		return err
+	}
+	snapshots := func(seed uint64) error {
+		for i, player := range replay.Players {
+			snapshot := p.Game(i).Snapshot()
+			msg := &StateMessage{Type: StateSnapshot, Player: player.Name, Frame: snapshot.Frame, Seed: seed, Snapshot: &snapshot}
+			if err := stream.SendMsg(msg); err != nil {
+				return xerrors.Errorf("failed to send snapshot: %w", err)
+			}
+		}
+		return nil
+	}
+	if err := snapshots(replay.Seed); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(r.config.TickInterval)
+	defer ticker.Stop()
+	for !p.Done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stream.Done():
+			return xerrors.New("stream closed")
+		case <-ticker.C:
+		}
+		for i, events := range p.Step() {
+			if len(events) == 0 {
+				continue
+			}
+			msg := &StateMessage{Type: StateDelta, Player: replay.Players[i].Name, Frame: p.Frame(), Events: events}
+			if err := stream.SendMsg(msg); err != nil {
+				return xerrors.Errorf("failed to send delta: %w", err)
+			}
+		}
+		if p.Frame()%r.config.SnapshotEvery == 0 && !p.Done() {
+			if err := snapshots(0); err != nil {
+				return err
+			}
+		}
+	}
+	return snapshots(0)
+}
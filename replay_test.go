@@ -0,0 +1,132 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestReplays(t *testing.T) {
+	replays := NewReplays(ReplaysConfig{}, zap.NewNop())
+	if _, err := replays.Load("nope"); !xerrors.Is(err, ErrReplayNotFound) {
+		t.Errorf("Load() error = %v, want %v", err, ErrReplayNotFound)
+	}
+
+	replay := &game.Replay{
+		RulesVersion: game.RulesVersion,
+		Seed:         3,
+		Players:      []game.ReplayPlayer{{Name: "alice", End: 5, Inputs: []game.ReplayInput{{Frame: 5, Input: game.InputHardDrop}}}},
+	}
+	id, err := replays.Save(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := replays.Load(id); err != nil || !reflect.DeepEqual(got, replay) {
+		t.Errorf("Load() = %+v, %v, want %+v", got, err, replay)
+	}
+}
+
+func TestReplays_Handler(t *testing.T) {
+	addr := "127.0.0.1:31131"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	replays := NewReplays(ReplaysConfig{TickInterval: time.Millisecond, SnapshotEvery: 10}, zap.NewNop())
+	replay := &game.Replay{
+		RulesVersion: game.RulesVersion,
+		Seed:         11,
+		Players: []game.ReplayPlayer{
+			{Name: "alice", End: 25, Inputs: []game.ReplayInput{{Frame: 3, Input: game.InputLeft}, {Frame: 4, Input: game.InputHardDrop}}},
+			{Name: "bob", End: 30, Inputs: []game.ReplayInput{{Frame: 8, Input: game.InputHardDrop, Garbage: []int{2}}}},
+		},
+	}
+	id, err := replays.Save(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterHandler("replay", replays.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("carol", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	stream, err := cli.NewStreamSession(context.Background(), "replay", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&ReplayRequest{ID: id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client follows the games from the first snapshots and the deltas, as it would live games
+	games := make(map[string]*StateMessage)
+	locks := make(map[string]int)
+	var msgs []StateMessage
+	for {
+		var msg StateMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+		switch msg.Type {
+		case StateSnapshot:
+			if _, ok := games[msg.Player]; !ok && msg.Seed != replay.Seed {
+				t.Errorf("first snapshot = %+v, want the seed", msg)
+			}
+			games[msg.Player] = &msg
+		case StateDelta:
+			for _, e := range msg.Events {
+				if e.Type == game.EventLock {
+					locks[msg.Player]++
+				}
+			}
+		}
+	}
+	if locks["alice"] != 1 || locks["bob"] != 1 {
+		t.Errorf("locks = %v, want a lock by each player", locks)
+	}
+
+	p, err := game.NewPlayback(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Seek(30)
+	for i, player := range replay.Players {
+		want := p.Game(i).Snapshot()
+		if got := games[player.Name]; got == nil || !reflect.DeepEqual(got.Snapshot, &want) {
+			t.Errorf("last snapshot of %s = %+v, want %+v", player.Name, got, want)
+		}
+	}
+	// snapshots of both games at frames 0, 10, 20 and the end
+	snapshots := 0
+	for _, msg := range msgs {
+		if msg.Type == StateSnapshot {
+			snapshots++
+		}
+	}
+	if snapshots != 8 {
+		t.Errorf("%d snapshots, want 8", snapshots)
+	}
+}
@@ -0,0 +1,74 @@
+package tetris
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// sendQueue sends the messages queued for a stream in order from its own goroutine,
+// so that a client that does not read never blocks the lock the messages are queued under.
+// It is not safe for concurrent use, the callers queue and close under their lock.
+type sendQueue struct {
+	stream  *ServerStream
+	out     chan interface{} // nil once closed
+	written chan struct{}    // closed when the messages queued are sent
+	logger  *zap.Logger
+}
+
+func newSendQueue(stream *ServerStream, size int, logger *zap.Logger) *sendQueue {
+	q := &sendQueue{
+		stream:  stream,
+		out:     make(chan interface{}, size),
+		written: make(chan struct{}),
+		logger:  logger,
+	}
+	go q.write(q.out)
+	return q
+}
+
+func (q *sendQueue) write(out <-chan interface{}) {
+	defer close(q.written)
+	failed := false
+	for msg := range out {
+		if failed {
+			continue
+		}
+		if err := q.stream.SendMsg(msg); err != nil {
+			q.logger.Info("failed to send message", zap.Error(err))
+			failed = true
+		}
+	}
+}
+
+// send queues a message, a client falling further behind than the size of the queue is disconnected
+func (q *sendQueue) send(msg interface{}) {
+	if q.out == nil {
+		return
+	}
+	select {
+	case q.out <- msg:
+	default:
+		q.logger.Info("client fell behind")
+		q.close()
+		// closing a stream may write to the client, it is not closed under the lock of the caller
+		go q.stream.Close()
+	}
+}
+
+// close stops queueing, the messages queued are still sent
+func (q *sendQueue) close() {
+	if q.out != nil {
+		close(q.out)
+		q.out = nil
+	}
+}
+
+// flush waits until the messages queued before close are sent, the stream is closed after the handler returns
+func (q *sendQueue) flush(ctx context.Context) {
+	select {
+	case <-q.written:
+	case <-ctx.Done():
+	case <-q.stream.Done():
+	}
+}
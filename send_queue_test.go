@@ -0,0 +1,30 @@
+package tetris
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSendQueue_SlowResumableClient(t *testing.T) {
+	stream := stuckResumableStream(t)
+	q := newSendQueue(stream, 4, zap.NewNop())
+
+	// closing the stream of the client falling behind blocks, the caller must not wait for it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			q.send(&VersusMessage{Type: VersusScore, Player: "fast"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send is blocked by a client that does not read")
+	}
+	if q.out != nil {
+		t.Error("the queue of a client falling behind must be closed")
+	}
+}
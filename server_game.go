@@ -0,0 +1,275 @@
+package tetris
+
+import (
+	"context"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// InputMessage is an input of a player for a frame of its game
+type InputMessage struct {
+	Frame uint64     `json:"frame"`
+	Input game.Input `json:"input"`
+	// Garbage is set when the player raised the next garbage sent to it before the input, in verified versus matches.
+	// Garbage must be raised with the first input after it is sent, a player locking with garbage left is disqualified.
+	Garbage bool `json:"garbage,omitempty"`
+}
+
+// StateMessageType is the kind of a StateMessage
+type StateMessageType string
+
+const (
+	// StateSnapshot carries the whole state of the game, the first one also the Seed of the game
+	StateSnapshot StateMessageType = "snapshot"
+	// StateDelta carries the events of the frames stepped since the last message
+	StateDelta StateMessageType = "delta"
+)
+
+// StateMessage is the state of a game run by the server
+type StateMessage struct {
+	Type StateMessageType `json:"type"`
+	// Player is whose game the message is of, set in replays and to spectators
+	Player   string         `json:"player,omitempty"`
+	Frame    uint64         `json:"frame"`
+	Seed     uint64         `json:"seed,omitempty"`
+	Snapshot *game.Snapshot `json:"snapshot,omitempty"`
+	Events   []game.Event   `json:"events,omitempty"`
+}
+
+// ServerGameConfig is the rules of games run by the server
+type ServerGameConfig struct {
+	Game game.Config
+	// Seed returns the seed of a game, the current time if nil
+	Seed func() uint64
+	// TickInterval is the duration of a frame, 1/60s if zero
+	TickInterval time.Duration
+	// MaxLag is how many frames the inputs of a player may run behind or ahead of the clock of the server,
+	// the server steps the game without the player past it. 30 if zero.
+	MaxLag uint64
+	// SnapshotEvery is the number of frames between snapshots, 60 if zero
+	SnapshotEvery uint64
+	// Mode is the goal of the games: sprint, ultra or marathon. The games only end by topping out if empty.
+	Mode LeaderboardMode
+	// OnGameEnd is called with the record of every game of a Mode that is over, it must not block
+	OnGameEnd func(Record)
+	// Replays records every game if set, the Record of a game has the id of its replay
+	Replays *Replays
+}
+
+func (c ServerGameConfig) withDefaults() ServerGameConfig {
+	if c.Seed == nil {
+		c.Seed = func() uint64 {
+			return uint64(time.Now().UnixNano())
+		}
+	}
+	if c.TickInterval <= 0 {
+		c.TickInterval = time.Second / game.FramesPerSecond
+	}
+	if c.MaxLag == 0 {
+		c.MaxLag = 30
+	}
+	if c.SnapshotEvery == 0 {
+		c.SnapshotEvery = 60
+	}
+	return c
+}
+
+// ServerGame runs the games of players on the server, players only send their inputs.
+// The server steps the game on its clock so that a player can not stall gravity, nor play faster than the clock.
+type ServerGame struct {
+	config ServerGameConfig
+	logger *zap.Logger
+}
+
+// NewServerGame returns games run by the server, register Handler to serve them
+func NewServerGame(config ServerGameConfig, logger *zap.Logger) *ServerGame {
+	return &ServerGame{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+type serverGameSession struct {
+	config ServerGameConfig
+	stream *ServerStream
+	game   *game.Game
+	rec    *game.Recorder
+	clock  uint64 // frames on the clock of the server
+	events []game.Event
+	out    []*StateMessage
+}
+
+// Handler serves a game per stream, it returns when the game is over or the player leaves
+func (sg *ServerGame) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		logger := sg.logger.With(zap.String("user", stream.User().UserName))
+		seed := sg.config.Seed()
+		s := &serverGameSession{
+			config: sg.config,
+			stream: stream,
+			game:   game.New(sg.config.Game, seed),
+			rec:    game.NewRecorder(stream.User().UserName),
+		}
+		s.out = append(s.out, s.snapshot(seed))
+		if err := s.flush(); err != nil {
+			logger.Info("failed to start server game", zap.Error(err))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		inputs := make(chan InputMessage)
+		go func() {
+			defer close(inputs)
+			for {
+				var in InputMessage
+				if err := stream.RecvMsgContext(ctx, &in); err != nil {
+					return
+				}
+				select {
+				case inputs <- in:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(sg.config.TickInterval)
+		defer ticker.Stop()
+		left := false
+	play:
+		for !s.done() {
+			select {
+			case <-ctx.Done():
+				left = true
+				break play
+			case in, ok := <-inputs:
+				if !ok {
+					left = true
+					break play
+				}
+				s.apply(in)
+			case <-ticker.C:
+				s.clock++
+				if s.clock > s.config.MaxLag {
+					s.stepTo(s.clock - s.config.MaxLag)
+				}
+			}
+			if err := s.flush(); err != nil {
+				logger.Info("failed to send game state", zap.Error(err))
+				left = true
+				break play
+			}
+		}
+
+		if !left {
+			s.out = append(s.out, s.snapshot(0))
+			if err := s.flush(); err != nil {
+				logger.Info("failed to send game state", zap.Error(err))
+			}
+		}
+		// games the player left are recorded too, but only games that are over are records
+		var replay string
+		if sg.config.Replays != nil {
+			id, err := sg.config.Replays.Save(&game.Replay{
+				RulesVersion: game.RulesVersion,
+				Config:       sg.config.Game,
+				Seed:         seed,
+				Players:      []game.ReplayPlayer{s.rec.Player()},
+			})
+			if err != nil {
+				logger.Warn("failed to save replay", zap.Error(err))
+			}
+			replay = id
+		}
+		if !left && sg.config.Mode != "" && sg.config.OnGameEnd != nil {
+			sg.config.OnGameEnd(Record{
+				User:   stream.User().UserName,
+				Mode:   sg.config.Mode,
+				Score:  s.game.Score(),
+				Lines:  s.game.Lines(),
+				Frames: s.game.Frame(),
+				Time:   time.Now(),
+				Replay: replay,
+			})
+		}
+	}
+}
+
+// done reports whether the game topped out or reached the goal of its mode
+func (s *serverGameSession) done() bool {
+	if s.game.Over() != game.TopOutNone {
+		return true
+	}
+	switch s.config.Mode {
+	case LeaderboardSprint:
+		return s.game.Lines() >= SprintLines
+	case LeaderboardUltra:
+		return s.game.Frame() >= UltraFrames
+	case LeaderboardMarathon:
+		return s.game.Lines() >= MarathonLines
+	}
+	return false
+}
+
+// apply steps the game to the frame of the input. Inputs for frames already stepped are applied at the next frame,
+// inputs too far ahead of the clock at the latest frame allowed.
+func (s *serverGameSession) apply(in InputMessage) {
+	frame := in.Frame
+	if limit := s.clock + s.config.MaxLag; frame > limit {
+		frame = limit
+	}
+	if next := s.game.Frame() + 1; frame < next {
+		frame = next
+	}
+	s.stepTo(frame - 1)
+	s.step(in.Input)
+}
+
+// stepTo steps the game without input until the frame
+func (s *serverGameSession) stepTo(frame uint64) {
+	for s.game.Frame() < frame && !s.done() {
+		s.step(0)
+	}
+}
+
+func (s *serverGameSession) step(in game.Input) {
+	if s.done() {
+		return
+	}
+	s.events = append(s.events, s.game.Step(in)...)
+	s.rec.Step(s.game.Frame(), in)
+	if s.game.Frame()%s.config.SnapshotEvery == 0 && !s.done() {
+		s.queueDelta()
+		s.out = append(s.out, s.snapshot(0))
+	}
+}
+
+func (s *serverGameSession) queueDelta() {
+	if len(s.events) == 0 {
+		return
+	}
+	s.out = append(s.out, &StateMessage{Type: StateDelta, Frame: s.events[len(s.events)-1].Frame, Events: s.events})
+	s.events = nil
+}
+
+// flush sends the messages of the frames stepped
+func (s *serverGameSession) flush() error {
+	s.queueDelta()
+	for i, msg := range s.out {
+		if err := s.stream.SendMsg(msg); err != nil {
+			return xerrors.Errorf("failed to send %s: %w", msg.Type, err)
+		}
+		s.out[i] = nil
+	}
+	s.out = s.out[:0]
+	return nil
+}
+
+func (s *serverGameSession) snapshot(seed uint64) *StateMessage {
+	snapshot := s.game.Snapshot()
+	return &StateMessage{Type: StateSnapshot, Frame: snapshot.Frame, Seed: seed, Snapshot: &snapshot}
+}
@@ -0,0 +1,275 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerGame(t *testing.T) {
+	addr := "127.0.0.1:31123"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sg := NewServerGame(ServerGameConfig{
+		Seed: func() uint64 {
+			return 7
+		},
+		// the clock of the server does not step the game within the test
+		MaxLag:        10000,
+		SnapshotEvery: 10,
+	}, zap.NewNop())
+	server.RegisterHandler("solo", sg.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "solo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func() *StateMessage {
+		t.Helper()
+		var msg StateMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return &msg
+	}
+
+	first := recv()
+	if first.Type != StateSnapshot || first.Seed != 7 || first.Frame != 0 {
+		t.Fatalf("first message = %+v, want the snapshot of the start", first)
+	}
+
+	// the client predicts the game with the seed, the server must agree
+	local := game.New(game.Config{}, first.Seed)
+	if want := local.Snapshot(); !reflect.DeepEqual(first.Snapshot, &want) {
+		t.Errorf("snapshot = %+v, want %+v", first.Snapshot, want)
+	}
+
+	inputs := map[uint64]game.Input{
+		3:  game.InputLeft,
+		4:  game.InputRotateCW,
+		5:  game.InputHardDrop,
+		12: game.InputHold,
+		15: game.InputHardDrop,
+		20: game.InputRight,
+	}
+	snapshots := make(map[uint64]game.Snapshot)
+	for frame := uint64(1); frame <= 20; frame++ {
+		local.Step(inputs[frame])
+		snapshots[frame] = local.Snapshot()
+		if in, ok := inputs[frame]; ok {
+			if err := stream.SendMsg(&InputMessage{Frame: frame, Input: in}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var locks []game.Event
+	for _, frame := range []uint64{10, 20} {
+		for {
+			msg := recv()
+			if msg.Type == StateDelta {
+				for _, e := range msg.Events {
+					if e.Type == game.EventLock {
+						locks = append(locks, e)
+					}
+				}
+				continue
+			}
+			if msg.Frame != frame {
+				t.Fatalf("snapshot at frame %d, want %d", msg.Frame, frame)
+			}
+			if want := snapshots[frame]; !reflect.DeepEqual(msg.Snapshot, &want) {
+				t.Errorf("snapshot = %+v, want %+v", msg.Snapshot, want)
+			}
+			break
+		}
+	}
+	if len(locks) != 2 {
+		t.Errorf("locks = %+v, want 2", locks)
+	}
+
+	// a late input is applied at the next frame, it can not rewrite the past
+	if err := stream.SendMsg(&InputMessage{Frame: 1, Input: game.InputHardDrop}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg := recv()
+		if msg.Type != StateDelta {
+			continue
+		}
+		if msg.Frame != 21 || msg.Events[0].Type != game.EventLock {
+			t.Errorf("delta = %+v, want a lock at frame 21", msg)
+		}
+		break
+	}
+
+	stream.CloseSend()
+	select {
+	case <-stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("game must end when the player leaves")
+	}
+}
+
+func TestServerGame_Clock(t *testing.T) {
+	addr := "127.0.0.1:31124"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sg := NewServerGame(ServerGameConfig{
+		Game:         game.Config{StartLevel: 20},
+		TickInterval: time.Millisecond,
+		MaxLag:       1,
+	}, zap.NewNop())
+	server.RegisterHandler("solo", sg.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "solo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a player sending nothing does not stall the game, pieces keep falling until the stack tops out
+	deadline := time.After(10 * time.Second)
+	for {
+		var msg StateMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == StateSnapshot && msg.Snapshot.Over != game.TopOutNone {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("game is not over")
+		default:
+		}
+	}
+}
+
+func TestServerGame_mode(t *testing.T) {
+	addr := "127.0.0.1:31129"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ended := make(chan Record, 1)
+	replays := NewReplays(ReplaysConfig{}, zap.NewNop())
+	sg := NewServerGame(ServerGameConfig{
+		MaxLag:        100000,
+		SnapshotEvery: 1000,
+		Mode:          LeaderboardUltra,
+		OnGameEnd: func(r Record) {
+			ended <- r
+		},
+		Replays: replays,
+	}, zap.NewNop())
+	server.RegisterHandler("ultra", sg.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "ultra", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			var msg StateMessage
+			if err := stream.RecvMsg(&msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	// an input past the time limit ends the game at the limit
+	if err := stream.SendMsg(&InputMessage{Frame: UltraFrames + 100, Input: game.InputHardDrop}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-ended:
+		if r.User != "test" || r.Mode != LeaderboardUltra || r.Frames > UltraFrames {
+			t.Errorf("record = %+v", r)
+		}
+		// the replay of the game plays the same game again
+		replay, err := replays.Load(r.Replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := game.NewPlayback(replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Seek(UltraFrames)
+		if g := p.Game(0); g.Frame() != r.Frames || g.Score() != r.Score || g.Lines() != r.Lines {
+			t.Errorf("replay ends at frame %d with score %d, want %+v", g.Frame(), g.Score(), r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the game must end at the time limit")
+	}
+}
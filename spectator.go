@@ -0,0 +1,264 @@
+package tetris
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// SpectateRequest is the first message of a spectator stream, it names the room of the match to watch
+type SpectateRequest struct {
+	Room string `json:"room"`
+}
+
+// SpectateReply answers a SpectateRequest. The StateMessages of every player follow it until the match is over,
+// starting with the snapshots of their games. Error is set if there is no match to watch.
+type SpectateReply struct {
+	Room    string        `json:"room"`
+	Players []string      `json:"players,omitempty"`
+	Delay   time.Duration `json:"delay"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// SpectatorsConfig is how spectators watch matches
+type SpectatorsConfig struct {
+	// Delay is how long after the players spectators see the games,
+	// so that a player can not watch the well of an opponent through a spectator. 3s if zero.
+	Delay time.Duration
+	// Buffer is how many updates a spectator may fall behind, a spectator further behind skips
+	// to the latest snapshots of the games. 256 if zero.
+	Buffer int
+	// TickInterval is how often updates are released to spectators once delayed, 1/60s if zero
+	TickInterval time.Duration
+	// SnapshotEvery is the number of frames between snapshots of the games, 60 if zero
+	SnapshotEvery uint64
+}
+
+func (c SpectatorsConfig) withDefaults() SpectatorsConfig {
+	if c.Delay <= 0 {
+		c.Delay = 3 * time.Second
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = 256
+	}
+	if c.TickInterval <= 0 {
+		c.TickInterval = time.Second / game.FramesPerSecond
+	}
+	if c.SnapshotEvery == 0 {
+		c.SnapshotEvery = 60
+	}
+	return c
+}
+
+// Spectators lets users watch the matches going on. Set it in VersusConfig to publish verified matches,
+// and register Handler to watch them.
+type Spectators struct {
+	config SpectatorsConfig
+	logger *zap.Logger
+	mux    sync.Mutex
+	rooms  map[string]*spectatedMatch
+}
+
+// NewSpectators returns spectators of no match yet
+func NewSpectators(config SpectatorsConfig, logger *zap.Logger) *Spectators {
+	return &Spectators{
+		config: config.withDefaults(),
+		logger: logger,
+		rooms:  make(map[string]*spectatedMatch),
+	}
+}
+
+// Rooms returns the rooms of the matches that can be watched
+func (s *Spectators) Rooms() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Handler serves a spectator of the room of its SpectateRequest, it returns when the match is over
+func (s *Spectators) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		logger := s.logger.With(zap.String("user", stream.User().UserName))
+		var req SpectateRequest
+		if err := stream.RecvMsgContext(ctx, &req); err != nil {
+			logger.Info("failed to receive spectate request", zap.Error(err))
+			return
+		}
+
+		reply := &SpectateReply{Room: req.Room, Delay: s.config.Delay}
+		s.mux.Lock()
+		m, ok := s.rooms[req.Room]
+		s.mux.Unlock()
+		if ok {
+			reply.Players = m.players
+		} else {
+			reply.Error = ErrRoomNotFound.Error()
+		}
+		if err := stream.SendMsg(reply); err != nil || !ok {
+			return
+		}
+
+		logger.Info("spectating", zap.String("room", req.Room))
+		if err := m.watch(ctx, stream); err != nil && !xerrors.Is(err, context.Canceled) {
+			logger.Info("spectator left", zap.String("room", req.Room), zap.Error(err))
+		}
+	}
+}
+
+// open publishes a match under the room, it replaces a match of the room that is still published
+func (s *Spectators) open(room string, players []string) *spectatedMatch {
+	m := newSpectatedMatch(s.config, players)
+	s.mux.Lock()
+	s.rooms[room] = m
+	s.mux.Unlock()
+	go func() {
+		m.run()
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if s.rooms[room] == m {
+			delete(s.rooms, room)
+		}
+	}()
+	return m
+}
+
+type delayedMessage struct {
+	at  time.Time
+	msg *StateMessage // nil ends the match
+}
+
+// spectatedMatch delays the updates of the games of a match and fans them out to its spectators.
+// The players only queue their updates, every spectator is sent them by its own handler
+// so that a slow spectator does not hold anyone up.
+type spectatedMatch struct {
+	config  SpectatorsConfig
+	players []string
+
+	mux     sync.Mutex
+	pending []delayedMessage // published, waiting for the delay
+	// log is the latest updates released, first is the sequence number of log[0]
+	log   []*StateMessage
+	first uint64
+	// games are the updates of each player since its latest snapshot, a spectator starts from them
+	games   map[string][]*StateMessage
+	over    bool
+	changed chan struct{} // closed when updates are released
+}
+
+func newSpectatedMatch(config SpectatorsConfig, players []string) *spectatedMatch {
+	return &spectatedMatch{
+		config:  config,
+		players: players,
+		games:   make(map[string][]*StateMessage),
+		changed: make(chan struct{}),
+	}
+}
+
+// publish queues an update of a game, it never blocks on spectators
+func (m *spectatedMatch) publish(msg *StateMessage) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.pending = append(m.pending, delayedMessage{at: time.Now().Add(m.config.Delay), msg: msg})
+}
+
+// close ends the match once the updates published are released
+func (m *spectatedMatch) close() {
+	m.publish(nil)
+}
+
+// run releases the updates as their delay passes until the match is over
+func (m *spectatedMatch) run() {
+	ticker := time.NewTicker(m.config.TickInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if m.release(now) {
+			return
+		}
+	}
+}
+
+// release hands the updates published before now minus the delay to the spectators, it returns true once the match is over
+func (m *spectatedMatch) release(now time.Time) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	n := 0
+	for ; n < len(m.pending) && !m.pending[n].at.After(now); n++ {
+		msg := m.pending[n].msg
+		if msg == nil {
+			m.over = true
+			continue
+		}
+		m.log = append(m.log, msg)
+		if over := len(m.log) - m.config.Buffer; over > 0 {
+			m.log = append([]*StateMessage(nil), m.log[over:]...)
+			m.first += uint64(over)
+		}
+		if msg.Type == StateSnapshot {
+			m.games[msg.Player] = m.games[msg.Player][:0]
+		}
+		m.games[msg.Player] = append(m.games[msg.Player], msg)
+	}
+	if n == 0 {
+		return m.over
+	}
+	m.pending = append(m.pending[:0], m.pending[n:]...)
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return m.over
+}
+
+// spectatorCursor is how far a spectator is in the updates of a match
+type spectatorCursor struct {
+	next   uint64 // sequence number of the next update to send
+	synced bool   // whether the spectator has the state of the games to follow the updates
+}
+
+// updates returns the updates the spectator has not been sent, the state of the games instead if it fell too far behind.
+// It returns true when the spectator was sent everything of a match that is over, and a channel closed on new updates.
+func (m *spectatedMatch) updates(c *spectatorCursor) ([]*StateMessage, bool, <-chan struct{}) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	end := m.first + uint64(len(m.log))
+	var msgs []*StateMessage
+	if !c.synced || c.next < m.first {
+		for _, p := range m.players {
+			msgs = append(msgs, m.games[p]...)
+		}
+		c.synced = true
+	} else {
+		msgs = append(msgs, m.log[c.next-m.first:]...)
+	}
+	c.next = end
+	return msgs, m.over, m.changed
+}
+
+// watch sends the updates of the match to a spectator until the match is over
+func (m *spectatedMatch) watch(ctx context.Context, stream *ServerStream) error {
+	var c spectatorCursor
+	for {
+		msgs, over, changed := m.updates(&c)
+		for _, msg := range msgs {
+			if err := stream.SendMsg(msg); err != nil {
+				return xerrors.Errorf("failed to send %s: %w", msg.Type, err)
+			}
+		}
+		if over {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stream.Done():
+			return xerrors.New("stream closed")
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package tetris
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSpectatedMatch(t *testing.T) {
+	delay := time.Hour
+	m := newSpectatedMatch(SpectatorsConfig{Delay: delay, Buffer: 4}.withDefaults(), []string{"alice"})
+	early := &spectatorCursor{}
+	if msgs, over, _ := m.updates(early); len(msgs) != 0 || over {
+		t.Fatalf("updates = %v, %v before the match", msgs, over)
+	}
+
+	for frame := uint64(0); frame < 12; frame++ {
+		typ := StateDelta
+		if frame%6 == 0 {
+			typ = StateSnapshot
+		}
+		m.publish(&StateMessage{Type: typ, Player: "alice", Frame: frame})
+	}
+	if m.release(time.Now()); len(m.log) != 0 {
+		t.Fatalf("%d updates released before the delay", len(m.log))
+	}
+	m.release(time.Now().Add(delay))
+
+	// the early spectator fell behind the buffer, it skips to the latest snapshot like a late one
+	late := &spectatorCursor{}
+	for _, c := range []*spectatorCursor{early, late} {
+		msgs, _, _ := m.updates(c)
+		if len(msgs) != 6 || msgs[0].Type != StateSnapshot || msgs[0].Frame != 6 || msgs[5].Frame != 11 {
+			t.Errorf("updates = %+v, want the snapshot at frame 6 and the deltas after it", msgs)
+		}
+	}
+
+	_, _, changed := m.updates(late)
+	m.publish(&StateMessage{Type: StateDelta, Player: "alice", Frame: 12})
+	m.close()
+	if !m.release(time.Now().Add(delay)) {
+		t.Error("the match must be over")
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("spectators must be told of new updates")
+	}
+	msgs, over, _ := m.updates(late)
+	if len(msgs) != 1 || msgs[0].Frame != 12 || !over {
+		t.Errorf("updates = %+v, %v, want the last delta", msgs, over)
+	}
+}
+
+func TestSpectators_Handler(t *testing.T) {
+	addr := "127.0.0.1:31132"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	delay := 300 * time.Millisecond
+	spectators := NewSpectators(SpectatorsConfig{Delay: delay, TickInterval: time.Millisecond}, zap.NewNop())
+	versus := NewVersus(VersusConfig{
+		Verify:     true,
+		Spectators: spectators,
+		RoomID: func(players []string) string {
+			return "r1"
+		},
+	}, zap.NewNop())
+	server.RegisterHandler("versus", versus.Handler())
+	server.RegisterHandler("spectate", spectators.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	connect := func(user, cmd string) *ClientStream {
+		cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		stream, err := cli.NewStreamSession(context.Background(), cmd, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	spectate := func(room string) (*ClientStream, *SpectateReply) {
+		stream := connect("carol", "spectate")
+		if err := stream.SendMsg(&SpectateRequest{Room: room}); err != nil {
+			t.Fatal(err)
+		}
+		var reply SpectateReply
+		if err := stream.RecvMsg(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return stream, &reply
+	}
+
+	if _, reply := spectate("r1"); reply.Error != ErrRoomNotFound.Error() {
+		t.Errorf("reply = %+v, want no match yet", reply)
+	}
+
+	alice := &versusClient{t: t, stream: connect("alice", "versus")}
+	bob := &versusClient{t: t, stream: connect("bob", "versus")}
+	for _, c := range []*versusClient{alice, bob} {
+		start := expectVersus(t, c.stream, VersusStart)
+		if start.Room != "r1" {
+			t.Errorf("start = %+v, want the room", start)
+		}
+		c.start(start.Seed)
+	}
+
+	stream, reply := spectate("r1")
+	if reply.Error != "" || len(reply.Players) != 2 || reply.Delay != delay {
+		t.Fatalf("reply = %+v", reply)
+	}
+
+	alice.play(game.InputHardDrop, nil)
+	locked := time.Now()
+	expectVersus(t, bob.stream, VersusScore)
+	if err := alice.stream.SendMsg(&VersusMessage{Type: VersusTopOut}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots := make(map[string]int)
+	seen := false
+	for {
+		var msg StateMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			break
+		}
+		switch msg.Type {
+		case StateSnapshot:
+			snapshots[msg.Player]++
+		case StateDelta:
+			for _, e := range msg.Events {
+				if e.Type != game.EventLock || msg.Player != "alice" {
+					continue
+				}
+				seen = true
+				if elapsed := time.Since(locked); elapsed < delay-50*time.Millisecond {
+					t.Errorf("lock seen after %v, want after the delay of %v", elapsed, delay)
+				}
+			}
+		}
+	}
+	if !seen {
+		t.Error("the lock of alice must be seen")
+	}
+	// the snapshots at the start and the end of the match
+	if snapshots["alice"] != 2 || snapshots["bob"] != 2 {
+		t.Errorf("snapshots = %v", snapshots)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spectators.Rooms()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms = %v, want the match gone", spectators.Rooms())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -12,48 +12,122 @@ import (
 
 type clientSession interface {
 	Close() error
+	// reopen moves the session to a new connection after a reconnect
+	reopen(open openSessionFunc) error
+	// abandon ends the session when the client gives up reconnecting
+	abandon(err error)
 }
 
 // SSHClient is a ssh client
 type SSHClient struct {
-	client   *ssh.Client
-	sessions map[string]clientSession
-	mux      sync.RWMutex
-	logger   *zap.Logger
+	client       *ssh.Client
+	sessions     map[string]clientSession
+	codecs       map[string]Codec // session name -> codec
+	mux          sync.RWMutex
+	logger       *zap.Logger
+	maxFrameSize uint32
+	closers      []io.Closer
+	addr         string
+	config       *ssh.ClientConfig
+	options      *clientOptions
+	closed       bool
+	done         chan struct{} // closed by Close
 }
 
-// NewSSHClient returns a new SSHClient
-func NewSSHClient(user, addr string, key ssh.Signer, logger *zap.Logger) (*SSHClient, error) {
-	var auth []ssh.AuthMethod
-	auth = append(auth, ssh.PublicKeys(key))
+// NewSSHClient returns a new SSHClient that authenticates with the key.
+// The host key is not verified unless one of the host key options such as WithKnownHosts is given.
+func NewSSHClient(user, addr string, key ssh.Signer, logger *zap.Logger, opts ...ClientOption) (*SSHClient, error) {
+	opts = append([]ClientOption{
+		WithUser(user),
+		WithSigners(key),
+		WithLogger(logger),
+		WithInsecureIgnoreHostKey(),
+	}, opts...)
+	return DialSSHClient(addr, opts...)
+}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            user,
-		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// DialSSHClient connects to the server at addr and returns a new SSHClient.
+// A host key option such as WithKnownHosts or WithInsecureIgnoreHostKey is required.
+func DialSSHClient(addr string, opts ...ClientOption) (*SSHClient, error) {
+	o := clientOptions{
+		logger: zap.NewNop(),
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			o.close()
+			return nil, err
+		}
 	}
 
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+	config, err := o.buildConfig()
 	if err != nil {
-		return nil, xerrors.Errorf("failed to ssh.Dial: %w", err)
+		o.close()
+		return nil, err
 	}
 
-	return &SSHClient{
-		client:   client,
-		sessions: make(map[string]clientSession),
-		mux:      sync.RWMutex{},
-		logger:   logger,
-	}, nil
+	client, err := o.connect(addr, config)
+	if err != nil {
+		o.close()
+		return nil, err
+	}
+
+	c := &SSHClient{
+		client:       client,
+		sessions:     make(map[string]clientSession),
+		codecs:       make(map[string]Codec),
+		mux:          sync.RWMutex{},
+		logger:       o.logger,
+		maxFrameSize: DefaultMaxFrameSize,
+		closers:      o.closers,
+		addr:         addr,
+		config:       config,
+		options:      &o,
+		done:         make(chan struct{}),
+	}
+	if o.reconnect != nil {
+		go c.watch(client)
+	}
+	return c, nil
+}
+
+// SetMaxFrameSize sets the largest payload accepted from the server by sessions created afterwards
+func (c *SSHClient) SetMaxFrameSize(n uint32) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.maxFrameSize = n
 }
 
 func (c *SSHClient) Close() {
 	c.mux.Lock()
 	defer c.mux.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
 	for _, s := range c.sessions {
 		s.Close()
 	}
 	c.sessions = make(map[string]clientSession)
 	c.client.Close()
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+}
+
+// SetCodec sets the codec negotiated for sessions with the name, the server must have it registered.
+// Sessions without a codec use DefaultCodec.
+func (c *SSHClient) SetCodec(name string, codec Codec) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.codecs[name] = codec
+}
+
+func (c *SSHClient) codec(name string) Codec {
+	if codec, ok := c.codecs[name]; ok {
+		return codec
+	}
+	return DefaultCodec
 }
 
 // NewStream returns a new SSH stream session
@@ -63,15 +137,23 @@ func (c *SSHClient) NewStreamSession(ctx context.Context, name string, sendQueSi
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	session, in, out, err := c.newSession(name)
+	resume := ""
+	if c.options.reconnect != nil {
+		resume = resumeNew
+	}
+	pipes, err := c.newSession(name, resume)
 	if err != nil {
 		return nil, err
 	}
 
-	sess := newClientStream(session, in, out, sendQueSize, recvQueSize)
+	sess := newClientStream(pipes.session, pipes.in, pipes.out, c.codec(name), sendQueSize, recvQueSize, c.maxFrameSize)
+	if pipes.resumable {
+		// the token arrives in the first frame
+		sess.stream.setResumable("", 0)
+	}
 
 	go func() {
-		if sess.StartStream(ctx, logger); err != nil {
+		if err := sess.StartStream(ctx, logger); err != nil {
 			logger.Error("client stream results in fail", zap.Error(err))
 		}
 	}()
@@ -86,41 +168,83 @@ func (c *SSHClient) NewUnarySession(name string) (*ClientUnary, error) {
 	c.mux.Lock()
 	defer c.mux.Unlock()
 
-	session, in, out, err := c.newSession(name)
+	pipes, err := c.newSession(name, "")
 	if err != nil {
 		return nil, err
 	}
 
-	sess := newClientUnary(session, in, out)
+	sess := newClientUnary(pipes.session, pipes.in, pipes.out, c.codec(name), c.maxFrameSize)
 	c.sessions[name] = sess
 	return sess, nil
 }
 
-func (c *SSHClient) newSession(name string) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+// sessionPipes is a started session
+type sessionPipes struct {
+	session   *ssh.Session
+	in        io.WriteCloser
+	out       io.Reader
+	resumable bool // the server accepted the resume env
+}
+
+// openSessionFunc opens the session again on the current connection, resume is the value of the resume env
+type openSessionFunc func(resume string) (*sessionPipes, error)
+
+func (c *SSHClient) newSession(name, resume string) (*sessionPipes, error) {
 	if _, ok := c.sessions[name]; ok {
-		return nil, nil, nil, xerrors.Errorf("session %s has already existed", name)
+		return nil, xerrors.Errorf("session %s has already existed", name)
 	}
+	return c.openSession(c.client, name, resume)
+}
 
-	session, err := c.client.NewSession()
+// openSession starts the session with the name. A resume token must be accepted by the server,
+// while resumeNew falls back to a session that is not resumable.
+func (c *SSHClient) openSession(client *ssh.Client, name, resume string) (*sessionPipes, error) {
+	session, err := client.NewSession()
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("failed to NewSession: %w", err)
+		return nil, xerrors.Errorf("failed to NewSession: %w", err)
 	}
 
 	in, err := session.StdinPipe()
 	if err != nil {
 		session.Close()
-		return nil, nil, nil, xerrors.Errorf("failed to new pipe: %w", err)
+		return nil, xerrors.Errorf("failed to new pipe: %w", err)
 	}
 	out, err := session.StdoutPipe()
 	if err != nil {
 		session.Close()
-		return nil, nil, nil, xerrors.Errorf("failed to new pipe: %w", err)
+		return nil, xerrors.Errorf("failed to new pipe: %w", err)
+	}
+
+	if codec, ok := c.codecs[name]; ok {
+		if err := session.Setenv(codecEnv, codec.Name()); err != nil {
+			session.Close()
+			return nil, xerrors.Errorf("failed to negotiate %s codec: %w", codec.Name(), err)
+		}
+	}
+
+	resumable := false
+	if resume != "" {
+		err := session.Setenv(resumeEnv, resume)
+		switch {
+		case err == nil:
+			resumable = true
+		case resume == resumeNew:
+			c.logger.Info("server does not support resumption", zap.String("session", name))
+		default:
+			session.Close()
+			return nil, xerrors.Errorf("failed to resume: %w", err)
+		}
 	}
 
 	if err := session.Start(name); err != nil {
 		session.Close()
-		return nil, nil, nil, xerrors.Errorf("failed to start session: %w", err)
+		return nil, xerrors.Errorf("failed to start session: %w", err)
 	}
 
-	return session, in, out, nil
+	return &sessionPipes{
+		session:   session,
+		in:        in,
+		out:       out,
+		resumable: resumable,
+	}, nil
 }
@@ -0,0 +1,156 @@
+package tetris
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/xerrors"
+)
+
+// ErrUnknownHost is returned when the server is not listed in the known hosts
+var ErrUnknownHost = xerrors.New("unknown host")
+
+// HostKeyMismatchError is returned when the server presents a key other than the trusted one
+type HostKeyMismatchError struct {
+	Host string
+	Want []ssh.PublicKey
+	Got  ssh.PublicKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	want := make([]string, 0, len(e.Want))
+	for _, k := range e.Want {
+		want = append(want, fmt.Sprintf("%s %s", k.Type(), ssh.FingerprintSHA256(k)))
+	}
+	return fmt.Sprintf("host key of %s has changed: got %s %s, want %s. someone may be eavesdropping, "+
+		"remove the old key from the trusted keys only if the server key was rotated",
+		e.Host, e.Got.Type(), ssh.FingerprintSHA256(e.Got), strings.Join(want, " or "))
+}
+
+// WithHostKey pins the host key the server must present
+func WithHostKey(key ssh.PublicKey) ClientOption {
+	return func(o *clientOptions) error {
+		o.hostKeyCallback = func(hostname string, remote net.Addr, got ssh.PublicKey) error {
+			if !bytes.Equal(got.Marshal(), key.Marshal()) {
+				return &HostKeyMismatchError{Host: hostname, Want: []ssh.PublicKey{key}, Got: got}
+			}
+			return nil
+		}
+		return nil
+	}
+}
+
+// WithKnownHosts verifies the host key with OpenSSH known_hosts files, @cert-authority lines are honored
+func WithKnownHosts(files ...string) ClientOption {
+	return func(o *clientOptions) error {
+		cb, err := knownhosts.New(files...)
+		if err != nil {
+			return xerrors.Errorf("failed to load known hosts: %w", err)
+		}
+		o.hostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return knownHostsError(hostname, key, cb(hostname, remote, key))
+		}
+		return nil
+	}
+}
+
+// WithTrustOnFirstUse accepts the key of a server seen for the first time and appends it to the known_hosts file,
+// the file is created when it does not exist. Later connections must present the same key.
+func WithTrustOnFirstUse(file string) ClientOption {
+	return func(o *clientOptions) error {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return xerrors.Errorf("failed to open known hosts: %w", err)
+		}
+		f.Close()
+
+		var mux sync.Mutex
+		o.hostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			mux.Lock()
+			defer mux.Unlock()
+
+			// reload so that keys saved by other clients are honored
+			cb, err := knownhosts.New(file)
+			if err != nil {
+				return xerrors.Errorf("failed to load known hosts: %w", err)
+			}
+			err = cb(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if xerrors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+				return appendKnownHost(file, hostname, key)
+			}
+			return knownHostsError(hostname, key, err)
+		}
+		return nil
+	}
+}
+
+// WithHostCertAuthority accepts host certificates signed by one of the authorities.
+// Plain host keys are verified by the other host key option, they are rejected without one.
+func WithHostCertAuthority(authorities ...ssh.PublicKey) ClientOption {
+	return func(o *clientOptions) error {
+		o.hostAuthorities = append(o.hostAuthorities, authorities...)
+		return nil
+	}
+}
+
+func (o *clientOptions) buildHostKeyCallback() ssh.HostKeyCallback {
+	cb := o.hostKeyCallback
+	if len(o.hostAuthorities) == 0 {
+		return cb
+	}
+
+	if cb == nil {
+		cb = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return xerrors.Errorf("%w: %s presented a plain host key, a certificate is required", ErrUnknownHost, hostname)
+		}
+	}
+	authorities := o.hostAuthorities
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, a := range authorities {
+				if bytes.Equal(a.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		HostKeyFallback: cb,
+	}
+	return checker.CheckHostKey
+}
+
+func knownHostsError(hostname string, key ssh.PublicKey, err error) error {
+	var keyErr *knownhosts.KeyError
+	if !xerrors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) == 0 {
+		return xerrors.Errorf("%w: %s", ErrUnknownHost, hostname)
+	}
+	want := make([]ssh.PublicKey, 0, len(keyErr.Want))
+	for _, k := range keyErr.Want {
+		want = append(want, k.Key)
+	}
+	return &HostKeyMismatchError{Host: hostname, Want: want, Got: key}
+}
+
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return xerrors.Errorf("failed to open known hosts: %w", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return xerrors.Errorf("failed to save host key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package tetris
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func defaultHostPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	return parsePubKey(t, testHostPubKey)
+}
+
+func hostKeyCallback(t *testing.T, opts ...ClientOption) ssh.HostKeyCallback {
+	t.Helper()
+	var o clientOptions
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return o.buildHostKeyCallback()
+}
+
+func TestWithHostKey(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	cb := hostKeyCallback(t, WithHostKey(defaultHostPublicKey(t)))
+
+	if err := cb("127.0.0.1:22", remote, defaultHostPublicKey(t)); err != nil {
+		t.Errorf("pinned key must be accepted: %v", err)
+	}
+
+	err := cb("127.0.0.1:22", remote, defaultPublicKey(t))
+	var mismatch *HostKeyMismatchError
+	if !xerrors.As(err, &mismatch) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mismatch.Host != "127.0.0.1:22" {
+		t.Errorf("unexpected host %s", mismatch.Host)
+	}
+}
+
+func TestWithKnownHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tetris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(file, []byte("[127.0.0.1]:2222 "+testHostPubKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	cb := hostKeyCallback(t, WithKnownHosts(file))
+
+	if err := cb("127.0.0.1:2222", remote, defaultHostPublicKey(t)); err != nil {
+		t.Errorf("known key must be accepted: %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := cb("127.0.0.1:2222", remote, defaultPublicKey(t)); !xerrors.As(err, &mismatch) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := cb("192.0.2.1:2222", remote, defaultHostPublicKey(t)); !xerrors.Is(err, ErrUnknownHost) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWithTrustOnFirstUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tetris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "known_hosts")
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	cb := hostKeyCallback(t, WithTrustOnFirstUse(file))
+
+	if err := cb("127.0.0.1:2222", remote, defaultHostPublicKey(t)); err != nil {
+		t.Fatalf("first key must be trusted: %v", err)
+	}
+	if err := cb("127.0.0.1:2222", remote, defaultHostPublicKey(t)); err != nil {
+		t.Errorf("trusted key must be accepted: %v", err)
+	}
+
+	// the key is persisted for the next client
+	cb = hostKeyCallback(t, WithKnownHosts(file))
+	if err := cb("127.0.0.1:2222", remote, defaultHostPublicKey(t)); err != nil {
+		t.Errorf("trusted key must be saved: %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := cb("127.0.0.1:2222", remote, defaultPublicKey(t)); !xerrors.As(err, &mismatch) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWithHostCertAuthority(t *testing.T) {
+	ca := defaultPrivateKey(t)
+	cert := &ssh.Certificate{
+		Key:             defaultHostPublicKey(t),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	cb := hostKeyCallback(t, WithHostCertAuthority(ca.PublicKey()))
+
+	if err := cb("127.0.0.1:22", remote, cert); err != nil {
+		t.Errorf("certificate signed by the authority must be accepted: %v", err)
+	}
+	if err := cb("127.0.0.1:22", remote, defaultHostPublicKey(t)); !xerrors.Is(err, ErrUnknownHost) {
+		t.Errorf("plain key must be rejected: %v", err)
+	}
+
+	// plain keys fall back to the pinned key
+	cb = hostKeyCallback(t, WithHostCertAuthority(ca.PublicKey()), WithHostKey(defaultHostPublicKey(t)))
+	if err := cb("127.0.0.1:22", remote, defaultHostPublicKey(t)); err != nil {
+		t.Errorf("pinned key must be accepted: %v", err)
+	}
+}
+
+func TestNewSSHClient_HostKeyMismatch(t *testing.T) {
+	c := &ssh.ServerConfig{
+		NoClientAuth: true,
+	}
+	c.AddHostKey(defaultHostKey(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// the handshake fails since the client rejects the host key
+		ssh.NewServerConn(conn, c)
+		conn.Close()
+	}()
+
+	_, err = NewSSHClient("test", l.Addr().String(), defaultPrivateKey(t), zap.NewNop(), WithHostKey(defaultPublicKey(t)))
+	if err == nil || !strings.Contains(err.Error(), "host key of "+l.Addr().String()+" has changed") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package tetris
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/xerrors"
+)
+
+// ClientOption configures SSHClient
+type ClientOption func(*clientOptions) error
+
+type clientOptions struct {
+	user                  string
+	logger                *zap.Logger
+	signers               []ssh.Signer
+	agent                 agent.ExtendedAgent
+	auth                  []ssh.AuthMethod
+	dialer                *net.Dialer
+	conn                  net.Conn
+	dialTimeout           time.Duration
+	clientVersion         string
+	ciphers               []string
+	keyExchanges          []string
+	macs                  []string
+	hostKeyCallback       ssh.HostKeyCallback
+	hostAuthorities       []ssh.PublicKey
+	insecureIgnoreHostKey bool
+	reconnect             *ReconnectPolicy
+	closers               []io.Closer // closed with the client
+}
+
+// WithUser sets the user name to log in as
+func WithUser(user string) ClientOption {
+	return func(o *clientOptions) error {
+		o.user = user
+		return nil
+	}
+}
+
+// WithLogger sets the logger, nothing is logged by default
+func WithLogger(logger *zap.Logger) ClientOption {
+	return func(o *clientOptions) error {
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithSigners authenticates with the private keys, they are tried in order
+func WithSigners(signers ...ssh.Signer) ClientOption {
+	return func(o *clientOptions) error {
+		o.signers = append(o.signers, signers...)
+		return nil
+	}
+}
+
+// WithAgent authenticates with the keys of the ssh-agent listening on SSH_AUTH_SOCK,
+// they are tried after the keys given by WithSigners
+func WithAgent() ClientOption {
+	return func(o *clientOptions) error {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return xerrors.New("SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return xerrors.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		o.agent = agent.NewClient(conn)
+		o.closers = append(o.closers, conn)
+		return nil
+	}
+}
+
+// WithPassword authenticates with the password
+func WithPassword(password string) ClientOption {
+	return func(o *clientOptions) error {
+		o.auth = append(o.auth, ssh.Password(password))
+		return nil
+	}
+}
+
+// WithKeyboardInteractive authenticates by answering the questions of the server
+func WithKeyboardInteractive(challenge ssh.KeyboardInteractiveChallenge) ClientOption {
+	return func(o *clientOptions) error {
+		o.auth = append(o.auth, ssh.KeyboardInteractive(challenge))
+		return nil
+	}
+}
+
+// WithDialTimeout bounds the time to connect and finish the SSH handshake
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) error {
+		o.dialTimeout = d
+		return nil
+	}
+}
+
+// WithDialer dials the server with the dialer
+func WithDialer(d *net.Dialer) ClientOption {
+	return func(o *clientOptions) error {
+		o.dialer = d
+		return nil
+	}
+}
+
+// WithConn runs the SSH connection over conn instead of dialing, e.g. a connection through a proxy
+func WithConn(conn net.Conn) ClientOption {
+	return func(o *clientOptions) error {
+		o.conn = conn
+		return nil
+	}
+}
+
+// WithClientVersion sets the version string sent to the server, it must start with "SSH-2.0-"
+func WithClientVersion(version string) ClientOption {
+	return func(o *clientOptions) error {
+		o.clientVersion = version
+		return nil
+	}
+}
+
+// WithCiphers sets the allowed ciphers in order of preference
+func WithCiphers(ciphers ...string) ClientOption {
+	return func(o *clientOptions) error {
+		o.ciphers = ciphers
+		return nil
+	}
+}
+
+// WithKeyExchanges sets the allowed key exchange algorithms in order of preference
+func WithKeyExchanges(kex ...string) ClientOption {
+	return func(o *clientOptions) error {
+		o.keyExchanges = kex
+		return nil
+	}
+}
+
+// WithMACs sets the allowed MAC algorithms in order of preference
+func WithMACs(macs ...string) ClientOption {
+	return func(o *clientOptions) error {
+		o.macs = macs
+		return nil
+	}
+}
+
+// WithInsecureIgnoreHostKey accepts any host key, it must not be used against untrusted networks
+func WithInsecureIgnoreHostKey() ClientOption {
+	return func(o *clientOptions) error {
+		o.insecureIgnoreHostKey = true
+		return nil
+	}
+}
+
+func (o *clientOptions) close() {
+	for _, c := range o.closers {
+		c.Close()
+	}
+}
+
+func (o *clientOptions) buildAuth() []ssh.AuthMethod {
+	var auth []ssh.AuthMethod
+	// the client tries each method once, so every key goes to a single publickey method
+	if len(o.signers) > 0 || o.agent != nil {
+		signers := o.signers
+		agent := o.agent
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if agent == nil {
+				return signers, nil
+			}
+			agentSigners, err := agent.Signers()
+			if err != nil {
+				return nil, xerrors.Errorf("failed to get keys from ssh-agent: %w", err)
+			}
+			return append(append([]ssh.Signer{}, signers...), agentSigners...), nil
+		}))
+	}
+	return append(auth, o.auth...)
+}
+
+func (o *clientOptions) buildConfig() (*ssh.ClientConfig, error) {
+	hostKeyCallback := o.buildHostKeyCallback()
+	if hostKeyCallback == nil {
+		if !o.insecureIgnoreHostKey {
+			return nil, xerrors.New("host key is not verified, give a host key option such as WithKnownHosts or WithInsecureIgnoreHostKey")
+		}
+		o.logger.Warn("host key is not verified, connection is vulnerable to man-in-the-middle attacks")
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+
+	if o.reconnect != nil && o.conn != nil {
+		return nil, xerrors.New("a connection given by WithConn can not be re-dialed, WithReconnect requires dialing")
+	}
+
+	config := &ssh.ClientConfig{
+		User:            o.user,
+		Auth:            o.buildAuth(),
+		HostKeyCallback: hostKeyCallback,
+		ClientVersion:   o.clientVersion,
+		Timeout:         o.dialTimeout,
+	}
+	config.Ciphers = o.ciphers
+	config.KeyExchanges = o.keyExchanges
+	config.MACs = o.macs
+	return config, nil
+}
+
+func (o *clientOptions) dial(addr string) (net.Conn, error) {
+	if o.conn != nil {
+		return o.conn, nil
+	}
+	dialer := o.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if o.dialTimeout > 0 && (dialer.Timeout == 0 || dialer.Timeout > o.dialTimeout) {
+		d := *dialer
+		d.Timeout = o.dialTimeout
+		dialer = &d
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// connect dials addr and finishes the SSH handshake
+func (o *clientOptions) connect(addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := o.dial(addr)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to dial: %w", err)
+	}
+
+	if o.dialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(o.dialTimeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, xerrors.Errorf("failed to ssh.Dial: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
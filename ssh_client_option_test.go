@@ -0,0 +1,190 @@
+package tetris
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/xerrors"
+)
+
+func serveTestAgent(t *testing.T) string {
+	t.Helper()
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(testPrivateKey), []byte(testPrivateKeyPass))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tetris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		os.RemoveAll(dir)
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return sock
+}
+
+func TestDialSSHClient(t *testing.T) {
+	pubkey := defaultPublicKey(t).Marshal()
+	publicKeyCallback := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !bytes.Equal(pubkey, key.Marshal()) {
+			return nil, xerrors.New("unauthorized user")
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		name    string
+		config  *ssh.ServerConfig
+		opts    func(t *testing.T, addr string) []ClientOption
+		wantErr bool
+	}{
+		{
+			name: "password",
+			config: &ssh.ServerConfig{
+				PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					if string(password) != "secret" {
+						return nil, xerrors.New("wrong password")
+					}
+					return nil, nil
+				},
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				return []ClientOption{WithPassword("secret")}
+			},
+		},
+		{
+			name: "keyboard interactive",
+			config: &ssh.ServerConfig{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := client("", "", []string{"level? "}, []bool{true})
+					if err != nil {
+						return nil, err
+					}
+					if len(answers) != 1 || answers[0] != "15" {
+						return nil, xerrors.New("wrong answer")
+					}
+					return nil, nil
+				},
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				return []ClientOption{WithKeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					return []string{"15"}, nil
+				})}
+			},
+		},
+		{
+			name: "signer after a wrong one",
+			config: &ssh.ServerConfig{
+				PublicKeyCallback: publicKeyCallback,
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				return []ClientOption{WithSigners(defaultHostKey(t), defaultPrivateKey(t))}
+			},
+		},
+		{
+			name: "agent",
+			config: &ssh.ServerConfig{
+				PublicKeyCallback: publicKeyCallback,
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				sock := serveTestAgent(t)
+				old := os.Getenv("SSH_AUTH_SOCK")
+				os.Setenv("SSH_AUTH_SOCK", sock)
+				t.Cleanup(func() {
+					os.Setenv("SSH_AUTH_SOCK", old)
+				})
+				return []ClientOption{WithAgent()}
+			},
+		},
+		{
+			name: "custom conn and version",
+			config: &ssh.ServerConfig{
+				PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+					if string(conn.ClientVersion()) != "SSH-2.0-tetris" {
+						return nil, xerrors.Errorf("unexpected version %s", conn.ClientVersion())
+					}
+					return publicKeyCallback(conn, key)
+				},
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return []ClientOption{WithConn(conn), WithClientVersion("SSH-2.0-tetris"), WithSigners(defaultPrivateKey(t))}
+			},
+		},
+		{
+			name: "algorithm preferences",
+			config: &ssh.ServerConfig{
+				PublicKeyCallback: publicKeyCallback,
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				return []ClientOption{
+					WithSigners(defaultPrivateKey(t)),
+					WithCiphers("aes128-ctr"),
+					WithKeyExchanges("curve25519-sha256@libssh.org"),
+					WithMACs("hmac-sha2-256"),
+				}
+			},
+		},
+		{
+			name: "no acceptable auth",
+			config: &ssh.ServerConfig{
+				PublicKeyCallback: publicKeyCallback,
+			},
+			opts: func(t *testing.T, addr string) []ClientOption {
+				return []ClientOption{WithPassword("secret")}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := testSSHServer(t, tt.config, map[string]sshHandler{}).String()
+			opts := append(tt.opts(t, addr), WithUser("test"), WithInsecureIgnoreHostKey(), WithDialTimeout(5*time.Second))
+			cli, err := DialSSHClient(addr, opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialSSHClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				cli.Close()
+			}
+		})
+	}
+}
+
+func TestDialSSHClient_HostKeyRequired(t *testing.T) {
+	_, err := DialSSHClient("127.0.0.1:0", WithUser("test"), WithSigners(defaultPrivateKey(t)))
+	if err == nil {
+		t.Error("dial without host key verification must fail")
+	}
+}
@@ -0,0 +1,147 @@
+package tetris
+
+import (
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// reconnectJitter randomizes the waits between attempts by this fraction, so that clients do not come back at once
+const reconnectJitter = 0.2
+
+// ReconnectPolicy is how SSHClient re-dials the server after the connection is lost
+type ReconnectPolicy struct {
+	// InitialInterval is the wait before the first attempt
+	InitialInterval time.Duration
+	// MaxInterval caps the wait between attempts
+	MaxInterval time.Duration
+	// Multiplier grows the wait after every failed attempt
+	Multiplier float64
+	// MaxElapsedTime gives up reconnecting after it, the client retries forever if zero
+	MaxElapsedTime time.Duration
+}
+
+// DefaultReconnectPolicy retries with exponential backoff from 500ms up to 30s for 5 minutes
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     30 * time.Second,
+	Multiplier:      2,
+	MaxElapsedTime:  5 * time.Minute,
+}
+
+// WithReconnect re-dials the server with the policy when the connection is lost.
+// Unary sessions are opened again, calls in flight fail. Stream sessions are resumed where they were
+// if the server enables resumption, see SSHServer.EnableResume.
+func WithReconnect(policy ReconnectPolicy) ClientOption {
+	return func(o *clientOptions) error {
+		if policy.InitialInterval <= 0 {
+			return xerrors.New("initial interval must be positive")
+		}
+		if policy.Multiplier < 1 {
+			return xerrors.New("multiplier must not be less than 1")
+		}
+		o.reconnect = &policy
+		return nil
+	}
+}
+
+func (p *ReconnectPolicy) next(wait time.Duration) time.Duration {
+	wait = time.Duration(float64(wait) * p.Multiplier)
+	if p.MaxInterval > 0 && wait > p.MaxInterval {
+		wait = p.MaxInterval
+	}
+	return wait
+}
+
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + reconnectJitter*(2*rand.Float64()-1)))
+}
+
+func (c *SSHClient) isClosed() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.closed
+}
+
+// watch reconnects whenever the connection is lost until the client is closed
+func (c *SSHClient) watch(client *ssh.Client) {
+	for {
+		err := client.Wait()
+		if c.isClosed() {
+			return
+		}
+		c.logger.Warn("connection lost, reconnecting", zap.Error(err))
+
+		client, err = c.reconnect()
+		if err != nil {
+			c.logger.Error("gave up reconnecting", zap.Error(err))
+			c.abandonSessions(err)
+			return
+		}
+		c.logger.Info("reconnected")
+	}
+}
+
+func (c *SSHClient) reconnect() (*ssh.Client, error) {
+	policy := c.options.reconnect
+	start := time.Now()
+	wait := policy.InitialInterval
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(jitter(wait))
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return nil, xerrors.New("client is closed")
+		}
+
+		client, err := c.options.connect(c.addr, c.config)
+		if err == nil {
+			if err := c.reopenSessions(client); err != nil {
+				client.Close()
+				return nil, err
+			}
+			return client, nil
+		}
+
+		c.logger.Warn("failed to reconnect", zap.Int("attempt", attempt), zap.Error(err))
+		if policy.MaxElapsedTime > 0 && time.Since(start) >= policy.MaxElapsedTime {
+			return nil, xerrors.Errorf("failed to reconnect in %d attempts: %w", attempt, err)
+		}
+		wait = policy.next(wait)
+	}
+}
+
+// reopenSessions moves the sessions to the new connection, sessions that can not be reopened are removed
+func (c *SSHClient) reopenSessions(client *ssh.Client) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return xerrors.New("client is closed")
+	}
+	c.client = client
+
+	for name, s := range c.sessions {
+		name := name
+		open := func(resume string) (*sessionPipes, error) {
+			return c.openSession(client, name, resume)
+		}
+		if err := s.reopen(open); err != nil {
+			c.logger.Warn("failed to reopen session", zap.String("session", name), zap.Error(err))
+			s.abandon(err)
+			delete(c.sessions, name)
+		}
+	}
+	return nil
+}
+
+func (c *SSHClient) abandonSessions(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, s := range c.sessions {
+		s.abandon(err)
+	}
+}
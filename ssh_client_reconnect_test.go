@@ -0,0 +1,235 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// flakyProxy forwards connections to addr until they are cut
+type flakyProxy struct {
+	listener net.Listener
+	mux      sync.Mutex
+	conns    []net.Conn
+}
+
+func newFlakyProxy(t *testing.T, addr string) *flakyProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &flakyProxy{listener: l}
+	t.Cleanup(func() {
+		l.Close()
+		p.cut()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mux.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mux.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+	return p
+}
+
+func (p *flakyProxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+// cut drops every connection, as a flaky network would
+func (p *flakyProxy) cut() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestSSHClient_Reconnect(t *testing.T) {
+	addr := "127.0.0.1:31116"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.EnableResume(10 * time.Second)
+
+	server.RegisterHandler("echo", func(ctx context.Context, stream *ServerStream) {
+		for {
+			p, err := stream.Recv()
+			switch {
+			case xerrors.Is(err, io.EOF):
+				return
+			case err != nil:
+				t.Error(err)
+				return
+			}
+			if err := stream.Send(&Packet{Data: append([]byte{}, p.Data...)}); err != nil {
+				t.Error(err)
+				return
+			}
+			p.Release()
+		}
+	})
+	server.RegisterUnaryHandler("ping", func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		return &Packet{Data: []byte("pong")}, nil
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	proxy := newFlakyProxy(t, addr)
+	cli, err := DialSSHClient(proxy.addr(),
+		WithUser("test"),
+		WithSigners(defaultPrivateKey(t)),
+		WithInsecureIgnoreHostKey(),
+		WithReconnect(ReconnectPolicy{
+			InitialInterval: 10 * time.Millisecond,
+			MaxInterval:     100 * time.Millisecond,
+			Multiplier:      2,
+			MaxElapsedTime:  10 * time.Second,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "echo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unary, err := cli.NewUnarySession("ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	go func() {
+		for i := 0; i < n; i++ {
+			if i == n/2 {
+				proxy.cut()
+			}
+			if err := stream.Send(&Packet{Data: []byte(strconv.Itoa(i))}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	// every packet is echoed exactly once and in order across the reconnect
+	for i := 0; i < n; i++ {
+		p, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() %d error = %v", i, err)
+		}
+		if got := string(p.Data); got != strconv.Itoa(i) {
+			t.Fatalf("Recv() = %s, want %d", got, i)
+		}
+	}
+	if _, err := stream.Recv(); !xerrors.Is(err, io.EOF) {
+		t.Errorf("Recv() error = %v, want EOF", err)
+	}
+
+	// the unary session is opened again on the new connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := unary.SendAndRecv(&Packet{Data: []byte("ping")})
+		if err == nil {
+			if string(res.Data) != "pong" {
+				t.Errorf("unexpected response %s", res.Data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unary session is not reopened: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSHClient_ResumeRejected(t *testing.T) {
+	addr := "127.0.0.1:31117"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// resumption is not enabled, the stream ends with the connection
+	server.RegisterHandler("wait", func(ctx context.Context, stream *ServerStream) {
+		<-stream.Done()
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	proxy := newFlakyProxy(t, addr)
+	cli, err := DialSSHClient(proxy.addr(),
+		WithUser("test"),
+		WithSigners(defaultPrivateKey(t)),
+		WithInsecureIgnoreHostKey(),
+		WithReconnect(ReconnectPolicy{InitialInterval: 10 * time.Millisecond, Multiplier: 2}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "wait", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.cut()
+
+	select {
+	case <-stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream must end when it can not be resumed")
+	}
+	if err := stream.Err(); err == nil || xerrors.Is(err, io.EOF) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
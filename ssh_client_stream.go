@@ -6,79 +6,117 @@ import (
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 )
 
 // ClientStream is a ssh session
 type ClientStream struct {
-	session  *ssh.Session
-	writer   io.WriteCloser
-	reader   io.Reader
-	request  chan *Packet
-	response chan *Packet
+	stream       *packetStream
+	maxFrameSize uint32
 }
 
-func newClientStream(session *ssh.Session, writer io.WriteCloser, reader io.Reader, sendQueSize, recvQueSize int) *ClientStream {
+func newClientStream(session *ssh.Session, writer io.WriteCloser, reader io.Reader, codec Codec, sendQueSize, recvQueSize int, maxFrameSize uint32) *ClientStream {
+	t := newTransport(writer, reader, writer.Close, session.Close, maxFrameSize)
 	return &ClientStream{
-		session:  session,
-		writer:   writer,
-		reader:   reader,
-		request:  make(chan *Packet, sendQueSize),
-		response: make(chan *Packet, recvQueSize),
+		stream:       newPacketStream(t, codec, sendQueSize, recvQueSize),
+		maxFrameSize: maxFrameSize,
 	}
 }
 
-func (c *ClientStream) Send(p *Packet) error {
-	c.request <- p
+// reopen resumes the stream on a session opened on the new connection
+func (c *ClientStream) reopen(open openSessionFunc) error {
+	token := c.stream.resumeToken()
+	if token == "" {
+		return xerrors.New("stream is not resumable")
+	}
+	pipes, err := open(token)
+	if err != nil {
+		c.stream.abandon(err)
+		return err
+	}
+	t := newTransport(pipes.in, pipes.out, pipes.in.Close, pipes.session.Close, c.maxFrameSize)
+	if err := c.stream.attachTransport(t); err != nil {
+		pipes.session.Close()
+		return err
+	}
 	return nil
 }
 
+// abandon ends the stream when it can not move to the new connection
+func (c *ClientStream) abandon(err error) {
+	c.stream.abandon(err)
+}
+
+// Send queues a packet, it returns the error that ended the stream if the stream is no longer running
+func (c *ClientStream) Send(p *Packet) error {
+	return c.stream.sendContext(context.Background(), p)
+}
+
+// SendContext is Send that gives up when ctx is done
+func (c *ClientStream) SendContext(ctx context.Context, p *Packet) error {
+	return c.stream.sendContext(ctx, p)
+}
+
+// Recv receives a packet, it returns io.EOF when the server ends the stream
 func (c *ClientStream) Recv() (*Packet, error) {
-	p := <-c.response
-	if p == nil {
-		return nil, io.EOF
-	}
-	return p, nil
+	return c.stream.recvContext(context.Background())
+}
+
+// RecvContext is Recv that gives up when ctx is done
+func (c *ClientStream) RecvContext(ctx context.Context) (*Packet, error) {
+	return c.stream.recvContext(ctx)
+}
+
+// SendMsg marshals v with the negotiated codec and sends it
+func (c *ClientStream) SendMsg(v interface{}) error {
+	return c.stream.sendMsg(context.Background(), v)
+}
+
+// RecvMsg receives a message and unmarshals it into v with the negotiated codec
+func (c *ClientStream) RecvMsg(v interface{}) error {
+	return c.stream.recvMsg(context.Background(), v)
+}
+
+// SendMsgContext is SendMsg that gives up when ctx is done
+func (c *ClientStream) SendMsgContext(ctx context.Context, v interface{}) error {
+	return c.stream.sendMsg(ctx, v)
+}
+
+// RecvMsgContext is RecvMsg that gives up when ctx is done
+func (c *ClientStream) RecvMsgContext(ctx context.Context, v interface{}) error {
+	return c.stream.recvMsg(ctx, v)
 }
 
+// CloseSend writes the packets already queued and tells the server no more packets will be sent, packets are still received.
+// Send fails with ErrStreamClosed afterwards.
+func (c *ClientStream) CloseSend() {
+	c.stream.closeSend()
+}
+
+// Close ends the stream at once, queued packets are dropped. It is safe to call Close more than once.
 func (c *ClientStream) Close() error {
-	close(c.request)
-	close(c.response)
-	return c.session.Close()
+	return c.stream.close()
+}
+
+// Done returns a channel that is closed when the stream ends
+func (c *ClientStream) Done() <-chan struct{} {
+	return c.stream.Done()
+}
+
+// ServerShutdown returns a channel that is closed when the server announces that it is going down.
+// The stream keeps running until the handler on the server returns.
+func (c *ClientStream) ServerShutdown() <-chan struct{} {
+	return c.stream.shutdown
+}
+
+// Err returns why the stream ended, it returns nil while the stream is running.
+// It is io.EOF when both sides finished sending, ErrStreamClosed after Close,
+// the context error when cancelled, or the read/write failure otherwise.
+func (c *ClientStream) Err() error {
+	return c.stream.Err()
 }
 
+// StartStream pumps packets until the stream ends or ctx is done
 func (c *ClientStream) StartStream(ctx context.Context, logger *zap.Logger) error {
-	eg, ctx := errgroup.WithContext(ctx)
-
-	// start watching request
-	eg.Go(func() error {
-		for {
-			p := <-c.request
-			if p == nil {
-				return nil
-			}
-			if err := p.Write(c.writer); err != nil {
-				logger.Error("failed to write to client stream", zap.Error(err), zap.Any("request", p))
-				return xerrors.Errorf("failed to write to stream: %w", err)
-			}
-		}
-	})
-
-	// start receiving
-	eg.Go(func() error {
-		for {
-			p, err := ReadPacket(c.reader)
-			if xerrors.Is(err, io.EOF) {
-				return nil
-			}
-			if err != nil {
-				logger.Error("failed to read from client stream", zap.Error(err))
-				return err
-			}
-			c.response <- p
-		}
-	})
-
-	return eg.Wait()
+	return c.stream.run(ctx, logger)
 }
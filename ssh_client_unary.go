@@ -2,32 +2,195 @@ package tetris
 
 import (
 	"io"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
 )
 
-// ClientUnary is a ssh session
+// ClientUnary is a ssh session. It is safe to call SendAndRecv from multiple goroutines,
+// responses are routed to callers by the request id.
+//
+// After the client reconnects, calls run on a new session. Calls in flight when the connection was lost fail.
 type ClientUnary struct {
-	session *ssh.Session
-	writer  io.WriteCloser
-	reader  io.Reader
+	codec        Codec
+	maxFrameSize uint32
+	mux          sync.Mutex
+	conn         *unaryConn
+	closed       bool
+	lastID       uint32
+	pending      map[uint32]chan *Packet // request id -> waiting caller
 }
 
-func newClientUnary(session *ssh.Session, writer io.WriteCloser, reader io.Reader) *ClientUnary {
-	return &ClientUnary{
+// unaryConn is the session a ClientUnary runs on
+type unaryConn struct {
+	session  *ssh.Session
+	writer   io.WriteCloser
+	reader   *PacketReader
+	writeMux sync.Mutex
+	done     chan struct{}
+	err      error
+}
+
+func newClientUnary(session *ssh.Session, writer io.WriteCloser, reader io.Reader, codec Codec, maxFrameSize uint32) *ClientUnary {
+	c := &ClientUnary{
+		codec:        codec,
+		maxFrameSize: maxFrameSize,
+		pending:      make(map[uint32]chan *Packet),
+	}
+	c.start(session, writer, reader)
+	return c
+}
+
+func (c *ClientUnary) start(session *ssh.Session, writer io.WriteCloser, reader io.Reader) {
+	conn := &unaryConn{
 		session: session,
 		writer:  writer,
-		reader:  reader,
+		reader:  NewPacketReader(reader, c.maxFrameSize),
+		done:    make(chan struct{}),
+	}
+	c.conn = conn
+	go c.demux(conn)
+}
+
+// reopen moves the session to the new connection
+func (c *ClientUnary) reopen(open openSessionFunc) error {
+	pipes, err := open("")
+	if err != nil {
+		return err
 	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		pipes.session.Close()
+		return ErrStreamClosed
+	}
+	c.conn.session.Close()
+	c.start(pipes.session, pipes.in, pipes.out)
+	return nil
 }
 
+// abandon does nothing, calls already fail when the connection is lost
+func (c *ClientUnary) abandon(err error) {}
+
 func (c *ClientUnary) SendAndRecv(req *Packet) (*Packet, error) {
-	if err := req.Write(c.writer); err != nil {
+	id, ch, conn := c.register()
+	defer c.unregister(id)
+
+	p := *req
+	p.ID = id
+	if err := conn.write(&p); err != nil {
+		return nil, err
+	}
+
+	var res *Packet
+	select {
+	case res = <-ch:
+	case <-conn.done:
+		// the response may have been routed right before the session ended
+		select {
+		case res = <-ch:
+		default:
+			return nil, conn.err
+		}
+	}
+	if err := res.Err(); err != nil {
 		return nil, err
 	}
-	return ReadPacket(c.reader)
+	return res, nil
+}
+
+// SendAndRecvMsg marshals req with the negotiated codec, sends it and unmarshals the response into res
+func (c *ClientUnary) SendAndRecvMsg(req, res interface{}) error {
+	p, err := marshalPacket(c.codec, req)
+	if err != nil {
+		return err
+	}
+	p, err = c.SendAndRecv(p)
+	if err != nil {
+		return err
+	}
+	return unmarshalPacket(c.codec, p, res)
 }
 
 func (c *ClientUnary) Close() error {
-	return c.session.Close()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.closed = true
+	return c.conn.session.Close()
+}
+
+func (c *ClientUnary) register() (uint32, chan *Packet, *unaryConn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for {
+		c.lastID++
+		// 0 is reserved for frames not bound to a request
+		if _, ok := c.pending[c.lastID]; c.lastID != 0 && !ok {
+			break
+		}
+	}
+	ch := make(chan *Packet, 1)
+	c.pending[c.lastID] = ch
+	return c.lastID, ch, c.conn
+}
+
+func (c *ClientUnary) unregister(id uint32) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.pending, id)
+}
+
+func (conn *unaryConn) write(p *Packet) error {
+	conn.writeMux.Lock()
+	defer conn.writeMux.Unlock()
+	return p.Write(conn.writer)
+}
+
+// demux routes responses to the waiting callers until the session ends
+func (c *ClientUnary) demux(conn *unaryConn) {
+	conn.err = c.readResponses(conn)
+	close(conn.done)
+}
+
+func (c *ClientUnary) readResponses(conn *unaryConn) error {
+	for {
+		p, err := conn.reader.ReadPacket()
+		if xerrors.Is(err, io.EOF) {
+			return xerrors.Errorf("unary session is closed: %w", io.EOF)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case FrameData, FrameError:
+			if p.ID == 0 {
+				// not bound to a request, the server gave up the session
+				if err := p.Err(); err != nil {
+					return err
+				}
+				continue
+			}
+			c.mux.Lock()
+			ch, ok := c.pending[p.ID]
+			c.mux.Unlock()
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- p:
+			default:
+				// duplicated response, the caller already has one
+			}
+		case FramePing:
+			if p.Flags&FlagAck == 0 {
+				if err := conn.write(&Packet{Type: FramePing, Flags: FlagAck, ID: p.ID, Data: p.Data}); err != nil {
+					return err
+				}
+			}
+		case FrameClose:
+			return xerrors.Errorf("unary session is closed by server: %w", io.EOF)
+		}
+	}
 }
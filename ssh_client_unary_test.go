@@ -27,7 +27,7 @@ func TestSSHClient_SendRecv(t *testing.T) {
 	handlers := map[string]sshHandler{
 		"test": func(r *Packet, w io.Writer) bool {
 			res := func(s string) {
-				p := Packet{Data: []byte(s)}
+				p := Packet{ID: r.ID, Data: []byte(s)}
 				if err := p.Write(w); err != nil {
 					t.Fatal(err)
 				}
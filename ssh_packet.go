@@ -3,43 +3,282 @@ package tetris
 import (
 	"encoding/binary"
 	"io"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
 
+// Frame header layout, see PROTOCOL.md for details.
+//
+//	byte    magic
+//	byte    version
+//	byte    type
+//	byte    flags
+//	uint32  id
+//	uint32  length
+//	byte[n] payload; n = length
+const (
+	// FrameMagic is the first byte of every frame
+	FrameMagic byte = 0x54 // 'T'
+	// ProtocolVersion is the highest frame version this package speaks
+	ProtocolVersion byte = 1
+	// MinProtocolVersion is the lowest frame version this package accepts
+	MinProtocolVersion byte = 1
+
+	// DefaultMaxFrameSize is the largest payload accepted unless configured
+	DefaultMaxFrameSize uint32 = 1 << 20
+
+	frameHeaderSize  = 12
+	legacyHeaderSize = 4
+	// payloads larger than this are not kept in the pool
+	maxPooledBufferSize = 64 << 10
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+func getBuffer(n int) []byte {
+	b := *bufferPool.Get().(*[]byte)
+	if cap(b) < n {
+		if n <= maxPooledBufferSize {
+			putBuffer(b)
+		}
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+func putBuffer(b []byte) {
+	if cap(b) > maxPooledBufferSize {
+		return
+	}
+	b = b[:0]
+	bufferPool.Put(&b)
+}
+
+// FrameType is a kind of frame
+type FrameType uint8
+
+const (
+	// FrameData carries an application message
+	FrameData FrameType = iota
+	// FrameControl carries a protocol level message
+	FrameControl
+	// FramePing is a keepalive, it is answered by a ping frame with FlagAck
+	FramePing
+	// FrameError carries an error message from the peer
+	FrameError
+	// FrameClose tells the peer that no more frames will be sent
+	FrameClose
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "data"
+	case FrameControl:
+		return "control"
+	case FramePing:
+		return "ping"
+	case FrameError:
+		return "error"
+	case FrameClose:
+		return "close"
+	}
+	return "unknown"
+}
+
+// FrameFlags is a bit set of frame flags
+type FrameFlags uint8
+
+const (
+	// FlagAck marks a frame as an answer to the frame with the same type and id
+	FlagAck FrameFlags = 1 << iota
+)
+
+var (
+	// ErrBadMagic is returned when a frame does not start with FrameMagic
+	ErrBadMagic = xerrors.New("bad frame magic")
+	// ErrLegacyFrame is returned when a peer speaks the length-only framing of older versions
+	ErrLegacyFrame = xerrors.New("legacy frame is not supported")
+	// ErrUnsupportedVersion is returned when a peer speaks a version out of [MinProtocolVersion, ProtocolVersion]
+	ErrUnsupportedVersion = xerrors.New("unsupported protocol version")
+	// ErrFrameTooLarge is returned when a peer announces a payload larger than the max frame size
+	ErrFrameTooLarge = xerrors.New("frame too large")
+	// ErrTruncatedFrame is returned when the reader ends in the middle of a frame
+	ErrTruncatedFrame = xerrors.New("truncated frame")
+)
+
+// RemoteError is an error sent by the peer with an error frame
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
 // Packet is a message
 type Packet struct {
-	Data []byte
+	Type  FrameType
+	Flags FrameFlags
+	ID    uint32
+	Data  []byte
+
+	pooled bool
+}
+
+func newErrorPacket(id uint32, err error) *Packet {
+	return &Packet{
+		Type: FrameError,
+		ID:   id,
+		Data: []byte(err.Error()),
+	}
+}
+
+// Err returns RemoteError if the packet is an error frame
+func (p *Packet) Err() error {
+	if p.Type != FrameError {
+		return nil
+	}
+	return &RemoteError{Message: string(p.Data)}
+}
+
+// Release returns the payload buffer to the pool. The packet must not be used after Release.
+// It does nothing for packets that were not returned by PacketReader.
+func (p *Packet) Release() {
+	if !p.pooled {
+		return
+	}
+	putBuffer(p.Data)
+	p.Data = nil
+	p.pooled = false
 }
 
 // Write writes binary that marshalled from packet to io.Writer
 func (p *Packet) Write(w io.Writer) error {
-	header := make([]byte, 4) // TODO: define protocol
+	buf := make([]byte, frameHeaderSize+len(p.Data))
+	buf[0] = FrameMagic
+	buf[1] = ProtocolVersion
+	buf[2] = byte(p.Type)
+	buf[3] = byte(p.Flags)
+	binary.BigEndian.PutUint32(buf[4:8], p.ID)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(p.Data)))
+	copy(buf[frameHeaderSize:], p.Data)
 
-	binary.BigEndian.PutUint32(header, uint32(len(p.Data)))
-	if _, err := w.Write(header); err != nil {
-		return xerrors.Errorf("failed to Write header: %w", err)
-	}
-	if _, err := w.Write(p.Data); err != nil {
-		return xerrors.Errorf("failed to Write data: %w", err)
+	if _, err := w.Write(buf); err != nil {
+		return xerrors.Errorf("failed to Write frame: %w", err)
 	}
 	return nil
 }
 
 // ReadPacket reads Packet data from Reader
 func ReadPacket(r io.Reader) (*Packet, error) {
-	header := make([]byte, 4) // TODO: define protocol
-	if _, err := r.Read(header); err != nil {
-		return nil, xerrors.Errorf("failed to read header: %w", err)
+	return NewPacketReader(r, DefaultMaxFrameSize).ReadPacket()
+}
+
+// PacketReader reads frames from an underlying reader
+type PacketReader struct {
+	r            io.Reader
+	maxFrameSize uint32
+	header       [frameHeaderSize]byte
+}
+
+// NewPacketReader returns a PacketReader that refuses payloads larger than maxFrameSize
+func NewPacketReader(r io.Reader, maxFrameSize uint32) *PacketReader {
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &PacketReader{
+		r:            r,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// ReadPacket reads a frame. It returns io.EOF only when the reader ends between frames.
+// The payload of the returned Packet is taken from a pool, call Packet.Release to return it.
+func (pr *PacketReader) ReadPacket() (*Packet, error) {
+	header := pr.header[:]
+	if n, err := io.ReadFull(pr.r, header[:2]); err != nil {
+		if n == 0 && xerrors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, xerrors.Errorf("failed to read header: %w", truncated(err))
+	}
+	if err := checkVersion(header[0], header[1]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(pr.r, header[2:]); err != nil {
+		return nil, xerrors.Errorf("failed to read header: %w", truncated(err))
+	}
+
+	len := binary.BigEndian.Uint32(header[8:12])
+	if len > pr.maxFrameSize {
+		return nil, xerrors.Errorf("%w: %d bytes exceeds %d bytes", ErrFrameTooLarge, len, pr.maxFrameSize)
 	}
 
-	len := binary.BigEndian.Uint32(header)
-	buf := make([]byte, len)
-	if _, err := r.Read(buf); err != nil {
-		return nil, xerrors.Errorf("failed to read data: %w", err)
+	buf := getBuffer(int(len))
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		putBuffer(buf)
+		return nil, xerrors.Errorf("failed to read data: %w", truncated(err))
 	}
 
 	return &Packet{
-		Data: buf,
+		Type:   FrameType(header[2]),
+		Flags:  FrameFlags(header[3]),
+		ID:     binary.BigEndian.Uint32(header[4:8]),
+		Data:   buf,
+		pooled: true,
 	}, nil
 }
+
+func truncated(err error) error {
+	if xerrors.Is(err, io.EOF) || xerrors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncatedFrame
+	}
+	return err
+}
+
+func checkVersion(magic, version byte) error {
+	if magic != FrameMagic {
+		// frames of older versions start with the most significant byte of a 32bit length,
+		// which is zero for any practical message size.
+		if magic == 0 {
+			return ErrLegacyFrame
+		}
+		return xerrors.Errorf("%w: 0x%02x", ErrBadMagic, magic)
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return xerrors.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	return nil
+}
+
+// writeRejection tells the peer why its frames are refused in a format the peer can read.
+// Peers speaking the legacy framing receive a length prefixed text, others receive an error frame.
+func writeRejection(w io.Writer, err error) error {
+	msg := err.Error()
+	if !xerrors.Is(err, ErrFrameTooLarge) {
+		msg = xerrors.Errorf("protocol mismatch, supported versions are %d-%d: %w", MinProtocolVersion, ProtocolVersion, err).Error()
+	}
+	if !xerrors.Is(err, ErrLegacyFrame) {
+		return newErrorPacket(0, xerrors.New(msg)).Write(w)
+	}
+
+	buf := make([]byte, legacyHeaderSize+len(msg))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[legacyHeaderSize:], msg)
+	if _, err := w.Write(buf); err != nil {
+		return xerrors.Errorf("failed to Write rejection: %w", err)
+	}
+	return nil
+}
+
+func isProtocolError(err error) bool {
+	return xerrors.Is(err, ErrLegacyFrame) || xerrors.Is(err, ErrUnsupportedVersion) || xerrors.Is(err, ErrBadMagic) ||
+		xerrors.Is(err, ErrFrameTooLarge)
+}
@@ -0,0 +1,219 @@
+package tetris
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/xerrors"
+)
+
+func TestPacket_WriteRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet Packet
+	}{
+		{
+			name:   "data",
+			packet: Packet{Type: FrameData, ID: 1, Data: []byte("hello")},
+		},
+		{
+			name:   "ping ack",
+			packet: Packet{Type: FramePing, Flags: FlagAck, ID: 0xffffffff, Data: []byte{}},
+		},
+		{
+			name:   "error",
+			packet: Packet{Type: FrameError, Data: []byte("failed")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.packet.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != frameHeaderSize+len(tt.packet.Data) {
+				t.Errorf("unexpected frame size %d", buf.Len())
+			}
+			// deliver a byte at a time as a slow channel does
+			got, err := ReadPacket(iotest.OneByteReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(got, &tt.packet, cmpopts.IgnoreUnexported(Packet{})); diff != "" {
+				t.Errorf("ReadPacket() %s", diff)
+			}
+		})
+	}
+}
+
+func TestReadPacket_Version(t *testing.T) {
+	legacy := make([]byte, 8)
+	binary.BigEndian.PutUint32(legacy, 4)
+	copy(legacy[4:], "ping")
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr error
+	}{
+		{
+			name:    "legacy frame",
+			frame:   legacy,
+			wantErr: ErrLegacyFrame,
+		},
+		{
+			name:    "future version",
+			frame:   []byte{FrameMagic, ProtocolVersion + 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			wantErr: ErrUnsupportedVersion,
+		},
+		{
+			name:    "bad magic",
+			frame:   []byte{0xff, ProtocolVersion, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			wantErr: ErrBadMagic,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadPacket(bytes.NewReader(tt.frame))
+			if !xerrors.Is(err, tt.wantErr) {
+				t.Errorf("ReadPacket() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_writeRejection(t *testing.T) {
+	t.Run("legacy", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeRejection(&buf, ErrLegacyFrame); err != nil {
+			t.Fatal(err)
+		}
+		// decode as a client of older versions does
+		b := buf.Bytes()
+		n := binary.BigEndian.Uint32(b[:legacyHeaderSize])
+		if int(n) != len(b)-legacyHeaderSize {
+			t.Fatalf("unexpected length %d", n)
+		}
+		if !bytes.Contains(b[legacyHeaderSize:], []byte("protocol mismatch")) {
+			t.Errorf("unexpected message %q", b[legacyHeaderSize:])
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeRejection(&buf, ErrUnsupportedVersion); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ReadPacket(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var remote *RemoteError
+		if !xerrors.As(p.Err(), &remote) {
+			t.Fatalf("unexpected error %v", p.Err())
+		}
+	})
+}
+
+func TestPacketReader_ReadPacket(t *testing.T) {
+	frame := func(data string) []byte {
+		var buf bytes.Buffer
+		p := Packet{Data: []byte(data)}
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name         string
+		stream       []byte
+		maxFrameSize uint32
+		wantErr      error
+	}{
+		{
+			name:         "eof between frames",
+			stream:       nil,
+			maxFrameSize: 16,
+			wantErr:      io.EOF,
+		},
+		{
+			name:         "payload at the limit",
+			stream:       frame("0123456789abcdef"),
+			maxFrameSize: 16,
+		},
+		{
+			name:         "payload over the limit",
+			stream:       frame("0123456789abcdefg"),
+			maxFrameSize: 16,
+			wantErr:      ErrFrameTooLarge,
+		},
+		{
+			name:         "truncated header",
+			stream:       frame("ping")[:6],
+			maxFrameSize: 16,
+			wantErr:      ErrTruncatedFrame,
+		},
+		{
+			name:         "truncated payload",
+			stream:       frame("ping")[:frameHeaderSize+2],
+			maxFrameSize: 16,
+			wantErr:      ErrTruncatedFrame,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewPacketReader(bytes.NewReader(tt.stream), tt.maxFrameSize)
+			_, err := r.ReadPacket()
+			if tt.wantErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if !xerrors.Is(err, tt.wantErr) {
+				t.Errorf("ReadPacket() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPacket_Release(t *testing.T) {
+	var buf bytes.Buffer
+	for _, s := range []string{"first", "second"} {
+		p := Packet{Data: []byte(s)}
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewPacketReader(&buf, 0)
+	p, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "first" {
+		t.Errorf("unexpected data %q", p.Data)
+	}
+	p.Release()
+	if p.Data != nil {
+		t.Error("data must be cleared on release")
+	}
+
+	p, err = r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "second" {
+		t.Errorf("unexpected data %q", p.Data)
+	}
+
+	// releasing a packet built by the caller must not touch its data
+	own := &Packet{Data: []byte("own")}
+	own.Release()
+	if string(own.Data) != "own" {
+		t.Error("unexpected release of caller's data")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
@@ -26,12 +27,23 @@ type SSHServer struct {
 	keyRegister  KeyRegister
 	mux          sync.RWMutex
 	handlers     map[string]ServerHandler // session name -> handler
-	userSessions map[string]SSHUser       // pubkey -> user
-	streams      []*ServerStream
+	unary        map[string]UnaryHandler  // session name -> handler
+	terminal     TerminalHandler
+	middleware   []Middleware
+	streams      map[*ServerStream]struct{}
+	unaries      map[*serverUnary]struct{}
+	terminals    map[*Terminal]struct{}
+	conns        map[net.Conn]struct{}
+	sessions     *sync.WaitGroup // sessions of the current run being served, each Listen has its own
+	draining     bool
+	addr         string
 	logger       *zap.Logger
 	listener     net.Listener
 	config       *ssh.ServerConfig
 	cancelFunc   context.CancelFunc
+	maxFrameSize uint32
+	resumeGrace  time.Duration               // how long a stream waits to be resumed, resumption is disabled if zero
+	resumable    map[string]*resumableStream // resume token -> stream
 }
 
 // NewSSHServer returns a ssh server
@@ -49,11 +61,18 @@ func NewSSHServer(logger *zap.Logger, addr string, hostKey []byte, keyRegister K
 	server := &SSHServer{
 		keyRegister:  keyRegister,
 		mux:          sync.RWMutex{},
-		userSessions: make(map[string]SSHUser),
 		logger:       logger,
 		listener:     l,
 		config:       &ssh.ServerConfig{},
 		handlers:     make(map[string]ServerHandler),
+		unary:        make(map[string]UnaryHandler),
+		maxFrameSize: DefaultMaxFrameSize,
+		resumable:    make(map[string]*resumableStream),
+		streams:      make(map[*ServerStream]struct{}),
+		unaries:      make(map[*serverUnary]struct{}),
+		terminals:    make(map[*Terminal]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		addr:         addr,
 	}
 
 	server.config.PublicKeyCallback = server.publicKeyCallback
@@ -62,10 +81,27 @@ func NewSSHServer(logger *zap.Logger, addr string, hostKey []byte, keyRegister K
 	return server, nil
 }
 
-func (s *SSHServer) RegisterHandler(name string, h ServerHandler) {
+// RegisterHandler registers a handler serving stream sessions with the name.
+// The middleware run after the ones added by Use.
+func (s *SSHServer) RegisterHandler(name string, h ServerHandler, mw ...Middleware) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	s.handlers[name] = h
+	s.handlers[name] = chainStream(mw, &StreamInfo{Name: name}, h)
+}
+
+// RegisterUnaryHandler registers a handler serving unary sessions with the name.
+// The middleware run after the ones added by Use.
+func (s *SSHServer) RegisterUnaryHandler(name string, h UnaryHandler, mw ...Middleware) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.unary[name] = chainUnary(mw, &UnaryInfo{Name: name}, h)
+}
+
+// SetMaxFrameSize sets the largest payload accepted from clients
+func (s *SSHServer) SetMaxFrameSize(n uint32) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.maxFrameSize = n
 }
 
 // https://github.com/golang/net/blob/46282727080fcf56da5781d0a9ef2fda184be5e6/http2/server.go#L674
@@ -76,15 +112,31 @@ func isClosedConnError(err error) bool {
 	return strings.Contains(err.Error(), "use of closed network connection")
 }
 
-// Listen starts serving SSH server
+// Listen starts serving SSH server. It returns nil once the server is closed or shut down,
+// Listen may be called again afterwards to serve on the same address.
 func (s *SSHServer) Listen(ctx context.Context) error {
+	s.mux.Lock()
 	if s.cancelFunc != nil {
+		s.mux.Unlock()
 		return xerrors.New("already started")
 	}
+	if s.listener == nil {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			s.mux.Unlock()
+			return err
+		}
+		s.listener = l
+	}
+	l := s.listener
+	s.draining = false
+	// sessions left over by a Shutdown that timed out are not waited for by the next one
+	s.sessions = &sync.WaitGroup{}
 	ctx, s.cancelFunc = context.WithCancel(ctx)
+	s.mux.Unlock()
 
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		switch {
 		case isClosedConnError(err):
 			s.logger.Info("failed to accept due to closed connection", zap.Error(err))
@@ -94,27 +146,72 @@ func (s *SSHServer) Listen(ctx context.Context) error {
 			return err
 		}
 
-		sshConn, chans, _, err := ssh.NewServerConn(conn, s.config)
-		if err != nil {
-			s.logger.Error("failed to new server conn", zap.Error(err))
-			continue
-		}
+		s.trackConn(conn, true)
+		go func(conn net.Conn) {
+			defer s.trackConn(conn, false)
 
-		go func(sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+			sshConn, chans, _, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				s.logger.Error("failed to new server conn", zap.Error(err))
+				conn.Close()
+				return
+			}
 			s.acceptConnection(ctx, sshConn, chans)
-		}(sshConn, chans)
+		}(conn)
 	}
 }
 
+func (s *SSHServer) trackConn(conn net.Conn, add bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if add {
+		s.conns[conn] = struct{}{}
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+func (s *SSHServer) trackStream(ss *ServerStream, add bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if add {
+		s.streams[ss] = struct{}{}
+	} else {
+		delete(s.streams, ss)
+	}
+}
+
+func (s *SSHServer) trackUnary(su *serverUnary, add bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if add {
+		s.unaries[su] = struct{}{}
+	} else {
+		delete(s.unaries, su)
+	}
+}
+
+// beginSession counts a session until its handler returns, it returns nil once the server is shutting down
+func (s *SSHServer) beginSession() *sync.WaitGroup {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.draining || s.sessions == nil {
+		return nil
+	}
+	s.sessions.Add(1)
+	return s.sessions
+}
+
 func (s *SSHServer) acceptConnection(ctx context.Context, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
 	defer sshConn.Close()
 
-	user, ok := s.userSessions[string(sshConn.SessionID())]
-	if !ok {
-		user = SSHUser{
-			UserName: "UNKNOWN",
-		}
+	info, err := newConnInfo(sshConn)
+	if err != nil {
+		s.logger.Error("failed to identify connection", zap.Error(err))
+		return
 	}
+	user := &info.User
+	ctx = contextWithConnInfo(ctx, info)
 
 	logger := s.logger.With(zap.String("user", user.UserName), zap.Binary("session_id", sshConn.SessionID()),
 		zap.String("remote_addr", sshConn.RemoteAddr().String()))
@@ -127,44 +224,70 @@ func (s *SSHServer) acceptConnection(ctx context.Context, sshConn *ssh.ServerCon
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
+		sessions := s.beginSession()
+		if sessions == nil {
+			newChannel.Reject(ssh.ResourceShortage, ErrServerShutdown.Error())
+			continue
+		}
 
 		ch, requests, err := newChannel.Accept()
 		if err != nil {
+			sessions.Done()
 			logger.Error("failed to accept new channel", zap.Error(err))
 			return
 		}
 
 		go func(ch ssh.Channel, requests <-chan *ssh.Request) {
+			defer sessions.Done()
 			defer ch.Close()
 
-			req := <-requests
-
-			if req.Type != "exec" {
-				logger.Warn("unknown request type", zap.String("type", req.Type))
-				req.Reply(false, nil)
+			exec := s.waitExec(requests, logger)
+			if exec == nil {
+				return
+			}
+			if exec.shell {
+				s.serveTerminal(ctx, ch, requests, exec, info, logger)
 				return
 			}
 
-			// exec payload: SSH_MSG_CHANNEL_REQUEST
-			// uint32    packet_length
-			// byte      padding_length
-			// byte[n1]  payload; n1 = packet_length - padding_length - 1
-			// byte[n2]  random padding; n2 = padding_length
-			cmd := string(req.Payload[4:])
 			s.mux.RLock()
-			handler, ok := s.handlers[cmd]
+			handler, ok := s.handlers[exec.cmd]
+			unaryHandler, unaryOK := s.unary[exec.cmd]
+			maxFrameSize := s.maxFrameSize
+			middleware := s.middleware
 			s.mux.RUnlock()
 
-			if !ok {
-				logger.Warn("unknown command", zap.String("cmd", cmd))
-				req.Reply(false, nil)
+			if !ok && !unaryOK {
+				logger.Warn("unknown command", zap.String("cmd", exec.cmd))
+				exec.req.Reply(false, nil)
 				return
 			}
 
-			req.Reply(true, nil)
+			if exec.resume != "" && exec.resume != resumeNew {
+				s.resumeStream(ch, exec, info, maxFrameSize, logger)
+				return
+			}
+
+			exec.req.Reply(true, nil)
+
+			if unaryOK {
+				unaryHandler = chainUnary(middleware, &UnaryInfo{Name: exec.cmd}, unaryHandler)
+				su := newServerUnary(ch, user, unaryHandler, maxFrameSize)
+				s.trackUnary(su, true)
+				defer s.trackUnary(su, false)
+				if err := su.serve(contextWithCodec(ctx, exec.codec), logger); err != nil {
+					logger.Error("failed to serve unary session", zap.Error(err))
+				}
+				return
+			}
 
-			ss := newServerStream(ch, &user, 0, 0) // TODO: allow to configure que size
-			defer ss.Close()
+			ss := newServerStream(ch, info, exec.codec, 0, 0, maxFrameSize) // TODO: allow to configure que size
+			if exec.resume == resumeNew {
+				s.makeResumable(ss, exec.cmd, user)
+			}
+			s.trackStream(ss, true)
+			defer s.trackStream(ss, false)
+			defer ss.finish()
 
 			go func() {
 				if err := ss.startStream(ctx, logger); err != nil {
@@ -173,29 +296,126 @@ func (s *SSHServer) acceptConnection(ctx context.Context, sshConn *ssh.ServerCon
 				}
 			}()
 
-			handler(ctx, ss)
+			chainStream(middleware, &StreamInfo{Name: exec.cmd}, handler)(ctx, ss)
 
 		}(ch, requests)
 	}
 }
 
+// execRequest is an exec or shell request with the settings the client asked before it
+type execRequest struct {
+	req    *ssh.Request
+	cmd    string
+	shell  bool
+	codec  Codec
+	resume string            // resumeNew, a resume token, or empty
+	env    map[string]string // other env the client sent
+	pty    *ptyRequest
+	size   WindowSize
+}
+
+// waitExec serves channel requests until an exec or shell request arrives.
+// It returns nil when the channel should be closed.
+func (s *SSHServer) waitExec(requests <-chan *ssh.Request, logger *zap.Logger) *execRequest {
+	exec := &execRequest{
+		codec: DefaultCodec,
+		env:   make(map[string]string),
+	}
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			name, value, err := parseEnvRequest(req.Payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			switch name {
+			case codecEnv:
+				c, ok := GetCodec(value)
+				if !ok {
+					logger.Warn("unknown codec", zap.String("codec", value))
+					req.Reply(false, nil)
+					continue
+				}
+				exec.codec = c
+			case resumeEnv:
+				if !s.resumeEnabled() {
+					req.Reply(false, nil)
+					continue
+				}
+				exec.resume = value
+			default:
+				exec.env[name] = value
+			}
+			req.Reply(true, nil)
+		case "pty-req":
+			pty, err := parsePtyRequest(req.Payload)
+			if err != nil {
+				logger.Warn("invalid pty request", zap.Error(err))
+				req.Reply(false, nil)
+				continue
+			}
+			exec.pty = pty
+			exec.size = WindowSize{Width: int(pty.Columns), Height: int(pty.Rows)}
+			req.Reply(true, nil)
+		case "window-change":
+			size, err := parseWindowChange(req.Payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			exec.size = size
+			req.Reply(true, nil)
+		case "shell":
+			exec.req = req
+			exec.shell = true
+			return exec
+		case "exec":
+			// exec payload: SSH_MSG_CHANNEL_REQUEST
+			// uint32    packet_length
+			// byte      padding_length
+			// byte[n1]  payload; n1 = packet_length - padding_length - 1
+			// byte[n2]  random padding; n2 = padding_length
+			exec.req = req
+			exec.cmd = string(req.Payload[4:])
+			return exec
+		default:
+			logger.Warn("unknown request type", zap.String("type", req.Type))
+			req.Reply(false, nil)
+			return nil
+		}
+	}
+	return nil
+}
+
 func (s *SSHServer) publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	user, err := s.keyRegister.Find(conn, key)
 	if err != nil {
 		s.logger.Info("unknown user", zap.Error(err))
 		return nil, xerrors.New("unauthorized")
 	}
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	s.userSessions[string(conn.SessionID())] = user
-	return nil, nil
+	return newPermissions(user, key, time.Now()), nil
 }
 
+// Close stops the server at once, connections are closed without waiting for handlers
 func (s *SSHServer) Close() {
+	s.mux.Lock()
 	if s.cancelFunc != nil {
 		s.cancelFunc()
+		s.cancelFunc = nil
 	}
 	if s.listener != nil {
 		s.listener.Close()
+		s.listener = nil
+	}
+	s.mux.Unlock()
+	s.closeConns()
+}
+
+func (s *SSHServer) closeConns() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for conn := range s.conns {
+		conn.Close()
 	}
 }
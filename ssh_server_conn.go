@@ -0,0 +1,70 @@
+package tetris
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// permission extensions carrying the identity from authentication to the connection
+const (
+	extUser           = "tetris-user"
+	extKeyFingerprint = "tetris-key-fingerprint"
+	extAuthTime       = "tetris-auth-time"
+)
+
+// ConnInfo describes the connection a session runs on
+type ConnInfo struct {
+	User           SSHUser
+	RemoteAddr     net.Addr
+	ClientVersion  string
+	KeyFingerprint string // SHA256 fingerprint of the key the user authenticated with
+	AuthTime       time.Time
+}
+
+type connInfoKey struct{}
+
+// ConnInfoFromContext returns the connection of the session a handler serves
+func ConnInfoFromContext(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return info, ok
+}
+
+func contextWithConnInfo(ctx context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+func newPermissions(user SSHUser, key ssh.PublicKey, now time.Time) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			extUser:           user.UserName,
+			extKeyFingerprint: ssh.FingerprintSHA256(key),
+			extAuthTime:       now.Format(time.RFC3339Nano),
+		},
+	}
+}
+
+func newConnInfo(conn *ssh.ServerConn) (*ConnInfo, error) {
+	if conn.Permissions == nil {
+		return nil, xerrors.New("connection is not authenticated")
+	}
+	ext := conn.Permissions.Extensions
+	name, ok := ext[extUser]
+	if !ok {
+		return nil, xerrors.New("connection is not authenticated")
+	}
+	authTime, err := time.Parse(time.RFC3339Nano, ext[extAuthTime])
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse auth time: %w", err)
+	}
+	return &ConnInfo{
+		User:           SSHUser{UserName: name},
+		RemoteAddr:     conn.RemoteAddr(),
+		ClientVersion:  string(conn.ClientVersion()),
+		KeyFingerprint: ext[extKeyFingerprint],
+		AuthTime:       authTime,
+	}, nil
+}
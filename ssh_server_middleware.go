@@ -0,0 +1,154 @@
+package tetris
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// StreamInfo describes the stream session an interceptor is called for
+type StreamInfo struct {
+	// Name is the session name the handler is registered with
+	Name string
+}
+
+// UnaryInfo describes the unary session an interceptor is called for
+type UnaryInfo struct {
+	// Name is the session name the handler is registered with
+	Name string
+}
+
+// StreamInterceptor wraps a stream handler, it calls handler to continue the chain or returns to refuse the stream
+type StreamInterceptor func(ctx context.Context, stream *ServerStream, info *StreamInfo, handler ServerHandler)
+
+// UnaryInterceptor wraps a unary handler, it calls handler to continue the chain or returns an error to refuse the request
+type UnaryInterceptor func(ctx context.Context, user *SSHUser, req *Packet, info *UnaryInfo, handler UnaryHandler) (*Packet, error)
+
+// TerminalInterceptor wraps a terminal handler, it calls handler to continue the chain or returns to end the session
+type TerminalInterceptor func(ctx context.Context, term *Terminal, handler TerminalHandler)
+
+// Middleware intercepts stream, unary and terminal sessions, any interceptor may be nil
+type Middleware struct {
+	Stream   StreamInterceptor
+	Unary    UnaryInterceptor
+	Terminal TerminalInterceptor
+}
+
+// ErrInternal is returned to clients for requests whose handler panicked
+var ErrInternal = xerrors.New("internal error")
+
+// Use adds middleware run for every handler, before the middleware given to the handler.
+// Middleware run in the order they are added.
+func (s *SSHServer) Use(mw ...Middleware) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.middleware = append(s.middleware, mw...)
+}
+
+func chainStream(mw []Middleware, info *StreamInfo, h ServerHandler) ServerHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		interceptor, next := mw[i].Stream, h
+		if interceptor == nil {
+			continue
+		}
+		h = func(ctx context.Context, stream *ServerStream) {
+			interceptor(ctx, stream, info, next)
+		}
+	}
+	return h
+}
+
+func chainUnary(mw []Middleware, info *UnaryInfo, h UnaryHandler) UnaryHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		interceptor, next := mw[i].Unary, h
+		if interceptor == nil {
+			continue
+		}
+		h = func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+			return interceptor(ctx, user, req, info, next)
+		}
+	}
+	return h
+}
+
+func chainTerminal(mw []Middleware, h TerminalHandler) TerminalHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		interceptor, next := mw[i].Terminal, h
+		if interceptor == nil {
+			continue
+		}
+		h = func(ctx context.Context, term *Terminal) {
+			interceptor(ctx, term, next)
+		}
+	}
+	return h
+}
+
+// Recovery recovers handlers from panics. A panicking stream is closed, a panicking unary request is answered with ErrInternal,
+// a panicking terminal exits with status 1.
+func Recovery(logger *zap.Logger) Middleware {
+	report := func(name string, r interface{}) {
+		logger.Error("handler panicked", zap.String("session", name), zap.String("panic", fmt.Sprint(r)),
+			zap.ByteString("stack", debug.Stack()))
+	}
+	return Middleware{
+		Stream: func(ctx context.Context, stream *ServerStream, info *StreamInfo, handler ServerHandler) {
+			defer func() {
+				if r := recover(); r != nil {
+					report(info.Name, r)
+					stream.Close()
+				}
+			}()
+			handler(ctx, stream)
+		},
+		Unary: func(ctx context.Context, user *SSHUser, req *Packet, info *UnaryInfo, handler UnaryHandler) (res *Packet, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					report(info.Name, r)
+					res, err = nil, ErrInternal
+				}
+			}()
+			return handler(ctx, user, req)
+		},
+		Terminal: func(ctx context.Context, term *Terminal, handler TerminalHandler) {
+			defer func() {
+				if r := recover(); r != nil {
+					report("shell", r)
+					term.Exit(1)
+				}
+			}()
+			handler(ctx, term)
+		},
+	}
+}
+
+// Logging logs every stream with how long it ran and why it ended, every unary request with its latency and error,
+// and every terminal with how long it ran
+func Logging(logger *zap.Logger) Middleware {
+	return Middleware{
+		Stream: func(ctx context.Context, stream *ServerStream, info *StreamInfo, handler ServerHandler) {
+			start := time.Now()
+			logger.Info("stream started", zap.String("session", info.Name), zap.String("user", stream.User().UserName))
+			handler(ctx, stream)
+			logger.Info("stream finished", zap.String("session", info.Name), zap.String("user", stream.User().UserName),
+				zap.Duration("duration", time.Since(start)), zap.NamedError("stream_error", stream.Err()))
+		},
+		Unary: func(ctx context.Context, user *SSHUser, req *Packet, info *UnaryInfo, handler UnaryHandler) (*Packet, error) {
+			start, id := time.Now(), req.ID
+			res, err := handler(ctx, user, req)
+			logger.Info("unary request", zap.String("session", info.Name), zap.String("user", user.UserName),
+				zap.Uint32("id", id), zap.Duration("duration", time.Since(start)), zap.Error(err))
+			return res, err
+		},
+		Terminal: func(ctx context.Context, term *Terminal, handler TerminalHandler) {
+			start := time.Now()
+			logger.Info("terminal started", zap.String("user", term.User().UserName))
+			handler(ctx, term)
+			logger.Info("terminal finished", zap.String("user", term.User().UserName), zap.Duration("duration", time.Since(start)))
+		},
+	}
+}
@@ -0,0 +1,168 @@
+package tetris
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// tracing records the order middleware run in
+func tracing(mux *sync.Mutex, trace *[]string, name string) Middleware {
+	record := func() {
+		mux.Lock()
+		defer mux.Unlock()
+		*trace = append(*trace, name)
+	}
+	return Middleware{
+		Stream: func(ctx context.Context, stream *ServerStream, info *StreamInfo, handler ServerHandler) {
+			record()
+			handler(ctx, stream)
+		},
+		Unary: func(ctx context.Context, user *SSHUser, req *Packet, info *UnaryInfo, handler UnaryHandler) (*Packet, error) {
+			record()
+			return handler(ctx, user, req)
+		},
+	}
+}
+
+func TestSSHServer_Use(t *testing.T) {
+	addr := "127.0.0.1:31118"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var mux sync.Mutex
+	var trace []string
+	server.Use(tracing(&mux, &trace, "global1"), Recovery(zap.NewNop()))
+	server.RegisterUnaryHandler("echo", func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		return &Packet{Data: req.Data}, nil
+	}, tracing(&mux, &trace, "local"))
+	server.RegisterUnaryHandler("panic", func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		panic("bug")
+	})
+	server.RegisterHandler("stream", func(ctx context.Context, stream *ServerStream) {
+		stream.Send(&Packet{Data: []byte(stream.User().UserName)})
+	}, tracing(&mux, &trace, "local"))
+	// added after the handlers are registered, it still runs for them
+	server.Use(tracing(&mux, &trace, "global2"))
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	echo, err := cli.NewUnarySession("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := echo.SendAndRecv(&Packet{Data: []byte("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(trace, []string{"global1", "global2", "local"}); diff != "" {
+		t.Errorf("unexpected order %s", diff)
+	}
+
+	trace = nil
+	stream, err := cli.NewStreamSession(context.Background(), "stream", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "test" {
+		t.Errorf("unexpected user %s", p.Data)
+	}
+	mux.Lock()
+	if diff := cmp.Diff(trace, []string{"global1", "global2", "local"}); diff != "" {
+		t.Errorf("unexpected order %s", diff)
+	}
+	mux.Unlock()
+
+	// the panic is recovered and the server keeps serving
+	sess, err := cli.NewUnarySession("panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sess.SendAndRecv(&Packet{Data: []byte("hi")})
+	var remote *RemoteError
+	if !xerrors.As(err, &remote) || remote.Message != ErrInternal.Error() {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := echo.SendAndRecv(&Packet{Data: []byte("hi")}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecovery_Terminal(t *testing.T) {
+	addr := "127.0.0.1:31134"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.Use(Recovery(zap.NewNop()))
+	server.RegisterTerminalHandler(func(ctx context.Context, term *Terminal) {
+		panic("bug")
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "play",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(defaultPrivateKey(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the panic is recovered and the server keeps serving
+	for i := 0; i < 2; i++ {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatal(err)
+		}
+		var exitErr *ssh.ExitError
+		if err := session.Wait(); !xerrors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			t.Errorf("Wait() error = %v, want exit status 1", err)
+		}
+		session.Close()
+	}
+}
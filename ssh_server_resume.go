@@ -0,0 +1,89 @@
+package tetris
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// resumeEnv is the env a client sets before exec to make a stream resumable or to resume it
+	resumeEnv = "TETRIS_RESUME"
+	// resumeNew asks for a resumable stream, any other value is a resume token
+	resumeNew = "new"
+)
+
+type resumableStream struct {
+	stream *ServerStream
+	cmd    string
+	user   string
+}
+
+// EnableResume lets clients resume streams after a connection loss.
+// A stream that is not resumed within grace ends, the handler sees it as a failure.
+func (s *SSHServer) EnableResume(grace time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.resumeGrace = grace
+}
+
+func (s *SSHServer) resumeEnabled() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.resumeGrace > 0
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// makeResumable issues a resume token for the stream, it is sent to the client as the first frame
+func (s *SSHServer) makeResumable(ss *ServerStream, cmd string, user *SSHUser) {
+	token := newResumeToken()
+
+	s.mux.Lock()
+	s.resumable[token] = &resumableStream{
+		stream: ss,
+		cmd:    cmd,
+		user:   user.UserName,
+	}
+	grace := s.resumeGrace
+	s.mux.Unlock()
+
+	ss.stream.setResumable(token, grace)
+	ss.stream.announceToken = true
+	ss.stream.onFinish = func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		delete(s.resumable, token)
+	}
+}
+
+// resumeStream moves the stream of the token to ch, it returns when the stream leaves ch
+func (s *SSHServer) resumeStream(ch ssh.Channel, exec *execRequest, info *ConnInfo, maxFrameSize uint32, logger *zap.Logger) {
+	s.mux.RLock()
+	rs, ok := s.resumable[exec.resume]
+	s.mux.RUnlock()
+	if !ok || rs.cmd != exec.cmd || rs.user != info.User.UserName {
+		logger.Warn("rejected unknown resume token", zap.String("cmd", exec.cmd))
+		exec.req.Reply(false, nil)
+		return
+	}
+	exec.req.Reply(true, nil)
+
+	t := newChannelTransport(ch, maxFrameSize)
+	if err := rs.stream.stream.attachTransport(t); err != nil {
+		logger.Warn("failed to resume stream", zap.Error(err))
+		return
+	}
+	rs.stream.setConnInfo(info)
+	logger.Info("resumed stream", zap.String("cmd", exec.cmd))
+	<-t.done
+}
@@ -0,0 +1,76 @@
+package tetris
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrServerShutdown is returned for sessions and requests refused because the server is shutting down
+var ErrServerShutdown = xerrors.New("server is shutting down")
+
+// Shutdown stops the server gracefully. It stops accepting connections and sessions, tells every client
+// with a stream or a terminal that the server is going down, and waits for the handlers to return. Unary sessions end
+// once their requests in flight are answered. When ctx is done first, the connections are closed at once
+// and the error of ctx is returned. Listen may be called again afterwards.
+func (s *SSHServer) Shutdown(ctx context.Context) error {
+	s.mux.Lock()
+	s.draining = true
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	cancel := s.cancelFunc
+	sessions := s.sessions
+	streams := make([]*ServerStream, 0, len(s.streams))
+	for ss := range s.streams {
+		streams = append(streams, ss)
+	}
+	unaries := make([]*serverUnary, 0, len(s.unaries))
+	for su := range s.unaries {
+		unaries = append(unaries, su)
+	}
+	terminals := make([]*Terminal, 0, len(s.terminals))
+	for t := range s.terminals {
+		terminals = append(terminals, t)
+	}
+	s.mux.Unlock()
+
+	// a client that does not read must not hold the shutdown past ctx, the notices are written
+	// concurrently and those still blocked end with the connections
+	for _, ss := range streams {
+		go ss.notifyShutdown()
+	}
+	for _, su := range unaries {
+		go su.shutdown()
+	}
+	for _, t := range terminals {
+		t.notifyShutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if sessions != nil {
+			sessions.Wait()
+		}
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if cancel != nil {
+		cancel()
+	}
+	// idle connections and the ones left by a deadline
+	s.closeConns()
+
+	s.mux.Lock()
+	s.cancelFunc = nil
+	s.mux.Unlock()
+	return err
+}
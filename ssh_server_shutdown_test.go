@@ -0,0 +1,147 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestSSHServer_Shutdown(t *testing.T) {
+	addr := "127.0.0.1:31119"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	finished := make(chan struct{})
+	server.RegisterHandler("match", func(ctx context.Context, stream *ServerStream) {
+		defer close(finished)
+		stream.Send(&Packet{Data: []byte("start")})
+		for {
+			if _, err := stream.Recv(); err != nil {
+				return
+			}
+		}
+	})
+	server.RegisterHandler("stuck", func(ctx context.Context, stream *ServerStream) {
+		stream.Send(&Packet{Data: []byte("start")})
+		select {}
+	})
+
+	listen := func() {
+		go func() {
+			if err := server.Listen(context.Background()); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	listen()
+
+	cli, err := NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	stream, err := cli.NewStreamSession(context.Background(), "match", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the match ends when the player leaves after the notice
+	go func() {
+		<-stream.ServerShutdown()
+		stream.CloseSend()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Shutdown() must wait for the handler")
+	}
+	if _, err := stream.Recv(); !xerrors.Is(err, io.EOF) {
+		t.Errorf("Recv() error = %v, want EOF", err)
+	}
+
+	// the server serves again after the restart, while the handler ignoring shutdown is cut at the deadline
+	listen()
+	var cli2 *SSHClient
+	for i := 0; ; i++ {
+		cli2, err = NewSSHClient("test", addr, defaultPrivateKey(t), zap.NewNop())
+		if err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer cli2.Close()
+
+	stuck, err := cli2.NewStreamSession(context.Background(), "stuck", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stuck.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want deadline exceeded", err)
+	}
+	select {
+	case <-stuck.ServerShutdown():
+	default:
+		t.Error("client must be told about the shutdown")
+	}
+	select {
+	case <-stuck.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("stream must be cut by the deadline")
+	}
+}
+
+func TestSSHServer_ShutdownBlockedNotice(t *testing.T) {
+	server, err := NewSSHServer(zap.NewNop(), "127.0.0.1:31133", []byte(testHostKey), &mockedKeyRegister{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// a client that never reads, writing the notice to it blocks
+	r, w := io.Pipe()
+	defer r.Close()
+	ss := &ServerStream{stream: newPacketStream(newTransport(w, r, w.Close, r.Close, 0), DefaultCodec, 0, 0)}
+	server.trackStream(ss, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown() took %v, the notice must not block it", elapsed)
+	}
+}
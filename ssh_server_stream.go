@@ -2,79 +2,135 @@ package tetris
 
 import (
 	"context"
-	"io"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/sync/errgroup"
-	"golang.org/x/xerrors"
 )
 
+// streamFlushTimeout bounds how long a finished handler waits for its packets to be written
+const streamFlushTimeout = 5 * time.Second
+
 type ServerStream struct {
-	channel  ssh.Channel
-	user     *SSHUser
-	request  chan *Packet
-	response chan *Packet
+	mux    sync.Mutex
+	info   *ConnInfo
+	stream *packetStream
 }
 
-func newServerStream(ch ssh.Channel, user *SSHUser, sendQueSize, recvQueSize int) *ServerStream {
+func newServerStream(ch ssh.Channel, info *ConnInfo, codec Codec, sendQueSize, recvQueSize int, maxFrameSize uint32) *ServerStream {
 	return &ServerStream{
-		channel:  ch,
-		user:     user,
-		request:  make(chan *Packet, sendQueSize),
-		response: make(chan *Packet, recvQueSize),
+		info:   info,
+		stream: newPacketStream(newChannelTransport(ch, maxFrameSize), codec, sendQueSize, recvQueSize),
 	}
 }
 
+func newChannelTransport(ch ssh.Channel, maxFrameSize uint32) *transport {
+	return newTransport(ch, ch, ch.CloseWrite, ch.Close, maxFrameSize)
+}
+
+// CloseSend writes the packets already queued and tells the client no more packets will be sent, packets are still received.
+// Send fails with ErrStreamClosed afterwards.
+func (ss *ServerStream) CloseSend() {
+	ss.stream.closeSend()
+}
+
+// Close ends the stream at once, queued packets are dropped. It is safe to call Close more than once.
 func (ss *ServerStream) Close() {
-	close(ss.request)
-	close(ss.response)
+	ss.stream.close()
+}
+
+// Done returns a channel that is closed when the stream ends
+func (ss *ServerStream) Done() <-chan struct{} {
+	return ss.stream.Done()
+}
+
+// Err returns why the stream ended, it returns nil while the stream is running.
+// It is io.EOF when both sides finished sending, ErrStreamClosed after Close,
+// the context error when cancelled, or the read/write failure otherwise.
+func (ss *ServerStream) Err() error {
+	return ss.stream.Err()
 }
 
 func (ss *ServerStream) startStream(ctx context.Context, logger *zap.Logger) error {
-	eg, ctx := errgroup.WithContext(ctx)
-
-	// start watching request
-	eg.Go(func() error {
-		for {
-			p := <-ss.request
-			if p == nil {
-				return nil
-			}
-			if err := p.Write(ss.channel); err != nil {
-				logger.Error("failed to write to server stream", zap.Error(err), zap.Any("request", p))
-				return xerrors.Errorf("failed to write to stream: %w", err)
-			}
-		}
-	})
-
-	// start receiving
-	eg.Go(func() error {
-		for {
-			p, err := ReadPacket(ss.channel)
-			if xerrors.Is(err, io.EOF) {
-				return nil
-			}
-			if err != nil {
-				logger.Error("failed to read from server stream", zap.Error(err))
-				return err
-			}
-			ss.response <- p
-		}
-	})
-
-	return eg.Wait()
+	return ss.stream.run(ctx, logger)
 }
 
+// finish flushes the packets sent by a handler that returned, then closes the stream.
+// Packets of a resumable stream are flushed once the client acknowledges them.
+func (ss *ServerStream) finish() {
+	ss.CloseSend()
+	select {
+	case <-ss.stream.delivered:
+	case <-time.After(streamFlushTimeout):
+	}
+	ss.Close()
+}
+
+// Send queues a packet, it returns the error that ended the stream if the stream is no longer running
 func (ss *ServerStream) Send(p *Packet) error {
-	ss.request <- p
-	return nil
+	return ss.stream.sendContext(context.Background(), p)
+}
+
+// SendContext is Send that gives up when ctx is done
+func (ss *ServerStream) SendContext(ctx context.Context, p *Packet) error {
+	return ss.stream.sendContext(ctx, p)
 }
 
+// Recv receives a packet, it returns io.EOF when the client ends the stream
 func (ss *ServerStream) Recv() (*Packet, error) {
-	p := <-ss.response
-	if p == nil {
-		return nil, io.EOF
-	}
-	return p, nil
+	return ss.stream.recvContext(context.Background())
+}
+
+// RecvContext is Recv that gives up when ctx is done
+func (ss *ServerStream) RecvContext(ctx context.Context) (*Packet, error) {
+	return ss.stream.recvContext(ctx)
+}
+
+// SendMsg marshals v with the negotiated codec and sends it
+func (ss *ServerStream) SendMsg(v interface{}) error {
+	return ss.stream.sendMsg(context.Background(), v)
+}
+
+// RecvMsg receives a message and unmarshals it into v with the negotiated codec
+func (ss *ServerStream) RecvMsg(v interface{}) error {
+	return ss.stream.recvMsg(context.Background(), v)
+}
+
+// SendMsgContext is SendMsg that gives up when ctx is done
+func (ss *ServerStream) SendMsgContext(ctx context.Context, v interface{}) error {
+	return ss.stream.sendMsg(ctx, v)
+}
+
+// RecvMsgContext is RecvMsg that gives up when ctx is done
+func (ss *ServerStream) RecvMsgContext(ctx context.Context, v interface{}) error {
+	return ss.stream.recvMsg(ctx, v)
+}
+
+// notifyShutdown tells the client that the server is going down
+func (ss *ServerStream) notifyShutdown() {
+	ss.stream.writeControl(newControlPacket(controlShutdown, nil))
+}
+
+// User returns the user who opened the stream
+func (ss *ServerStream) User() *SSHUser {
+	return &ss.ConnInfo().User
+}
+
+// ConnInfo returns the connection the stream runs on, it changes when the client resumes the stream
+func (ss *ServerStream) ConnInfo() *ConnInfo {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	return ss.info
+}
+
+func (ss *ServerStream) setConnInfo(info *ConnInfo) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.info = info
+}
+
+// Codec returns the codec negotiated for the stream
+func (ss *ServerStream) Codec() Codec {
+	return ss.stream.codec
 }
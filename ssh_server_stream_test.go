@@ -3,6 +3,7 @@ package tetris
 import (
 	"context"
 	"io"
+	"strings"
 	"sync"
 	"testing"
 
@@ -39,9 +40,19 @@ func Test_newServerStream(t *testing.T) {
 	defer server.Close()
 
 	server.RegisterHandler("handler", func(ctx context.Context, stream *ServerStream) {
-		if diff := cmp.Diff(stream.user, &testUser); diff != "" {
+		if diff := cmp.Diff(stream.User(), &testUser); diff != "" {
 			t.Errorf("unexpected user, %s", diff)
 		}
+		info := stream.ConnInfo()
+		if fp := ssh.FingerprintSHA256(defaultPublicKey(t)); info.KeyFingerprint != fp {
+			t.Errorf("unexpected fingerprint %s, want %s", info.KeyFingerprint, fp)
+		}
+		if !strings.HasPrefix(info.ClientVersion, "SSH-2.0-") || info.RemoteAddr == nil || info.AuthTime.IsZero() {
+			t.Errorf("unexpected conn info %+v", info)
+		}
+		if fromCtx, ok := ConnInfoFromContext(ctx); !ok || fromCtx != info {
+			t.Error("conn info must be in the context")
+		}
 		for {
 			p, err := stream.Recv()
 			switch {
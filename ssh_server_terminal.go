@@ -0,0 +1,285 @@
+package tetris
+
+import (
+	"bufio"
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// TerminalHandler serves interactive sessions of plain ssh clients, e.g. `ssh play@host`
+type TerminalHandler func(ctx context.Context, term *Terminal)
+
+// WindowSize is the size of a terminal in characters
+type WindowSize struct {
+	Width  int
+	Height int
+}
+
+// ptyRequest is the payload of a pty-req request, RFC 4254 6.2
+type ptyRequest struct {
+	Term          string
+	Columns       uint32
+	Rows          uint32
+	WidthPixels   uint32
+	HeightPixels  uint32
+	TerminalModes string
+}
+
+// windowChange is the payload of a window-change request, RFC 4254 6.7
+type windowChange struct {
+	Columns      uint32
+	Rows         uint32
+	WidthPixels  uint32
+	HeightPixels uint32
+}
+
+// Terminal is the interactive session of a plain ssh client.
+// The client's terminal is in raw mode: Read returns key presses as they are typed,
+// and lines written must end with "\r\n".
+type Terminal struct {
+	ch       ssh.Channel
+	reader   *bufio.Reader
+	info     *ConnInfo
+	term     string
+	env      map[string]string
+	mux      sync.Mutex
+	size     WindowSize
+	resize   chan WindowSize
+	exitCode int
+	shutdown chan struct{}
+	once     sync.Once
+	keys     chan KeyPress
+	keysOnce sync.Once
+	done     chan struct{} // closed when the handler returned
+}
+
+// KeyPress is a key read from a terminal, Err is set when the terminal can not be read anymore
+type KeyPress struct {
+	Key Key
+	Err error
+}
+
+func newTerminal(ch ssh.Channel, info *ConnInfo, exec *execRequest) *Terminal {
+	t := &Terminal{
+		ch:       ch,
+		reader:   bufio.NewReader(ch),
+		info:     info,
+		env:      exec.env,
+		resize:   make(chan WindowSize, 1),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if exec.pty != nil {
+		t.term = exec.pty.Term
+		t.size = exec.size
+	}
+	return t
+}
+
+// RegisterTerminalHandler registers the handler serving shell sessions.
+// Shell requests are refused until a handler is registered. The middleware run after the ones added by Use.
+func (s *SSHServer) RegisterTerminalHandler(h TerminalHandler, mw ...Middleware) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.terminal = chainTerminal(mw, h)
+}
+
+func (s *SSHServer) trackTerminal(t *Terminal, add bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if add {
+		s.terminals[t] = struct{}{}
+	} else {
+		delete(s.terminals, t)
+	}
+}
+
+// serveTerminal runs the terminal handler for a shell request until it returns
+func (s *SSHServer) serveTerminal(ctx context.Context, ch ssh.Channel, requests <-chan *ssh.Request, exec *execRequest, info *ConnInfo, logger *zap.Logger) {
+	s.mux.RLock()
+	handler := s.terminal
+	middleware := s.middleware
+	s.mux.RUnlock()
+
+	if handler == nil {
+		logger.Warn("no terminal handler")
+		exec.req.Reply(false, nil)
+		return
+	}
+	exec.req.Reply(true, nil)
+
+	t := newTerminal(ch, info, exec)
+	s.trackTerminal(t, true)
+	defer s.trackTerminal(t, false)
+
+	// the requests end when the client closes the channel
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer cancel()
+		t.serveRequests(requests, logger)
+	}()
+
+	chainTerminal(middleware, handler)(ctx, t)
+	close(t.done)
+
+	if err := t.exit(); err != nil {
+		logger.Warn("failed to send exit status", zap.Error(err))
+	}
+}
+
+func (t *Terminal) serveRequests(requests <-chan *ssh.Request, logger *zap.Logger) {
+	for req := range requests {
+		switch req.Type {
+		case "window-change":
+			size, err := parseWindowChange(req.Payload)
+			if err != nil {
+				logger.Warn("invalid window change", zap.Error(err))
+				req.Reply(false, nil)
+				continue
+			}
+			t.setSize(size)
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func parseWindowChange(payload []byte) (WindowSize, error) {
+	var msg windowChange
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return WindowSize{}, xerrors.Errorf("failed to parse window-change request: %w", err)
+	}
+	return WindowSize{Width: int(msg.Columns), Height: int(msg.Rows)}, nil
+}
+
+func parsePtyRequest(payload []byte) (*ptyRequest, error) {
+	var msg ptyRequest
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return nil, xerrors.Errorf("failed to parse pty-req request: %w", err)
+	}
+	return &msg, nil
+}
+
+func (t *Terminal) setSize(size WindowSize) {
+	t.mux.Lock()
+	t.size = size
+	t.mux.Unlock()
+
+	// only the latest size matters to a handler that is behind
+	for {
+		select {
+		case t.resize <- size:
+			return
+		default:
+		}
+		select {
+		case <-t.resize:
+		default:
+		}
+	}
+}
+
+// exit sends the exit status to the client
+func (t *Terminal) exit() error {
+	t.mux.Lock()
+	code := t.exitCode
+	t.mux.Unlock()
+	_, err := t.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+	return err
+}
+
+// Read reads the raw input of the client
+func (t *Terminal) Read(p []byte) (int, error) {
+	return t.reader.Read(p)
+}
+
+// ReadKey reads the next key press
+func (t *Terminal) ReadKey() (Key, error) {
+	return readKey(t.reader)
+}
+
+// Keys receives the keys pressed. The keys are read ahead from a goroutine of the terminal, so a handler may stop
+// waiting for them at any time and a key pressed meanwhile is received by the next one waiting. Do not mix it with Read or ReadKey.
+func (t *Terminal) Keys() <-chan KeyPress {
+	t.keysOnce.Do(func() {
+		t.keys = make(chan KeyPress)
+		go t.readKeys()
+	})
+	return t.keys
+}
+
+func (t *Terminal) readKeys() {
+	defer close(t.keys)
+	for {
+		k, err := readKey(t.reader)
+		select {
+		case t.keys <- KeyPress{Key: k, Err: err}:
+		case <-t.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write writes to the client's terminal, e.g. ANSI escape codes
+func (t *Terminal) Write(p []byte) (int, error) {
+	return t.ch.Write(p)
+}
+
+// Size returns the current size of the terminal, it is zero when the client asked no pty
+func (t *Terminal) Size() WindowSize {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.size
+}
+
+// Resized receives the new size whenever the client's window changes
+func (t *Terminal) Resized() <-chan WindowSize {
+	return t.resize
+}
+
+// Term returns the TERM of the client, e.g. xterm-256color
+func (t *Terminal) Term() string {
+	return t.term
+}
+
+// Getenv returns an environment variable the client sent, e.g. LANG
+func (t *Terminal) Getenv(name string) string {
+	return t.env[name]
+}
+
+// Exit sets the exit status the client sees once the handler returns
+func (t *Terminal) Exit(code int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.exitCode = code
+}
+
+// User returns the user who opened the terminal
+func (t *Terminal) User() *SSHUser {
+	return &t.info.User
+}
+
+// ConnInfo returns the connection the terminal runs on
+func (t *Terminal) ConnInfo() *ConnInfo {
+	return t.info
+}
+
+// ServerShutdown is closed when the server starts shutting down, the handler should say goodbye and return
+func (t *Terminal) ServerShutdown() <-chan struct{} {
+	return t.shutdown
+}
+
+func (t *Terminal) notifyShutdown() {
+	t.once.Do(func() {
+		close(t.shutdown)
+	})
+}
@@ -0,0 +1,192 @@
+package tetris
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestSSHServer_Terminal(t *testing.T) {
+	addr := "127.0.0.1:31120"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.RegisterTerminalHandler(func(ctx context.Context, term *Terminal) {
+		fmt.Fprintf(term, "hello %s %s %s %dx%d\r\n", term.User().UserName, term.Term(), term.Getenv("LANG"),
+			term.Size().Width, term.Size().Height)
+		for {
+			key, err := term.ReadKey()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch key.Code {
+			case KeyLeft:
+				fmt.Fprint(term, "left\r\n")
+			case KeyRune:
+				fmt.Fprintf(term, "rune %c\r\n", key.Rune)
+			case KeyCtrlC:
+				select {
+				case size := <-term.Resized():
+					fmt.Fprintf(term, "resized %dx%d\r\n", size.Width, size.Height)
+				case <-time.After(5 * time.Second):
+					t.Error("window change is not received")
+				}
+				term.Exit(3)
+				return
+			}
+		}
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "play",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(defaultPrivateKey(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.Setenv("LANG", "en_US.UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	out := bufio.NewReader(stdout)
+	expect := func(want string) {
+		t.Helper()
+		line, err := out.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(line, "\r\n"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	expect("hello play xterm en_US.UTF-8 80x24")
+	stdin.Write([]byte("\x1b[D"))
+	expect("left")
+	stdin.Write([]byte("z"))
+	expect("rune z")
+	if err := session.WindowChange(30, 100); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Write([]byte{0x03})
+	expect("resized 100x30")
+
+	var exitErr *ssh.ExitError
+	if err := session.Wait(); !xerrors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("Wait() error = %v, want exit status 3", err)
+	}
+}
+
+func TestSSHServer_TerminalWithoutHandler(t *testing.T) {
+	addr := "127.0.0.1:31121"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "play",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(defaultPrivateKey(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := session.Shell(); err == nil {
+		t.Error("shell must be refused without a terminal handler")
+	}
+}
+
+func TestTerminal_Keys(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	term := &Terminal{reader: bufio.NewReader(r), done: make(chan struct{})}
+	defer close(term.done)
+
+	// a screen stops waiting for keys when its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	select {
+	case k := <-term.Keys():
+		t.Fatalf("Keys() = %+v before a key is pressed", k)
+	case <-ctx.Done():
+	}
+
+	// the next one waiting receives the key pressed afterwards
+	go w.Write([]byte("q"))
+	select {
+	case k := <-term.Keys():
+		if k.Err != nil || k.Key.Code != KeyRune || k.Key.Rune != 'q' {
+			t.Errorf("Keys() = %+v, want q", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the key is swallowed")
+	}
+}
@@ -0,0 +1,145 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// UnaryHandler answers a request of a unary session. Requests of a session are served concurrently.
+type UnaryHandler func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error)
+
+type serverUnary struct {
+	channel  ssh.Channel
+	reader   *PacketReader
+	user     *SSHUser
+	handler  UnaryHandler
+	writeMux sync.Mutex
+	mux      sync.Mutex
+	inflight int
+	draining bool
+}
+
+func newServerUnary(ch ssh.Channel, user *SSHUser, handler UnaryHandler, maxFrameSize uint32) *serverUnary {
+	return &serverUnary{
+		channel: ch,
+		reader:  NewPacketReader(ch, maxFrameSize),
+		user:    user,
+		handler: handler,
+	}
+}
+
+// serve calls the handler for every request until the client closes the session,
+// then waits for the requests in flight.
+func (su *serverUnary) serve(ctx context.Context, logger *zap.Logger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		p, err := su.reader.ReadPacket()
+		if xerrors.Is(err, io.EOF) {
+			return nil
+		}
+		if isProtocolError(err) {
+			logger.Warn("rejected client speaking unsupported protocol", zap.Error(err))
+			su.writeMux.Lock()
+			if err := writeRejection(su.channel, err); err != nil {
+				logger.Error("failed to write rejection", zap.Error(err))
+			}
+			su.writeMux.Unlock()
+			return err
+		}
+		if err != nil {
+			logger.Error("failed to read from unary session", zap.Error(err))
+			return err
+		}
+
+		switch p.Type {
+		case FrameData:
+			if !su.begin() {
+				if err := su.write(newErrorPacket(p.ID, ErrServerShutdown)); err != nil {
+					return err
+				}
+				p.Release()
+				continue
+			}
+			wg.Add(1)
+			go func(req *Packet) {
+				defer wg.Done()
+				defer su.end()
+				su.handle(ctx, req, logger)
+			}(p)
+		case FramePing:
+			if p.Flags&FlagAck == 0 {
+				if err := su.write(&Packet{Type: FramePing, Flags: FlagAck, ID: p.ID, Data: p.Data}); err != nil {
+					return err
+				}
+			}
+		case FrameClose:
+			return nil
+		case FrameError:
+			return p.Err()
+		default:
+			logger.Debug("ignored frame", zap.Stringer("type", p.Type))
+		}
+	}
+}
+
+// begin counts a request in flight, it returns false once the session is draining
+func (su *serverUnary) begin() bool {
+	su.mux.Lock()
+	defer su.mux.Unlock()
+	if su.draining {
+		return false
+	}
+	su.inflight++
+	return true
+}
+
+func (su *serverUnary) end() {
+	su.mux.Lock()
+	defer su.mux.Unlock()
+	su.inflight--
+	if su.draining && su.inflight == 0 {
+		su.channel.Close()
+	}
+}
+
+// shutdown refuses new requests and closes the session once the requests in flight are answered
+func (su *serverUnary) shutdown() {
+	su.write(newControlPacket(controlShutdown, nil))
+	su.mux.Lock()
+	defer su.mux.Unlock()
+	su.draining = true
+	if su.inflight == 0 {
+		su.channel.Close()
+	}
+}
+
+func (su *serverUnary) handle(ctx context.Context, req *Packet, logger *zap.Logger) {
+	id := req.ID
+	res, err := su.handler(ctx, su.user, req)
+	if err != nil {
+		res = newErrorPacket(id, err)
+	}
+	if res == nil {
+		res = &Packet{}
+	}
+	res.ID = id
+	if err := su.write(res); err != nil {
+		logger.Error("failed to write unary response", zap.Error(err), zap.Uint32("id", id))
+	}
+}
+
+func (su *serverUnary) write(p *Packet) error {
+	su.writeMux.Lock()
+	defer su.writeMux.Unlock()
+	return p.Write(su.channel)
+}
@@ -0,0 +1,90 @@
+package tetris
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func TestSSHServer_RegisterUnaryHandler(t *testing.T) {
+	addr := "127.0.0.1:31115"
+	testUser := SSHUser{
+		UserName: "test",
+	}
+
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return testUser, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server.RegisterUnaryHandler("score", func(ctx context.Context, user *SSHUser, req *Packet) (*Packet, error) {
+		if diff := cmp.Diff(user, &testUser); diff != "" {
+			t.Errorf("unexpected user, %s", diff)
+		}
+		n, err := strconv.Atoi(string(req.Data))
+		if err != nil {
+			return nil, xerrors.Errorf("not a number: %s", req.Data)
+		}
+		// answer the earlier requests later so responses arrive out of order
+		time.Sleep(time.Duration(20-n) * time.Millisecond)
+		return &Packet{Data: []byte(strconv.Itoa(n * 100))}, nil
+	})
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	cli, err := NewSSHClient(testUser.UserName, addr, defaultPrivateKey(t), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	sess, err := cli.NewUnarySession("score")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			res, err := sess.SendAndRecv(&Packet{Data: []byte(strconv.Itoa(n))})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := strconv.Itoa(n * 100); string(res.Data) != want {
+				t.Errorf("request %d got response %s", n, res.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = sess.SendAndRecv(&Packet{Data: []byte("foo")})
+	var remote *RemoteError
+	if !xerrors.As(err, &remote) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := fmt.Sprintf("not a number: %s", "foo"); remote.Message != want {
+		t.Errorf("unexpected message %q", remote.Message)
+	}
+}
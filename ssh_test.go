@@ -118,12 +118,15 @@ func testSSHServer(t *testing.T, config *ssh.ServerConfig, handlers map[string]s
 	go func() {
 		conn, err := l.Accept()
 		if err != nil {
-			panic(err)
+			// closed by cleanup without any client
+			return
 		}
 
 		sshConn, chans, _, err := ssh.NewServerConn(conn, config)
 		if err != nil {
-			panic(err)
+			// the client failed to authenticate
+			conn.Close()
+			return
 		}
 		defer sshConn.Close()
 
@@ -0,0 +1,211 @@
+package tetris
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var ErrReplayNotFound = xerrors.New("replay not found")
+
+// Store persists what the server must not lose on restart. It is safe for concurrent use.
+type Store interface {
+	// Profile returns the profile of the user, ErrProfileNotFound if the user has none
+	Profile(user string) (Profile, error)
+	// Profiles returns every profile in the order of user names
+	Profiles() ([]Profile, error)
+	// SaveMatch saves the log of a match together with the profiles of its players rated by it
+	SaveMatch(log *MatchLog, profiles []Profile) error
+	// Matches returns up to limit logs of the latest matches the user played, the latest first
+	Matches(user string, limit int) ([]MatchLog, error)
+	// SaveReplay saves a replay under the id, it replaces the replay saved under the same id
+	SaveReplay(id string, replay []byte) error
+	// Replay returns the replay saved under the id, ErrReplayNotFound if there is none
+	Replay(id string) ([]byte, error)
+	// SaveRecord saves the record of a single player game, and keeps it as the personal best of the player
+	// if it is better than the one before. It reports whether it is the personal best.
+	SaveRecord(record Record) (bool, error)
+	// Records returns the records of the mode that ended at or after since, in the order they ended
+	Records(mode LeaderboardMode, since time.Time) ([]Record, error)
+	// PersonalBest returns the best record of the user in the mode, ErrNoRecord if it has none
+	PersonalBest(user string, mode LeaderboardMode) (Record, error)
+	// PersonalBests returns the best record of every player of the mode, in no order
+	PersonalBests(mode LeaderboardMode) ([]Record, error)
+	// SaveKeys caches the public keys of the user, they replace the keys cached for the user before
+	SaveKeys(user string, keys CachedKeys) error
+	// Keys returns the keys cached, user name -> its keys
+	Keys() (map[string]CachedKeys, error)
+	Close() error
+}
+
+// CachedKeys are the public keys of a user in the ssh wire format, as retrieved at Fetched
+type CachedKeys struct {
+	Keys    [][]byte  `json:"keys"`
+	Fetched time.Time `json:"fetched"`
+}
+
+func (k CachedKeys) clone() CachedKeys {
+	c := CachedKeys{Keys: make([][]byte, len(k.Keys)), Fetched: k.Fetched}
+	for i, key := range k.Keys {
+		c.Keys[i] = append([]byte(nil), key...)
+	}
+	return c
+}
+
+// MemoryStore is a Store keeping everything in memory, for tests and servers that do not need to persist
+type MemoryStore struct {
+	mux      sync.RWMutex
+	profiles map[string]Profile
+	matches  []MatchLog
+	replays  map[string][]byte
+	records  map[LeaderboardMode][]Record
+	bests    map[LeaderboardMode]map[string]Record // mode -> user -> personal best
+	keys     map[string]CachedKeys
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		profiles: make(map[string]Profile),
+		replays:  make(map[string][]byte),
+		records:  make(map[LeaderboardMode][]Record),
+		bests:    make(map[LeaderboardMode]map[string]Record),
+		keys:     make(map[string]CachedKeys),
+	}
+}
+
+func (s *MemoryStore) Profile(user string) (Profile, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	p, ok := s.profiles[user]
+	if !ok {
+		return Profile{}, ErrProfileNotFound
+	}
+	return p.clone(), nil
+}
+
+func (s *MemoryStore) Profiles() ([]Profile, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	profiles := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		profiles = append(profiles, p.clone())
+	}
+	sortProfiles(profiles)
+	return profiles, nil
+}
+
+func (s *MemoryStore) SaveMatch(log *MatchLog, profiles []Profile) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.matches = append(s.matches, log.clone())
+	for _, p := range profiles {
+		s.profiles[p.User] = p.clone()
+	}
+	return nil
+}
+
+func (s *MemoryStore) Matches(user string, limit int) ([]MatchLog, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var logs []MatchLog
+	for i := len(s.matches) - 1; i >= 0 && len(logs) < limit; i-- {
+		if s.matches[i].played(user) {
+			logs = append(logs, s.matches[i].clone())
+		}
+	}
+	return logs, nil
+}
+
+func (s *MemoryStore) SaveReplay(id string, replay []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.replays[id] = append([]byte(nil), replay...)
+	return nil
+}
+
+func (s *MemoryStore) Replay(id string) ([]byte, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	replay, ok := s.replays[id]
+	if !ok {
+		return nil, ErrReplayNotFound
+	}
+	return append([]byte(nil), replay...), nil
+}
+
+func (s *MemoryStore) SaveRecord(record Record) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	records := append(s.records[record.Mode], record)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	s.records[record.Mode] = records
+
+	bests, ok := s.bests[record.Mode]
+	if !ok {
+		bests = make(map[string]Record)
+		s.bests[record.Mode] = bests
+	}
+	if best, ok := bests[record.User]; ok && !record.better(&best) {
+		return false, nil
+	}
+	bests[record.User] = record
+	return true, nil
+}
+
+func (s *MemoryStore) PersonalBest(user string, mode LeaderboardMode) (Record, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	best, ok := s.bests[mode][user]
+	if !ok {
+		return Record{}, ErrNoRecord
+	}
+	return best, nil
+}
+
+func (s *MemoryStore) PersonalBests(mode LeaderboardMode) ([]Record, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	bests := make([]Record, 0, len(s.bests[mode]))
+	for _, r := range s.bests[mode] {
+		bests = append(bests, r)
+	}
+	return bests, nil
+}
+
+func (s *MemoryStore) Records(mode LeaderboardMode, since time.Time) ([]Record, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var records []Record
+	for _, r := range s.records[mode] {
+		if !r.Time.Before(since) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+func (s *MemoryStore) SaveKeys(user string, keys CachedKeys) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.keys[user] = keys.clone()
+	return nil
+}
+
+func (s *MemoryStore) Keys() (map[string]CachedKeys, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	keys := make(map[string]CachedKeys, len(s.keys))
+	for user, k := range s.keys {
+		keys[user] = k.clone()
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,402 @@
+package tetris
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/xerrors"
+)
+
+var (
+	boltMetaBucket        = []byte("meta")
+	boltProfilesBucket    = []byte("profiles")     // user -> Profile
+	boltMatchesBucket     = []byte("matches")      // sequence -> MatchLog
+	boltUserMatchesBucket = []byte("user_matches") // user -> bucket of the sequences of its matches
+	boltReplaysBucket     = []byte("replays")      // id -> replay
+	boltKeysBucket        = []byte("keys")         // key in the ssh wire format -> user, until version 4
+	boltUserKeysBucket    = []byte("user_keys")    // user -> CachedKeys
+	boltRecordsBucket     = []byte("records")      // mode -> bucket of time and sequence -> Record
+	boltBestsBucket       = []byte("bests")        // mode -> bucket of user -> its best Record
+
+	boltVersionKey = []byte("version")
+)
+
+// boltMigrations bring a database from the version of their index to the next one, in order
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 0 -> 1: profiles, matches, replays and keys
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltProfilesBucket, boltMatchesBucket, boltReplaysBucket, boltKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 1 -> 2: index matches by player
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltUserMatchesBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(boltMatchesBucket).ForEach(func(k, v []byte) error {
+			var log MatchLog
+			if err := json.Unmarshal(v, &log); err != nil {
+				return xerrors.Errorf("failed to unmarshal match %x: %w", k, err)
+			}
+			return indexBoltMatch(tx, k, &log)
+		})
+	},
+	// 2 -> 3: records of single player games
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRecordsBucket)
+		return err
+	},
+	// 3 -> 4: keys by user with the time they were retrieved, the keys cached before are retrieved again at the next login
+	func(tx *bolt.Tx) error {
+		users := make(map[string]CachedKeys)
+		err := tx.Bucket(boltKeysBucket).ForEach(func(k, v []byte) error {
+			keys := users[string(v)]
+			keys.Keys = append(keys.Keys, append([]byte(nil), k...))
+			users[string(v)] = keys
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(boltUserKeysBucket)
+		if err != nil {
+			return err
+		}
+		for user, keys := range users {
+			v, err := json.Marshal(&keys)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(user), v); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket(boltKeysBucket)
+	},
+	// 4 -> 5: personal bests of the players by mode
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBestsBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(boltRecordsBucket).ForEach(func(mode, _ []byte) error {
+			return tx.Bucket(boltRecordsBucket).Bucket(mode).ForEach(func(k, v []byte) error {
+				var r Record
+				if err := json.Unmarshal(v, &r); err != nil {
+					return xerrors.Errorf("failed to unmarshal record %x: %w", k, err)
+				}
+				_, err := putBoltBest(tx, &r)
+				return err
+			})
+		})
+	},
+}
+
+// BoltStore is a Store in a bbolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the database at the path, creating it if needed, and migrates it to the latest version
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open bolt store %s: %w", path, err)
+	}
+	s := &BoltStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStore) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		var version uint64
+		if v := meta.Get(boltVersionKey); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(boltMigrations)) {
+			return xerrors.Errorf("bolt store version %d is newer than %d", version, len(boltMigrations))
+		}
+		for ; version < uint64(len(boltMigrations)); version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return xerrors.Errorf("failed to migrate bolt store to version %d: %w", version+1, err)
+			}
+		}
+		return meta.Put(boltVersionKey, boltUint64(version))
+	})
+}
+
+func boltUint64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func indexBoltMatch(tx *bolt.Tx, seq []byte, log *MatchLog) error {
+	index := tx.Bucket(boltUserMatchesBucket)
+	for _, user := range log.Players {
+		b, err := index.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		if err := b.Put(seq, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Profile(user string) (Profile, error) {
+	var p Profile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltProfilesBucket).Get([]byte(user))
+		if v == nil {
+			return ErrProfileNotFound
+		}
+		return json.Unmarshal(v, &p)
+	})
+	return p, err
+}
+
+func (s *BoltStore) Profiles() ([]Profile, error) {
+	var profiles []Profile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltProfilesBucket).ForEach(func(k, v []byte) error {
+			var p Profile
+			if err := json.Unmarshal(v, &p); err != nil {
+				return xerrors.Errorf("failed to unmarshal profile %s: %w", k, err)
+			}
+			profiles = append(profiles, p)
+			return nil
+		})
+	})
+	return profiles, err
+}
+
+func (s *BoltStore) SaveMatch(log *MatchLog, profiles []Profile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		matches := tx.Bucket(boltMatchesBucket)
+		n, err := matches.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		seq := boltUint64(n)
+		if err := matches.Put(seq, v); err != nil {
+			return err
+		}
+		if err := indexBoltMatch(tx, seq, log); err != nil {
+			return err
+		}
+
+		b := tx.Bucket(boltProfilesBucket)
+		for _, p := range profiles {
+			v, err := json.Marshal(&p)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(p.User), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Matches(user string, limit int) ([]MatchLog, error) {
+	var logs []MatchLog
+	err := s.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltUserMatchesBucket).Bucket([]byte(user))
+		if index == nil {
+			return nil
+		}
+		matches := tx.Bucket(boltMatchesBucket)
+		c := index.Cursor()
+		for k, _ := c.Last(); k != nil && len(logs) < limit; k, _ = c.Prev() {
+			var log MatchLog
+			if err := json.Unmarshal(matches.Get(k), &log); err != nil {
+				return xerrors.Errorf("failed to unmarshal match %x: %w", k, err)
+			}
+			logs = append(logs, log)
+		}
+		return nil
+	})
+	return logs, err
+}
+
+func (s *BoltStore) SaveReplay(id string, replay []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReplaysBucket).Put([]byte(id), replay)
+	})
+}
+
+func (s *BoltStore) Replay(id string) ([]byte, error) {
+	var replay []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltReplaysBucket).Get([]byte(id))
+		if v == nil {
+			return ErrReplayNotFound
+		}
+		// the value is only valid during the transaction
+		replay = append([]byte(nil), v...)
+		return nil
+	})
+	return replay, err
+}
+
+// boltRecordKey sorts the records of a mode by the time they ended
+func boltRecordKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func (s *BoltStore) SaveRecord(record Record) (bool, error) {
+	var best bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(record.Mode))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(boltRecordKey(record.Time, seq), v); err != nil {
+			return err
+		}
+		best, err = putBoltBest(tx, &record)
+		return err
+	})
+	return best, err
+}
+
+// putBoltBest keeps the record as the personal best of its player if it is better, it reports whether it is
+func putBoltBest(tx *bolt.Tx, record *Record) (bool, error) {
+	b, err := tx.Bucket(boltBestsBucket).CreateBucketIfNotExists([]byte(record.Mode))
+	if err != nil {
+		return false, err
+	}
+	if v := b.Get([]byte(record.User)); v != nil {
+		var best Record
+		if err := json.Unmarshal(v, &best); err != nil {
+			return false, xerrors.Errorf("failed to unmarshal the best of %s: %w", record.User, err)
+		}
+		if !record.better(&best) {
+			return false, nil
+		}
+	}
+	v, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	return true, b.Put([]byte(record.User), v)
+}
+
+func (s *BoltStore) PersonalBest(user string, mode LeaderboardMode) (Record, error) {
+	var best Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBestsBucket).Bucket([]byte(mode))
+		if b == nil {
+			return ErrNoRecord
+		}
+		v := b.Get([]byte(user))
+		if v == nil {
+			return ErrNoRecord
+		}
+		return json.Unmarshal(v, &best)
+	})
+	return best, err
+}
+
+func (s *BoltStore) PersonalBests(mode LeaderboardMode) ([]Record, error) {
+	var bests []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBestsBucket).Bucket([]byte(mode))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return xerrors.Errorf("failed to unmarshal the best of %s: %w", k, err)
+			}
+			bests = append(bests, r)
+			return nil
+		})
+	})
+	return bests, err
+}
+
+func (s *BoltStore) Records(mode LeaderboardMode, since time.Time) ([]Record, error) {
+	var records []Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(mode))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		if !since.IsZero() {
+			k, v = c.Seek(boltRecordKey(since, 0))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return xerrors.Errorf("failed to unmarshal record %x: %w", k, err)
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *BoltStore) SaveKeys(user string, keys CachedKeys) error {
+	v, err := json.Marshal(&keys)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserKeysBucket).Put([]byte(user), v)
+	})
+}
+
+func (s *BoltStore) Keys() (map[string]CachedKeys, error) {
+	users := make(map[string]CachedKeys)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserKeysBucket).ForEach(func(k, v []byte) error {
+			var keys CachedKeys
+			if err := json.Unmarshal(v, &keys); err != nil {
+				return xerrors.Errorf("failed to unmarshal keys of %s: %w", k, err)
+			}
+			users[string(k)] = keys
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,273 @@
+package tetris
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+func tempBoltPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tetris-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "tetris.db")
+}
+
+func openBoltStore(t *testing.T, path string) *BoltStore {
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testStore runs the behavior every store shares
+func testStore(t *testing.T, s Store) {
+	now := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := s.Profile("alice"); !xerrors.Is(err, ErrProfileNotFound) {
+		t.Errorf("Profile() error = %v, want %v", err, ErrProfileNotFound)
+	}
+
+	alice := Profile{
+		User:    "alice",
+		Created: now,
+		Modes:   map[string]ModeStats{"1v1": {Rating: Rating{1662, 290, 0.06}, Played: 1, Wins: 1}},
+		History: []MatchResult{{Mode: "1v1", End: now, Players: []string{"alice", "bob"}, Place: 1, Won: true, Before: DefaultRating, After: Rating{1662, 290, 0.06}}},
+	}
+	bob := Profile{User: "bob", Created: now, Modes: map[string]ModeStats{"1v1": {Rating: Rating{1337, 290, 0.06}, Played: 1, Losses: 1}}, History: []MatchResult{}}
+	first := &MatchLog{Mode: "1v1", Ranked: true, Players: []string{"alice", "bob"}, Seed: 1, Start: now, End: now, Winner: "alice", Places: map[string]int{"alice": 1, "bob": 2}}
+	if err := s.SaveMatch(first, []Profile{bob, alice}); err != nil {
+		t.Fatal(err)
+	}
+	second := &MatchLog{Mode: "versus", Players: []string{"carol", "alice"}, Seed: 2, Start: now, End: now, Winner: "carol", Places: map[string]int{"carol": 1, "alice": 2}}
+	if err := s.SaveMatch(second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.Profile("alice"); err != nil || !reflect.DeepEqual(got, alice) {
+		t.Errorf("Profile() = %+v, %v, want %+v", got, err, alice)
+	}
+	profiles, err := s.Profiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[0].User != "alice" || profiles[1].User != "bob" {
+		t.Errorf("Profiles() = %+v", profiles)
+	}
+
+	matches, err := s.Matches("alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || !reflect.DeepEqual(matches[0], *second) || !reflect.DeepEqual(matches[1], *first) {
+		t.Errorf("Matches() = %+v", matches)
+	}
+	if matches, _ := s.Matches("alice", 1); len(matches) != 1 || matches[0].Seed != 2 {
+		t.Errorf("Matches() = %+v, want the latest", matches)
+	}
+	if matches, _ := s.Matches("bob", 10); len(matches) != 1 || matches[0].Seed != 1 {
+		t.Errorf("Matches() = %+v, want the match of bob", matches)
+	}
+
+	if _, err := s.Replay("1"); !xerrors.Is(err, ErrReplayNotFound) {
+		t.Errorf("Replay() error = %v, want %v", err, ErrReplayNotFound)
+	}
+	if err := s.SaveReplay("1", []byte("replay")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Replay("1"); err != nil || string(got) != "replay" {
+		t.Errorf("Replay() = %q, %v", got, err)
+	}
+
+	late := Record{User: "bob", Mode: LeaderboardSprint, Lines: 40, Frames: 3000, Time: now.Add(time.Hour)}
+	early := Record{User: "alice", Mode: LeaderboardSprint, Lines: 40, Frames: 2500, Time: now}
+	for _, r := range []Record{late, early, {User: "alice", Mode: LeaderboardUltra, Score: 100, Time: now}} {
+		if best, err := s.SaveRecord(r); err != nil || !best {
+			t.Fatalf("SaveRecord() = %v, %v, want the first record the best", best, err)
+		}
+	}
+	slower := Record{User: "alice", Mode: LeaderboardSprint, Lines: 40, Frames: 2600, Time: now.Add(2 * time.Hour)}
+	if best, err := s.SaveRecord(slower); err != nil || best {
+		t.Errorf("SaveRecord() = %v, %v, want not the best", best, err)
+	}
+	if best, err := s.PersonalBest("alice", LeaderboardSprint); err != nil || !reflect.DeepEqual(best, early) {
+		t.Errorf("PersonalBest() = %+v, %v, want %+v", best, err, early)
+	}
+	if _, err := s.PersonalBest("bob", LeaderboardUltra); !xerrors.Is(err, ErrNoRecord) {
+		t.Errorf("PersonalBest() error = %v, want %v", err, ErrNoRecord)
+	}
+	if bests, err := s.PersonalBests(LeaderboardSprint); err != nil || len(bests) != 2 {
+		t.Errorf("PersonalBests() = %+v, %v", bests, err)
+	}
+	if records, err := s.Records(LeaderboardSprint, time.Time{}); err != nil || !reflect.DeepEqual(records, []Record{early, late, slower}) {
+		t.Errorf("Records() = %+v, %v, want in the order they ended", records, err)
+	}
+	if records, _ := s.Records(LeaderboardSprint, now.Add(time.Minute)); !reflect.DeepEqual(records, []Record{late, slower}) {
+		t.Errorf("Records() = %+v, want the records since", records)
+	}
+	if records, _ := s.Records(LeaderboardMarathon, time.Time{}); len(records) != 0 {
+		t.Errorf("Records() = %+v, want none", records)
+	}
+
+	if err := s.SaveKeys("alice", CachedKeys{Keys: [][]byte{[]byte("key1"), []byte("key2")}, Fetched: now}); err != nil {
+		t.Fatal(err)
+	}
+	// the keys retrieved again replace the ones of before
+	if err := s.SaveKeys("alice", CachedKeys{Keys: [][]byte{[]byte("key3")}, Fetched: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice := keys["alice"]; len(keys) != 1 || !reflect.DeepEqual(alice.Keys, [][]byte{[]byte("key3")}) || !alice.Fetched.Equal(now.Add(time.Hour)) {
+		t.Errorf("Keys() = %+v, want key3 of alice", keys)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	path := tempBoltPath(t)
+	s := openBoltStore(t, path)
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything is there after a restart
+	s = openBoltStore(t, path)
+	defer s.Close()
+	if p, err := s.Profile("bob"); err != nil || p.Modes["1v1"].Losses != 1 {
+		t.Errorf("Profile() = %+v, %v", p, err)
+	}
+	if matches, _ := s.Matches("alice", 10); len(matches) != 2 {
+		t.Errorf("Matches() = %+v", matches)
+	}
+	if replay, err := s.Replay("1"); err != nil || string(replay) != "replay" {
+		t.Errorf("Replay() = %q, %v", replay, err)
+	}
+}
+
+func TestBoltStore_migrate(t *testing.T) {
+	path := tempBoltPath(t)
+
+	// a database of version 1 has matches but no index of them
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if err := boltMigrations[0](tx); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltMatchesBucket).Put(boltUint64(1), []byte(`{"Players":["alice","bob"],"Seed":7}`)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltKeysBucket).Put([]byte("key1"), []byte("alice")); err != nil {
+			return err
+		}
+		return meta.Put(boltVersionKey, boltUint64(1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s := openBoltStore(t, path)
+	defer s.Close()
+	if matches, err := s.Matches("bob", 10); err != nil || len(matches) != 1 || matches[0].Seed != 7 {
+		t.Errorf("Matches() = %+v, %v, want the match indexed", matches, err)
+	}
+	// the keys of before are kept, retrieved long ago
+	if keys, err := s.Keys(); err != nil || !reflect.DeepEqual(keys, map[string]CachedKeys{"alice": {Keys: [][]byte{[]byte("key1")}}}) {
+		t.Errorf("Keys() = %+v, %v, want the keys by user", keys, err)
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get(boltVersionKey); string(v) != string(boltUint64(uint64(len(boltMigrations)))) {
+			t.Errorf("version = %x", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltStore_migrateBests(t *testing.T) {
+	path := tempBoltPath(t)
+
+	// a database of version 4 has records but no personal bests
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		for _, migrate := range boltMigrations[:4] {
+			if err := migrate(tx); err != nil {
+				return err
+			}
+		}
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucket([]byte(LeaderboardUltra))
+		if err != nil {
+			return err
+		}
+		for i, score := range []string{"100", "300", "200"} {
+			if err := b.Put(boltRecordKey(time.Unix(int64(i), 0), uint64(i)), []byte(`{"user":"alice","mode":"ultra","score":`+score+`}`)); err != nil {
+				return err
+			}
+		}
+		return meta.Put(boltVersionKey, boltUint64(4))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s := openBoltStore(t, path)
+	defer s.Close()
+	if best, err := s.PersonalBest("alice", LeaderboardUltra); err != nil || best.Score != 300 {
+		t.Errorf("PersonalBest() = %+v, %v, want the best of the records", best, err)
+	}
+}
+
+func TestGithubKeyRegister_SetStore(t *testing.T) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(reroreroKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	if err := store.SaveKeys("rerorero", CachedKeys{Keys: [][]byte{key.Marshal()}, Fetched: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewGithubKeyRegister(zap.NewNop())
+	if err := r.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	// found without asking github
+	conn := &mockedConnMetadata{UserMock: func() string { return "rerorero" }}
+	if user, err := r.Find(conn, key); err != nil || user.UserName != "rerorero" {
+		t.Errorf("Find() = %+v, %v", user, err)
+	}
+}
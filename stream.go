@@ -0,0 +1,714 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ErrStreamClosed is returned by Send and Recv after the stream is closed locally
+	ErrStreamClosed = xerrors.New("stream is closed")
+	// errConnectionLost reports a transport failure that a resumable stream can recover from
+	errConnectionLost = xerrors.New("connection lost")
+)
+
+const (
+	// ackEvery is the number of frames received on a resumable stream before they are acknowledged
+	ackEvery = 16
+	// maxUnacked bounds the frames kept for retransmission, a stream that exceeds it can no longer be resumed
+	maxUnacked = 4096
+)
+
+// transport is a connection a stream runs on, a resumable stream moves to a new one after a connection loss
+type transport struct {
+	writer     io.Writer
+	reader     *PacketReader
+	closeWrite func() error // sends EOF to the peer
+	closeConn  func() error // closes both directions
+	peerResume chan uint32  // last sequence number received by the peer, sent when the transport resumes a stream
+	done       chan struct{}
+}
+
+func newTransport(w io.Writer, r io.Reader, closeWrite, closeConn func() error, maxFrameSize uint32) *transport {
+	return &transport{
+		writer:     w,
+		reader:     NewPacketReader(r, maxFrameSize),
+		closeWrite: closeWrite,
+		closeConn:  closeConn,
+		peerResume: make(chan uint32, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// packetStream pumps packets between the send/recv queues and a transport.
+// It is shared by ClientStream and ServerStream.
+//
+// A stream ends when both directions are finished: the peer closed its side and CloseSend was called.
+// Close, a cancelled context or any read/write failure end it at once, except for a connection loss
+// of a resumable stream, which waits for a new transport to be attached.
+//
+// Frames of a resumable stream carry sequence numbers in their id. Data and close frames are kept
+// until the peer acknowledges them, and retransmitted on the new transport when the stream resumes.
+type packetStream struct {
+	codec         Codec
+	request       chan *Packet
+	response      chan *Packet
+	attach        chan *transport
+	detachTimeout time.Duration // how long a resumable stream waits for a new transport, forever if zero
+	announceToken bool          // the token is sent to the peer, set on the server side
+	onFinish      func()
+	writeMux      sync.Mutex
+
+	closeSendOnce sync.Once
+	sendClosed    chan struct{} // closed by CloseSend
+	closeOnce     sync.Once
+	closed        chan struct{} // closed by Close
+	sendDone      chan struct{} // closed when every packet is written and the peer is told so
+	deliverOnce   sync.Once
+	delivered     chan struct{} // closed after sendDone once the peer acknowledged every packet
+	recvOnce      sync.Once
+	recvDone      chan struct{} // closed when no more packets will be received
+	peerClosed    chan struct{} // closed when the peer finished sending
+	abandonOnce   sync.Once
+	abandoned     chan struct{} // closed when the stream will not be resumed
+	shutdownOnce  sync.Once
+	shutdown      chan struct{} // closed when the server announced it is going down
+
+	mux        sync.Mutex
+	transport  *transport
+	resumable  bool
+	token      string
+	sendSeq    uint32
+	recvSeq    uint32
+	unacked    []*Packet
+	overflow   bool
+	abandonErr error
+	done       chan struct{} // closed when the stream ends
+	err        error
+	recvErr    error
+}
+
+func newPacketStream(t *transport, codec Codec, sendQueSize, recvQueSize int) *packetStream {
+	return &packetStream{
+		codec:      codec,
+		request:    make(chan *Packet, sendQueSize),
+		response:   make(chan *Packet, recvQueSize),
+		attach:     make(chan *transport),
+		sendClosed: make(chan struct{}),
+		closed:     make(chan struct{}),
+		sendDone:   make(chan struct{}),
+		delivered:  make(chan struct{}),
+		recvDone:   make(chan struct{}),
+		peerClosed: make(chan struct{}),
+		abandoned:  make(chan struct{}),
+		shutdown:   make(chan struct{}),
+		transport:  t,
+		done:       make(chan struct{}),
+	}
+}
+
+// setResumable makes the stream number its frames so that it can be resumed with the token.
+// It must be called before the stream runs. The token may be set later by the peer.
+func (s *packetStream) setResumable(token string, detachTimeout time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.resumable = true
+	s.token = token
+	s.detachTimeout = detachTimeout
+}
+
+func (s *packetStream) isResumable() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.resumable
+}
+
+// resumeToken returns the token to resume the stream with, it is empty if the stream is not resumable
+func (s *packetStream) resumeToken() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.token
+}
+
+func (s *packetStream) sendContext(ctx context.Context, p *Packet) error {
+	// fail fast rather than racing with a ready queue
+	select {
+	case <-s.done:
+		return s.Err()
+	case <-s.sendClosed:
+		return ErrStreamClosed
+	default:
+	}
+
+	select {
+	case s.request <- p:
+		return nil
+	case <-s.sendClosed:
+		return ErrStreamClosed
+	case <-s.done:
+		return s.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *packetStream) recvContext(ctx context.Context) (*Packet, error) {
+	select {
+	case p := <-s.response:
+		return p, nil
+	case <-s.recvDone:
+		// deliver what was received before the end
+		select {
+		case p := <-s.response:
+			return p, nil
+		default:
+		}
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return nil, s.recvErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *packetStream) sendMsg(ctx context.Context, v interface{}) error {
+	p, err := marshalPacket(s.codec, v)
+	if err != nil {
+		return err
+	}
+	return s.sendContext(ctx, p)
+}
+
+func (s *packetStream) recvMsg(ctx context.Context, v interface{}) error {
+	p, err := s.recvContext(ctx)
+	if err != nil {
+		return err
+	}
+	return unmarshalPacket(s.codec, p, v)
+}
+
+// closeSend writes the packets already queued, then tells the peer that no more packets will be sent
+func (s *packetStream) closeSend() {
+	s.closeSendOnce.Do(func() {
+		close(s.sendClosed)
+	})
+}
+
+// close ends the stream at once, queued packets are dropped
+func (s *packetStream) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+
+		s.mux.Lock()
+		t := s.transport
+		resumable := s.resumable
+		s.mux.Unlock()
+		if resumable && !isClosedChan(s.delivered) {
+			// a resumable peer would wait for the stream to come back otherwise
+			s.write(t, newErrorPacket(0, ErrStreamClosed))
+		}
+		close(s.closed)
+		err = t.closeConn()
+	})
+	return err
+}
+
+// attachTransport resumes the stream on t. The current transport is closed if the stream did not notice its loss yet.
+func (s *packetStream) attachTransport(t *transport) error {
+	s.mux.Lock()
+	old := s.transport
+	s.mux.Unlock()
+	old.closeConn()
+
+	select {
+	case s.attach <- t:
+		return nil
+	case <-s.done:
+		return ErrStreamClosed
+	}
+}
+
+// abandon ends the stream with err, it is called when the stream will not get a new transport
+func (s *packetStream) abandon(err error) {
+	s.abandonOnce.Do(func() {
+		s.mux.Lock()
+		s.abandonErr = err
+		s.mux.Unlock()
+		close(s.abandoned)
+	})
+}
+
+// writeControl writes a control frame on the current transport, it is lost if the stream is detached
+func (s *packetStream) writeControl(p *Packet) error {
+	s.mux.Lock()
+	t := s.transport
+	s.mux.Unlock()
+	return s.write(t, p)
+}
+
+// Done returns a channel that is closed when the stream ends
+func (s *packetStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream ended: io.EOF when both sides finished sending, ErrStreamClosed after Close,
+// the context error when cancelled, or the read/write failure. It returns nil while the stream is running.
+func (s *packetStream) Err() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.err
+}
+
+func isClosedChan(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *packetStream) isFinished() bool {
+	return isClosedChan(s.delivered) && isClosedChan(s.peerClosed)
+}
+
+func (s *packetStream) closeRecv(err error) {
+	s.recvOnce.Do(func() {
+
+		s.mux.Lock()
+		s.recvErr = err
+		s.mux.Unlock()
+		if err == io.EOF {
+			close(s.peerClosed)
+		}
+		close(s.recvDone)
+	})
+}
+
+func (s *packetStream) write(t *transport, p *Packet) error {
+	s.writeMux.Lock()
+	defer s.writeMux.Unlock()
+	return p.Write(t.writer)
+}
+
+// writeSeq numbers a data or close frame and keeps it until the peer acknowledges it
+func (s *packetStream) writeSeq(t *transport, p *Packet) error {
+	s.mux.Lock()
+	if !s.resumable {
+		s.mux.Unlock()
+		return s.write(t, p)
+	}
+	s.sendSeq++
+	q := *p
+	q.ID = s.sendSeq
+	if len(s.unacked) >= maxUnacked {
+		s.unacked = s.unacked[1:]
+		s.overflow = true
+	}
+	s.unacked = append(s.unacked, &q)
+	s.mux.Unlock()
+	return s.write(t, &q)
+}
+
+func (s *packetStream) ack(seq uint32) {
+	s.mux.Lock()
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].ID <= seq {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+	s.mux.Unlock()
+	s.checkDelivered()
+}
+
+// checkDelivered closes delivered when the send side finished and nothing waits for an ack.
+// Frames of a stream that is not resumable are never acknowledged, they are delivered once written.
+func (s *packetStream) checkDelivered() {
+	if !isClosedChan(s.sendDone) {
+		return
+	}
+	s.mux.Lock()
+	delivered := !s.resumable || len(s.unacked) == 0
+	s.mux.Unlock()
+	if delivered {
+		s.deliverOnce.Do(func() {
+			close(s.delivered)
+		})
+	}
+}
+
+func (s *packetStream) lost(err error) error {
+	if !s.isResumable() {
+		return err
+	}
+	return xerrors.Errorf("%v: %w", err, errConnectionLost)
+}
+
+// run pumps packets until the stream ends
+func (s *packetStream) run(ctx context.Context, logger *zap.Logger) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-s.abandoned:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		for _, ch := range []<-chan struct{}{s.delivered, s.peerClosed} {
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(finished)
+	}()
+
+	s.mux.Lock()
+	t := s.transport
+	s.mux.Unlock()
+	resumed := false
+	for {
+		err := s.runTransport(ctx, logger, t, resumed, finished)
+		close(t.done)
+		if !xerrors.Is(err, errConnectionLost) || ctx.Err() != nil {
+			return s.finish(err)
+		}
+		if isClosedChan(s.peerClosed) {
+			// nobody is left to resume with
+			return s.finish(nil)
+		}
+
+		logger.Warn("connection lost, waiting for the stream to be resumed", zap.Error(err))
+		t, err = s.waitAttach(ctx, err)
+		if err != nil {
+			return s.finish(err)
+		}
+		logger.Info("stream resumed")
+		resumed = true
+	}
+}
+
+func (s *packetStream) waitAttach(ctx context.Context, lostErr error) (*transport, error) {
+	s.mux.Lock()
+	token, overflow, timeout := s.token, s.overflow, s.detachTimeout
+	s.mux.Unlock()
+	if token == "" {
+		return nil, xerrors.Errorf("stream can not be resumed without a token: %w", lostErr)
+	}
+	if overflow {
+		return nil, xerrors.Errorf("stream can not be resumed, too many frames are unacknowledged: %w", lostErr)
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case t := <-s.attach:
+		s.mux.Lock()
+		s.transport = t
+		s.mux.Unlock()
+		return t, nil
+	case <-expired:
+		return nil, xerrors.Errorf("stream was not resumed within %s: %w", timeout, lostErr)
+	case <-s.abandoned:
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return nil, xerrors.Errorf("stream was not resumed: %v: %w", s.abandonErr, lostErr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *packetStream) finish(err error) error {
+	switch {
+	case err == nil:
+	case s.isClosed():
+		err = ErrStreamClosed
+	case isClosedChan(s.abandoned) && !xerrors.Is(err, errConnectionLost):
+		s.mux.Lock()
+		err = xerrors.Errorf("stream is abandoned: %w", s.abandonErr)
+		s.mux.Unlock()
+	}
+	if err == nil {
+		s.closeRecv(io.EOF)
+	} else {
+		s.closeRecv(err)
+	}
+	if err != nil && s.isResumable() && !xerrors.Is(err, errConnectionLost) && !xerrors.Is(err, ErrStreamClosed) {
+		// a resumable peer would wait for the stream to come back otherwise
+		s.mux.Lock()
+		t := s.transport
+		s.mux.Unlock()
+		s.write(t, newErrorPacket(0, err))
+	}
+
+	s.mux.Lock()
+	s.err = io.EOF
+	if err != nil {
+		s.err = err
+	}
+	s.mux.Unlock()
+	close(s.done)
+
+	if s.onFinish != nil {
+		s.onFinish()
+	}
+	return err
+}
+
+func (s *packetStream) isClosed() bool {
+	return isClosedChan(s.closed)
+}
+
+func (s *packetStream) runTransport(ctx context.Context, logger *zap.Logger, t *transport, resumed bool, finished <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-finished:
+		}
+		// unblock the reader
+		t.closeConn()
+	}()
+
+	// start watching request
+	eg.Go(func() error {
+		return s.send(ctx, logger, t, resumed, finished)
+	})
+
+	// start receiving
+	eg.Go(func() error {
+		return s.receive(ctx, logger, t)
+	})
+
+	return eg.Wait()
+}
+
+func (s *packetStream) send(ctx context.Context, logger *zap.Logger, t *transport, resumed bool, finished <-chan struct{}) error {
+	write := func(p *Packet) error {
+		if err := s.writeSeq(t, p); err != nil {
+			logger.Error("failed to write to stream", zap.Error(err), zap.Any("request", p))
+			return xerrors.Errorf("failed to write to stream: %w", s.lost(err))
+		}
+		return nil
+	}
+
+	if resumed {
+		if err := s.resume(ctx, t); err != nil {
+			return err
+		}
+	} else if s.announceToken {
+		if err := s.write(t, newControlPacket(controlResumeToken, []byte(s.resumeToken()))); err != nil {
+			return xerrors.Errorf("failed to write resume token: %w", s.lost(err))
+		}
+	}
+
+	request, sendClosed := s.request, s.sendClosed
+	if isClosedChan(s.sendDone) {
+		request, sendClosed = nil, nil
+	}
+	for {
+		select {
+		case p := <-request:
+			if err := write(p); err != nil {
+				return err
+			}
+		case <-sendClosed:
+			// flush what was queued before CloseSend
+			for len(s.request) > 0 {
+				if err := write(<-s.request); err != nil {
+					return err
+				}
+			}
+			if err := write(&Packet{Type: FrameClose}); err != nil {
+				return err
+			}
+			if !s.isResumable() {
+				// a resumable stream keeps its side open to acknowledge the peer
+				if err := t.closeWrite(); err != nil {
+					return xerrors.Errorf("failed to close write: %w", err)
+				}
+			}
+			close(s.sendDone)
+			s.checkDelivered()
+			request, sendClosed = nil, nil
+		case <-finished:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// resume tells the peer what was received, then retransmits what the peer missed
+func (s *packetStream) resume(ctx context.Context, t *transport) error {
+	s.mux.Lock()
+	recvSeq := s.recvSeq
+	s.mux.Unlock()
+	if err := s.write(t, newSeqControlPacket(controlResume, recvSeq)); err != nil {
+		return xerrors.Errorf("failed to write resume: %w", s.lost(err))
+	}
+
+	var peerSeq uint32
+	select {
+	case peerSeq = <-t.peerResume:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.ack(peerSeq)
+	s.mux.Lock()
+	missed := append([]*Packet{}, s.unacked...)
+	s.mux.Unlock()
+	for _, p := range missed {
+		if err := s.write(t, p); err != nil {
+			return xerrors.Errorf("failed to retransmit: %w", s.lost(err))
+		}
+	}
+	return nil
+}
+
+func (s *packetStream) receive(ctx context.Context, logger *zap.Logger, t *transport) error {
+	received := 0
+	for {
+		p, err := t.reader.ReadPacket()
+		switch {
+		case err == nil:
+		case !s.isResumable() && xerrors.Is(err, io.EOF):
+			graceful := isClosedChan(s.peerClosed)
+			s.closeRecv(io.EOF)
+			if graceful || isClosedChan(s.delivered) {
+				return nil
+			}
+			// the peer went away without a close frame, nobody reads what is still to be sent
+			return xerrors.Errorf("connection closed before the stream finished: %w", io.ErrUnexpectedEOF)
+		case ctx.Err() != nil:
+			// the connection is closed because the stream was cancelled
+			return ctx.Err()
+		case s.isFinished():
+			return nil
+		case isProtocolError(err):
+			logger.Warn("rejected peer speaking unsupported protocol", zap.Error(err))
+			s.writeMux.Lock()
+			if err := writeRejection(t.writer, err); err != nil {
+				logger.Error("failed to write rejection", zap.Error(err))
+			}
+			s.writeMux.Unlock()
+			return err
+		case s.isResumable():
+			return xerrors.Errorf("failed to read from stream: %w", s.lost(err))
+		default:
+			logger.Error("failed to read from stream", zap.Error(err))
+			return err
+		}
+
+		switch p.Type {
+		case FrameData, FrameClose:
+			// p belongs to the receiver once delivered
+			seq, frameType := p.ID, p.Type
+			resumable := s.isResumable()
+			if resumable {
+				s.mux.Lock()
+				duplicated := seq <= s.recvSeq
+				s.mux.Unlock()
+				if duplicated {
+					p.Release()
+					continue
+				}
+			}
+
+			if frameType == FrameData {
+				select {
+				case s.response <- p:
+				case <-ctx.Done():
+					// not counted as received, the peer sends it again on resume
+					return ctx.Err()
+				}
+			}
+
+			if resumable {
+				s.mux.Lock()
+				s.recvSeq = seq
+				s.mux.Unlock()
+				if received++; received%ackEvery == 0 || frameType == FrameClose {
+					if err := s.write(t, newSeqControlPacket(controlAck, seq)); err != nil {
+						return xerrors.Errorf("failed to write ack: %w", s.lost(err))
+					}
+				}
+			}
+			if frameType == FrameClose {
+				s.closeRecv(io.EOF)
+			}
+		case FramePing:
+			if p.Flags&FlagAck == 0 {
+				if err := s.write(t, &Packet{Type: FramePing, Flags: FlagAck, ID: p.ID, Data: p.Data}); err != nil {
+					return xerrors.Errorf("failed to write ping: %w", s.lost(err))
+				}
+			}
+		case FrameControl:
+			if err := s.handleControl(t, p); err != nil {
+				return err
+			}
+		case FrameError:
+			return p.Err()
+		default:
+			logger.Debug("ignored frame", zap.Stringer("type", p.Type))
+		}
+	}
+}
+
+func (s *packetStream) handleControl(t *transport, p *Packet) error {
+	kind, payload, err := parseControl(p)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case controlResumeToken:
+		s.mux.Lock()
+		if s.resumable {
+			s.token = string(payload)
+		}
+		s.mux.Unlock()
+	case controlAck:
+		seq, err := parseSeq(payload)
+		if err != nil {
+			return err
+		}
+		s.ack(seq)
+	case controlResume:
+		seq, err := parseSeq(payload)
+		if err != nil {
+			return err
+		}
+		select {
+		case t.peerResume <- seq:
+		default:
+		}
+	case controlShutdown:
+		s.shutdownOnce.Do(func() {
+			close(s.shutdown)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package tetris
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func startTestPacketStream(t *testing.T, ctx context.Context, w io.Writer, r io.ReadCloser) (*packetStream, chan error) {
+	t.Helper()
+	s := newPacketStream(newTransport(w, r, r.Close, r.Close, 0), DefaultCodec, 0, 0)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.run(ctx, zap.NewNop())
+	}()
+	return s, errCh
+}
+
+// discardStream is a stream to a client that reads everything sent
+func discardStream(t *testing.T) *ServerStream {
+	t.Helper()
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	s, _ := startTestPacketStream(t, context.Background(), ioutil.Discard, r)
+	return &ServerStream{stream: s}
+}
+
+// stuckStream is a stream to a client that never reads, sending to it blocks once the queues are full
+func stuckStream(t *testing.T) *ServerStream {
+	t.Helper()
+	r, w := io.Pipe()
+	t.Cleanup(func() { r.Close() })
+	s, _ := startTestPacketStream(t, context.Background(), w, r)
+	return &ServerStream{stream: s}
+}
+
+// stuckResumableStream is a resumable stream to a client that neither reads nor writes,
+// closing it blocks on the frame telling the client the stream is closed
+func stuckResumableStream(t *testing.T) *ServerStream {
+	t.Helper()
+	out, w := io.Pipe()
+	r, in := io.Pipe()
+	t.Cleanup(func() {
+		out.Close()
+		in.Close()
+	})
+	s := newPacketStream(newTransport(w, r, r.Close, r.Close, 0), DefaultCodec, 0, 0)
+	s.setResumable("token", 0)
+	go s.run(context.Background(), zap.NewNop())
+	return &ServerStream{stream: s}
+}
+
+func Test_packetStream_RecvContextDeadline(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	s, _ := startTestPacketStream(t, context.Background(), ioutil.Discard, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.recvContext(ctx); !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("recvContext() error = %v", err)
+	}
+}
+
+func TestStream_MsgContext(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	s, _ := startTestPacketStream(t, context.Background(), ioutil.Discard, r)
+	server, client := &ServerStream{stream: s}, &ClientStream{stream: s}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var v map[string]string
+	if err := server.RecvMsgContext(ctx, &v); !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ServerStream.RecvMsgContext() error = %v", err)
+	}
+	if err := client.RecvMsgContext(ctx, &v); !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ClientStream.RecvMsgContext() error = %v", err)
+	}
+}
+
+func Test_packetStream_SendAfterWriteFailure(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	writeErr := xerrors.New("connection reset")
+	s, errCh := startTestPacketStream(t, context.Background(), &failingWriter{err: writeErr}, r)
+
+	if err := s.sendContext(context.Background(), &Packet{Data: []byte("move")}); err != nil {
+		t.Fatalf("first send must be queued: %v", err)
+	}
+	if err := <-errCh; !xerrors.Is(err, writeErr) {
+		t.Fatalf("run() error = %v", err)
+	}
+	if err := s.sendContext(context.Background(), &Packet{Data: []byte("move")}); !xerrors.Is(err, writeErr) {
+		t.Errorf("sendContext() error = %v", err)
+	}
+	if _, err := s.recvContext(context.Background()); err == nil {
+		t.Error("recvContext() must fail after the stream ended")
+	}
+}
+
+func Test_packetStream_Cancel(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	s, errCh := startTestPacketStream(t, ctx, ioutil.Discard, r)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := s.recvContext(context.Background())
+		recvErr <- err
+	}()
+
+	cancel()
+	if err := <-errCh; !xerrors.Is(err, context.Canceled) {
+		t.Errorf("run() error = %v", err)
+	}
+	select {
+	case err := <-recvErr:
+		if !xerrors.Is(err, context.Canceled) {
+			t.Errorf("recvContext() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recvContext() is blocked after cancel")
+	}
+	if err := s.sendContext(context.Background(), &Packet{}); !xerrors.Is(err, context.Canceled) {
+		t.Errorf("sendContext() error = %v", err)
+	}
+}
+
+// pipeConn is one end of an in-memory full duplex connection supporting half-close
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (c *pipeConn) closeWrite() error {
+	return c.PipeWriter.Close()
+}
+
+func (c *pipeConn) close() error {
+	c.PipeReader.Close()
+	return c.PipeWriter.Close()
+}
+
+func startTestPacketStreamPair(t *testing.T, queSize int) (a, b *packetStream) {
+	t.Helper()
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	ca := &pipeConn{PipeReader: ar, PipeWriter: aw}
+	cb := &pipeConn{PipeReader: br, PipeWriter: bw}
+	a = newPacketStream(newTransport(ca, ca, ca.closeWrite, ca.close, 0), DefaultCodec, queSize, queSize)
+	b = newPacketStream(newTransport(cb, cb, cb.closeWrite, cb.close, 0), DefaultCodec, queSize, queSize)
+	go a.run(context.Background(), zap.NewNop())
+	go b.run(context.Background(), zap.NewNop())
+	t.Cleanup(func() {
+		a.close()
+		b.close()
+	})
+	return a, b
+}
+
+func Test_packetStream_CloseSend(t *testing.T) {
+	a, b := startTestPacketStreamPair(t, 4)
+
+	for _, s := range []string{"1", "2", "3"} {
+		if err := a.sendContext(context.Background(), &Packet{Data: []byte(s)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.closeSend()
+	if err := a.sendContext(context.Background(), &Packet{}); !xerrors.Is(err, ErrStreamClosed) {
+		t.Errorf("sendContext() after closeSend error = %v", err)
+	}
+
+	// every packet queued before CloseSend arrives, then EOF
+	for _, want := range []string{"1", "2", "3"} {
+		p, err := b.recvContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p.Data) != want {
+			t.Errorf("got %q, want %q", p.Data, want)
+		}
+	}
+	if _, err := b.recvContext(context.Background()); err != io.EOF {
+		t.Errorf("recvContext() error = %v, want io.EOF", err)
+	}
+
+	// the other direction is still open
+	if err := b.sendContext(context.Background(), &Packet{Data: []byte("bye")}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.recvContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "bye" {
+		t.Errorf("unexpected data %q", p.Data)
+	}
+	select {
+	case <-a.Done():
+		t.Fatal("stream must not end while the peer is sending")
+	default:
+	}
+
+	b.closeSend()
+	for _, s := range []*packetStream{a, b} {
+		<-s.Done()
+		if err := s.Err(); err != io.EOF {
+			t.Errorf("Err() = %v, want io.EOF", err)
+		}
+	}
+}
+
+func Test_packetStream_CloseDuringTraffic(t *testing.T) {
+	a, b := startTestPacketStreamPair(t, 1)
+
+	var wg sync.WaitGroup
+	for _, s := range []*packetStream{a, b} {
+		wg.Add(2)
+		go func(s *packetStream) {
+			defer wg.Done()
+			for {
+				if err := s.sendContext(context.Background(), &Packet{Data: []byte("move")}); err != nil {
+					return
+				}
+			}
+		}(s)
+		go func(s *packetStream) {
+			defer wg.Done()
+			for {
+				if _, err := s.recvContext(context.Background()); err != nil {
+					return
+				}
+			}
+		}(s)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.close(); err != nil {
+		t.Errorf("second close must be a no-op: %v", err)
+	}
+	wg.Wait()
+
+	<-a.Done()
+	if err := a.Err(); !xerrors.Is(err, ErrStreamClosed) {
+		t.Errorf("Err() = %v, want ErrStreamClosed", err)
+	}
+	<-b.Done()
+	if err := b.Err(); err == nil {
+		t.Error("Err() of the peer must be set")
+	}
+}
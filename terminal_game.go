@@ -0,0 +1,275 @@
+package tetris
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+)
+
+const (
+	ansiHome       = "\x1b[H"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiFaint      = "\x1b[2m"
+)
+
+// pieceColors are the background colors of the cells of each piece, guideline colors on 256 color terminals
+var pieceColors = map[game.Cell]string{
+	game.Cell(game.PieceI): "\x1b[48;5;51m",
+	game.Cell(game.PieceO): "\x1b[48;5;226m",
+	game.Cell(game.PieceT): "\x1b[48;5;129m",
+	game.Cell(game.PieceS): "\x1b[48;5;46m",
+	game.Cell(game.PieceZ): "\x1b[48;5;196m",
+	game.Cell(game.PieceJ): "\x1b[48;5;21m",
+	game.Cell(game.PieceL): "\x1b[48;5;208m",
+	game.CellGarbage:       "\x1b[48;5;244m",
+}
+
+// TerminalGameConfig is the rules of games played on plain ssh terminals
+type TerminalGameConfig struct {
+	Game game.Config
+	// Seed returns the seed of a game, the current time if nil
+	Seed func() uint64
+	// TickInterval is the duration of a frame, 1/60s if zero
+	TickInterval time.Duration
+}
+
+func (c TerminalGameConfig) withDefaults() TerminalGameConfig {
+	if c.Seed == nil {
+		c.Seed = func() uint64 {
+			return uint64(time.Now().UnixNano())
+		}
+	}
+	if c.TickInterval <= 0 {
+		c.TickInterval = time.Second / game.FramesPerSecond
+	}
+	return c
+}
+
+// TerminalGame runs games on the server for plain ssh clients and draws them with ANSI escape codes
+type TerminalGame struct {
+	config TerminalGameConfig
+	logger *zap.Logger
+}
+
+// NewTerminalGame returns games played on terminals, register Handler to serve them
+func NewTerminalGame(config TerminalGameConfig, logger *zap.Logger) *TerminalGame {
+	return &TerminalGame{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+// Handler plays a game per terminal until it is over or the player quits with q or escape.
+// Left and right move, up and x rotate clockwise, z rotates counterclockwise,
+// down soft drops, space hard drops and c holds.
+func (tg *TerminalGame) Handler() TerminalHandler {
+	return func(ctx context.Context, term *Terminal) {
+		logger := tg.logger.With(zap.String("user", term.User().UserName))
+		if err := tg.play(ctx, term); err != nil {
+			logger.Info("terminal game ended", zap.Error(err))
+		}
+	}
+}
+
+func (tg *TerminalGame) play(ctx context.Context, term *Terminal) error {
+	g := game.New(tg.config.Game, tg.config.Seed())
+	if _, err := io.WriteString(term, ansiHideCursor+ansiClear); err != nil {
+		return err
+	}
+	defer io.WriteString(term, ansiReset+ansiShowCursor+"\r\n")
+	if err := renderGame(term, g); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(tg.config.TickInterval)
+	defer ticker.Stop()
+	// the key presses wait in line, a frame applies one of them so that none is lost
+	var inputs []game.Input
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-term.ServerShutdown():
+			_, err := io.WriteString(term, "\r\nthe server is shutting down")
+			return err
+		case <-term.Resized():
+			if _, err := io.WriteString(term, ansiClear); err != nil {
+				return err
+			}
+			if err := renderGame(term, g); err != nil {
+				return err
+			}
+		case k := <-term.Keys():
+			if k.Err != nil {
+				return k.Err
+			}
+			in, quit := gameInput(k.Key)
+			if quit {
+				return nil
+			}
+			if in != 0 {
+				inputs = append(inputs, in)
+			}
+		case <-ticker.C:
+			var in game.Input
+			if len(inputs) > 0 {
+				in, inputs = inputs[0], inputs[1:]
+			}
+			before := g.Active()
+			events := g.Step(in)
+			if len(events) == 0 && in == 0 && g.Active() == before {
+				continue
+			}
+			if err := renderGame(term, g); err != nil {
+				return err
+			}
+			if g.Over() != game.TopOutNone {
+				_, err := fmt.Fprintf(term, "\r\nGAME OVER  score %d", g.Score())
+				return err
+			}
+		}
+	}
+}
+
+// gameInput maps a key to the input of a frame, quit is set for the keys leaving the game
+func gameInput(k Key) (in game.Input, quit bool) {
+	switch k.Code {
+	case KeyLeft:
+		return game.InputLeft, false
+	case KeyRight:
+		return game.InputRight, false
+	case KeyUp:
+		return game.InputRotateCW, false
+	case KeyDown:
+		return game.InputSoftDrop, false
+	case KeyEscape, KeyCtrlC, KeyCtrlD:
+		return 0, true
+	case KeyRune:
+		switch k.Rune {
+		case ' ':
+			return game.InputHardDrop, false
+		case 'x', 'X':
+			return game.InputRotateCW, false
+		case 'z', 'Z':
+			return game.InputRotateCCW, false
+		case 'c', 'C':
+			return game.InputHold, false
+		case 'q', 'Q':
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// renderGame draws the visible rows of the well with the falling piece and its ghost,
+// the hold box on the left and the next queue with the score on the right
+func renderGame(w io.Writer, g *game.Game) error {
+	board := g.Board()
+	ghost := make(map[game.Point]bool, 4)
+	for _, p := range g.Ghost().Cells() {
+		ghost[p] = true
+	}
+	active := g.Active()
+	cells := make(map[game.Point]game.Cell, 4)
+	for _, p := range active.Cells() {
+		cells[p] = game.Cell(active.Piece)
+	}
+
+	hold := previewRows(g.Hold())
+	side := make([]string, game.VisibleHeight+2)
+	var right []string
+	right = append(right, "NEXT")
+	for _, p := range g.Next() {
+		rows := previewRows(p)
+		right = append(right, rows[0], rows[1], "")
+	}
+	right = append(right,
+		fmt.Sprintf("SCORE %d", g.Score()),
+		fmt.Sprintf("LINES %d", g.Lines()),
+		fmt.Sprintf("LEVEL %d", g.Level()),
+	)
+	copy(side[1:], right)
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	for row := 0; row < game.VisibleHeight+2; row++ {
+		// the hold box is 8 columns wide like the previews
+		switch row {
+		case 1:
+			b.WriteString("HOLD    ")
+		case 2, 3:
+			b.WriteString(hold[row-2])
+		default:
+			b.WriteString(strings.Repeat(" ", 8))
+		}
+
+		if row == 0 || row == game.VisibleHeight+1 {
+			b.WriteString(" +" + strings.Repeat("-", 2*game.Width) + "+ ")
+		} else {
+			y := game.VisibleHeight - row
+			b.WriteString(" |")
+			for x := 0; x < game.Width; x++ {
+				p := game.Point{X: x, Y: y}
+				if c, ok := cells[p]; ok {
+					b.WriteString(cellString(c))
+				} else if ghost[p] {
+					b.WriteString(ansiFaint + "[]" + ansiReset)
+				} else {
+					b.WriteString(cellString(board.Cell(x, y)))
+				}
+			}
+			b.WriteString("| ")
+		}
+		b.WriteString(side[row])
+		// clear what a longer line drawn before left
+		b.WriteString("\x1b[K\r\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func cellString(c game.Cell) string {
+	if c == game.CellEmpty {
+		return " ."
+	}
+	return pieceColors[c] + "  " + ansiReset
+}
+
+// previewRows draws a piece in its spawn orientation on 2 rows of 8 columns, blank for PieceNone
+func previewRows(p game.Piece) [2]string {
+	rows := [2]string{strings.Repeat(" ", 8), strings.Repeat(" ", 8)}
+	if p == game.PieceNone {
+		return rows
+	}
+	cells := game.ActivePiece{Piece: p, Rotation: game.Rotation0}.Cells()
+	top := cells[0].Y
+	for _, c := range cells {
+		if c.Y > top {
+			top = c.Y
+		}
+	}
+	for i := range rows {
+		var b strings.Builder
+		for x := 0; x < 4; x++ {
+			filled := false
+			for _, c := range cells {
+				if c.X == x && c.Y == top-i {
+					filled = true
+				}
+			}
+			if filled {
+				b.WriteString(cellString(game.Cell(p)))
+			} else {
+				b.WriteString("  ")
+			}
+		}
+		rows[i] = b.String()
+	}
+	return rows
+}
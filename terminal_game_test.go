@@ -0,0 +1,110 @@
+package tetris
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/vkg/tetris/game"
+)
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+func TestRenderGame(t *testing.T) {
+	g := game.New(game.DefaultConfig, 1)
+	g.Step(game.InputHardDrop)
+	held := g.Active().Piece
+	g.Step(game.InputHold)
+	for i := 0; i < 3; i++ {
+		g.Step(game.InputSoftDrop)
+	}
+
+	var b strings.Builder
+	if err := renderGame(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if !strings.HasPrefix(out, ansiHome) {
+		t.Errorf("the screen must be drawn from the top left: %q", out[:10])
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if len(lines) != game.VisibleHeight+2 {
+		t.Fatalf("got %d lines, want %d", len(lines), game.VisibleHeight+2)
+	}
+
+	ghost := map[game.Point]bool{}
+	for _, p := range g.Ghost().Cells() {
+		ghost[p] = true
+	}
+	active := map[game.Point]bool{}
+	for _, p := range g.Active().Cells() {
+		active[p] = true
+	}
+	board := g.Board()
+	for row, line := range lines {
+		plain := ansiEscape.ReplaceAllString(line, "")
+		if row == 0 || row == game.VisibleHeight+1 {
+			if want := "+" + strings.Repeat("-", 2*game.Width) + "+"; plain[9:9+len(want)] != want {
+				t.Errorf("row %d is %q, want the border", row, plain)
+			}
+			continue
+		}
+		well := plain[10 : 10+2*game.Width]
+		y := game.VisibleHeight - row
+		for x := 0; x < game.Width; x++ {
+			p := game.Point{X: x, Y: y}
+			want := " ."
+			switch {
+			case active[p] || board.Cell(x, y) != game.CellEmpty:
+				want = "  "
+			case ghost[p]:
+				want = "[]"
+			}
+			if got := well[2*x : 2*x+2]; got != want {
+				t.Errorf("cell %d,%d is %q, want %q", x, y, got, want)
+			}
+		}
+	}
+
+	// the colors of the pieces show which piece each cell is of
+	if !strings.Contains(lines[2]+lines[3], pieceColors[game.Cell(held)]) {
+		t.Errorf("the held %v is not drawn: %q", held, lines[2:4])
+	}
+	side := func(row int) string {
+		return lines[row][strings.LastIndex(lines[row], "|"):]
+	}
+	for i, p := range g.Next() {
+		if rows := side(2+3*i) + side(3+3*i); !strings.Contains(rows, pieceColors[game.Cell(p)]) {
+			t.Errorf("next piece %d %v is not drawn: %q", i, p, rows)
+		}
+	}
+	plain := ansiEscape.ReplaceAllString(out, "")
+	for _, s := range []string{"HOLD", "NEXT", "SCORE", "LINES 0", "LEVEL 1"} {
+		if !strings.Contains(plain, s) {
+			t.Errorf("%q is not drawn", s)
+		}
+	}
+}
+
+func Test_gameInput(t *testing.T) {
+	tests := []struct {
+		key  Key
+		in   game.Input
+		quit bool
+	}{
+		{Key{Code: KeyLeft}, game.InputLeft, false},
+		{Key{Code: KeyDown}, game.InputSoftDrop, false},
+		{Key{Code: KeyRune, Rune: ' '}, game.InputHardDrop, false},
+		{Key{Code: KeyRune, Rune: 'z'}, game.InputRotateCCW, false},
+		{Key{Code: KeyRune, Rune: 'c'}, game.InputHold, false},
+		{Key{Code: KeyRune, Rune: 'a'}, 0, false},
+		{Key{Code: KeyRune, Rune: 'q'}, 0, true},
+		{Key{Code: KeyEscape}, 0, true},
+	}
+	for _, tt := range tests {
+		in, quit := gameInput(tt.key)
+		if in != tt.in || quit != tt.quit {
+			t.Errorf("gameInput(%+v) = %v, %v, want %v, %v", tt.key, in, quit, tt.in, tt.quit)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tetris
+
+import (
+	"bufio"
+	"unicode/utf8"
+)
+
+// KeyCode is a key pressed on a terminal
+type KeyCode int
+
+const (
+	KeyUnknown KeyCode = iota
+	KeyRune            // a printable character, see Key.Rune
+	KeyUp
+	KeyDown
+	KeyRight
+	KeyLeft
+	KeyEnter
+	KeyTab
+	KeyBackspace
+	KeyEscape
+	KeyCtrlC
+	KeyCtrlD
+)
+
+// Key is a key press decoded from the raw input of a terminal
+type Key struct {
+	Code KeyCode
+	Rune rune // set for KeyRune
+}
+
+const keyEsc = 0x1b
+
+// readKey decodes a key press, escape sequences are expected to arrive in one piece
+func readKey(r *bufio.Reader) (Key, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+	switch b {
+	case keyEsc:
+		if r.Buffered() == 0 {
+			return Key{Code: KeyEscape}, nil
+		}
+		return readEscape(r)
+	case '\r', '\n':
+		return Key{Code: KeyEnter}, nil
+	case '\t':
+		return Key{Code: KeyTab}, nil
+	case 0x7f, 0x08:
+		return Key{Code: KeyBackspace}, nil
+	case 0x03:
+		return Key{Code: KeyCtrlC}, nil
+	case 0x04:
+		return Key{Code: KeyCtrlD}, nil
+	}
+	if b < 0x20 {
+		return Key{Code: KeyUnknown}, nil
+	}
+	if b < utf8.RuneSelf {
+		return Key{Code: KeyRune, Rune: rune(b)}, nil
+	}
+	if err := r.UnreadByte(); err != nil {
+		return Key{}, err
+	}
+	c, _, err := r.ReadRune()
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Code: KeyRune, Rune: c}, nil
+}
+
+// readEscape decodes the rest of a CSI (ESC [) or SS3 (ESC O) sequence
+func readEscape(r *bufio.Reader) (Key, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+	if b != '[' && b != 'O' {
+		// alt+key, the key is dropped
+		return Key{Code: KeyUnknown}, nil
+	}
+	// parameters run until a final byte in 0x40-0x7e
+	for {
+		b, err = r.ReadByte()
+		if err != nil {
+			return Key{}, err
+		}
+		if b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	switch b {
+	case 'A':
+		return Key{Code: KeyUp}, nil
+	case 'B':
+		return Key{Code: KeyDown}, nil
+	case 'C':
+		return Key{Code: KeyRight}, nil
+	case 'D':
+		return Key{Code: KeyLeft}, nil
+	}
+	return Key{Code: KeyUnknown}, nil
+}
@@ -0,0 +1,59 @@
+package tetris
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Key
+	}{
+		{
+			name:  "runes",
+			input: "a é",
+			want:  []Key{{Code: KeyRune, Rune: 'a'}, {Code: KeyRune, Rune: ' '}, {Code: KeyRune, Rune: 'é'}},
+		},
+		{
+			name:  "arrows",
+			input: "\x1b[A\x1b[B\x1bOC\x1b[1;5D",
+			want:  []Key{{Code: KeyUp}, {Code: KeyDown}, {Code: KeyRight}, {Code: KeyLeft}},
+		},
+		{
+			name:  "controls",
+			input: "\r\t\x7f\x03\x04",
+			want:  []Key{{Code: KeyEnter}, {Code: KeyTab}, {Code: KeyBackspace}, {Code: KeyCtrlC}, {Code: KeyCtrlD}},
+		},
+		{
+			name:  "escape alone",
+			input: "\x1b",
+			want:  []Key{{Code: KeyEscape}},
+		},
+		{
+			name:  "unknown sequence",
+			input: "\x1b[3~x",
+			want:  []Key{{Code: KeyUnknown}, {Code: KeyRune, Rune: 'x'}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			for i, want := range tt.want {
+				got, err := readKey(r)
+				if err != nil {
+					t.Fatalf("readKey() %d error = %v", i, err)
+				}
+				if got != want {
+					t.Errorf("readKey() %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if _, err := readKey(r); err != io.EOF {
+				t.Errorf("readKey() error = %v, want EOF", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+package tetris
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// VersusMessageType is the kind of a message of a versus match
+type VersusMessageType string
+
+const (
+	// VersusStart is sent to every player when the match starts, every player plays with Seed.
+	// Room is the id spectators watch the match with, it is empty if the match can not be watched.
+	VersusStart VersusMessageType = "start"
+	// VersusInput is sent by a player with its Inputs, in the order of frames, when matches are verified
+	VersusInput VersusMessageType = "input"
+	// VersusLock is sent by a player for each piece it locks at Frame with its Score
+	VersusLock VersusMessageType = "lock"
+	// VersusTopOut is sent by a player whose game is over
+	VersusTopOut VersusMessageType = "top_out"
+	// VersusScore tells every player the Score of a lock of Player
+	VersusScore VersusMessageType = "score"
+	// VersusAttack tells every player that Player sent Lines of garbage to Target
+	VersusAttack VersusMessageType = "attack"
+	// VersusGarbage tells every player that garbage rises into the well of Player, the player adds a row per hole.
+	// In verified matches Frame is the last frame of its game the player may raise it at.
+	VersusGarbage VersusMessageType = "garbage"
+	// VersusEliminated tells every player that Player is out at Place, Reason is set for a disqualified player
+	VersusEliminated VersusMessageType = "eliminated"
+	// VersusEnd tells every player that the match is over
+	VersusEnd VersusMessageType = "end"
+)
+
+// VersusMessage is a message of a versus match, the fields set depend on Type
+type VersusMessage struct {
+	Type    VersusMessageType `json:"type"`
+	Player  string            `json:"player,omitempty"`
+	Players []string          `json:"players,omitempty"`
+	Room    string            `json:"room,omitempty"`
+	Seed    uint64            `json:"seed,omitempty"`
+	Frame   uint64            `json:"frame,omitempty"`
+	Inputs  []InputMessage    `json:"inputs,omitempty"`
+	Score   *game.ScoreEvent  `json:"score,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	Lines   int               `json:"lines,omitempty"`
+	Holes   []int             `json:"holes,omitempty"`
+	Place   int               `json:"place,omitempty"`
+	Winner  string            `json:"winner,omitempty"`
+	Reason  string            `json:"reason,omitempty"`
+}
+
+// VersusConfig is the rules of versus matches
+type VersusConfig struct {
+	// Players is the number of players of a match, two if zero
+	Players int
+	// Holes is how the holes of garbage rows are placed
+	Holes game.HolePolicy
+	// MaxGarbagePerLock caps the garbage rising after a lock, 8 if zero
+	MaxGarbagePerLock int
+	// Seed returns the seed of a match, the current time if nil
+	Seed func() uint64
+	// Game is the rules of the games of the players
+	Game game.Config
+	// Verify re-simulates the game of every player from its inputs. A player whose locks do not match
+	// the simulation is disqualified, and attacks are computed from the simulated scores.
+	Verify bool
+	// GarbageGrace is the number of frames a verified player has to raise the garbage sent to it, counted from
+	// the latest frame of its game the server has. It covers the frames played until the garbage reaches the player.
+	// 3s of frames if zero.
+	GarbageGrace uint64
+	// OnMatchEnd is called with the log of every match that is over. It runs without any lock of the match
+	// on the handler of the player who ended it, blocking delays that handler alone, e.g. Profiles.RecordMatch saving the log.
+	OnMatchEnd func(*MatchLog)
+	// SendQueue is the number of messages queued for a player, a player falling further behind is disconnected. 64 if zero.
+	SendQueue int
+	// Mode names the matches in their logs, "versus" if empty
+	Mode string
+	// Ranked marks the matches as rated in their logs
+	Ranked bool
+	// Replays records verified matches if set, the server only has the inputs of the players of those
+	Replays *Replays
+	// Spectators publishes the matches if set, they are only published when Verify is set
+	// as the server has the games of the players from their inputs alone
+	Spectators *Spectators
+	// RoomID returns the room spectators watch a match of the players with, a new id if nil or empty.
+	// Set it to Lobby.RoomID to watch the matches of the rooms of a lobby.
+	RoomID func(players []string) string
+}
+
+func (c VersusConfig) withDefaults() VersusConfig {
+	if c.Players < 2 {
+		c.Players = 2
+	}
+	if c.MaxGarbagePerLock <= 0 {
+		c.MaxGarbagePerLock = 8
+	}
+	if c.SendQueue <= 0 {
+		c.SendQueue = 64
+	}
+	if c.GarbageGrace == 0 {
+		c.GarbageGrace = 3 * game.FramesPerSecond
+	}
+	if c.Seed == nil {
+		c.Seed = func() uint64 {
+			return uint64(time.Now().UnixNano())
+		}
+	}
+	if c.Mode == "" {
+		c.Mode = "versus"
+	}
+	return c
+}
+
+// Versus pairs the players of its handler into matches where line clears send garbage to opponents
+type Versus struct {
+	config  VersusConfig
+	logger  *zap.Logger
+	mux     sync.Mutex
+	waiting []*versusPlayer
+}
+
+// NewVersus returns a versus mode, register Handler to serve it
+func NewVersus(config VersusConfig, logger *zap.Logger) *Versus {
+	return &Versus{
+		config: config.withDefaults(),
+		logger: logger,
+	}
+}
+
+type versusPlayer struct {
+	stream   *ServerStream
+	name     string
+	matched  chan *versusMatch
+	queue    *sendQueue // closed once the match is over
+	garbage  game.GarbageQueue
+	holes    *game.Holes
+	alive    bool
+	target   int        // the opponent attacked next, round robin
+	sim      *versusSim // nil unless verified
+	snapshot uint64     // frame of the latest snapshot of the game of the player sent to spectators
+}
+
+type versusMatch struct {
+	mux     sync.Mutex
+	config  VersusConfig
+	players []*versusPlayer
+	alive   int
+	over    bool
+	ended   bool            // OnMatchEnd is called
+	replay  *game.Replay    // saved once the match is over, nil unless verified and recorded
+	closing []*ServerStream // streams of disqualified players, closed once the lock is released
+	log     *MatchLog
+	watched *spectatedMatch // nil unless verified and spectated
+	logger  *zap.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Handler serves a player, it returns when the match of the player is over
+func (v *Versus) Handler() ServerHandler {
+	return func(ctx context.Context, stream *ServerStream) {
+		p := &versusPlayer{
+			stream:  stream,
+			name:    stream.User().UserName,
+			matched: make(chan *versusMatch, 1),
+		}
+		v.join(p)
+
+		var m *versusMatch
+		select {
+		case m = <-p.matched:
+		case <-ctx.Done():
+		case <-stream.Done():
+		}
+		if m == nil {
+			if !v.leave(p) {
+				// matched while leaving, the match sees the player gone
+				m = <-p.matched
+				m.eliminate(p)
+			}
+			return
+		}
+		m.serve(ctx, p)
+	}
+}
+
+func (v *Versus) join(p *versusPlayer) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	v.waiting = append(v.waiting, p)
+
+	// a user who joined twice is not matched against itself
+	var players, waiting []*versusPlayer
+	names := make(map[string]bool, v.config.Players)
+	for _, w := range v.waiting {
+		if len(players) < v.config.Players && !names[w.name] {
+			names[w.name] = true
+			players = append(players, w)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	if len(players) < v.config.Players {
+		return
+	}
+	v.waiting = waiting
+	v.start(players)
+}
+
+// leave removes a player that is not matched yet, it returns false if the player was matched
+func (v *Versus) leave(p *versusPlayer) bool {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	for i, w := range v.waiting {
+		if w == p {
+			v.waiting = append(v.waiting[:i], v.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Versus) start(players []*versusPlayer) {
+	seed := v.config.Seed()
+	m := &versusMatch{
+		config:  v.config,
+		players: players,
+		alive:   len(players),
+		logger:  v.logger,
+		log: &MatchLog{
+			Mode:   v.config.Mode,
+			Ranked: v.config.Ranked,
+			Seed:   seed,
+			Start:  time.Now(),
+			Places: make(map[string]int),
+		},
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	names := make([]string, len(players))
+	for i, p := range players {
+		names[i] = p.name
+		p.alive = true
+		p.target = (i + 1) % len(players)
+		p.holes = game.NewHoles(v.config.Holes, seed+uint64(i)+1)
+		p.queue = newSendQueue(p.stream, v.config.SendQueue, v.logger.With(zap.String("player", p.name)))
+		if v.config.Verify {
+			p.sim = newVersusSim(p.name, v.config.Game, seed, v.config.GarbageGrace)
+		}
+	}
+	m.log.Players = names
+	var room string
+	if v.config.Spectators != nil && v.config.Verify {
+		if v.config.RoomID != nil {
+			room = v.config.RoomID(names)
+		}
+		if room == "" {
+			room = randomID()
+		}
+		m.watched = v.config.Spectators.open(room, names)
+		for _, p := range players {
+			m.publishSnapshot(p)
+		}
+	}
+	v.logger.Info("versus match started", zap.Strings("players", names), zap.Uint64("seed", seed), zap.String("room", room))
+
+	m.broadcast(&VersusMessage{Type: VersusStart, Players: names, Room: room, Seed: seed})
+	for _, p := range players {
+		p.matched <- m
+	}
+}
+
+// serve handles the messages of a player until the match is over
+func (m *versusMatch) serve(ctx context.Context, p *versusPlayer) {
+	defer p.queue.flush(ctx)
+	defer m.eliminate(p)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		var msg VersusMessage
+		if err := p.stream.RecvMsgContext(ctx, &msg); err != nil {
+			if !xerrors.Is(err, context.Canceled) {
+				m.logger.Info("versus player left", zap.String("player", p.name), zap.Error(err))
+			}
+			return
+		}
+		switch msg.Type {
+		case VersusInput:
+			m.input(p, msg.Inputs)
+		case VersusLock:
+			if msg.Score == nil {
+				m.logger.Warn("lock without score", zap.String("player", p.name))
+				continue
+			}
+			m.lock(p, msg.Frame, *msg.Score)
+		case VersusTopOut:
+			m.eliminate(p)
+		default:
+			m.logger.Warn("unexpected versus message", zap.String("player", p.name), zap.String("type", string(msg.Type)))
+		}
+	}
+}
+
+// lock sends the attack of a lock to an opponent after cancelling the garbage queued for the player,
+// garbage rises into the well of the player when the lock cleared no lines
+func (m *versusMatch) lock(p *versusPlayer, frame uint64, score game.ScoreEvent) {
+	m.mux.Lock()
+	defer m.unlock()
+	if !p.alive {
+		return
+	}
+	if p.sim != nil {
+		simulated, err := p.sim.lock(frame, score)
+		if err != nil {
+			m.disqualify(p, err)
+			return
+		}
+		score = simulated
+		m.publish(p)
+	}
+	m.broadcast(&VersusMessage{Type: VersusScore, Player: p.name, Score: &score})
+
+	if attack := p.garbage.Cancel(game.Attack(score)); attack > 0 {
+		if target := m.nextTarget(p); target != nil {
+			target.garbage.Push(attack)
+			m.broadcast(&VersusMessage{Type: VersusAttack, Player: p.name, Target: target.name, Lines: attack})
+		}
+	}
+
+	if score.Lines > 0 {
+		return
+	}
+	var holes []int
+	for _, lines := range p.garbage.Take(m.config.MaxGarbagePerLock) {
+		holes = append(holes, p.holes.Next(lines)...)
+	}
+	if len(holes) > 0 {
+		msg := &VersusMessage{Type: VersusGarbage, Player: p.name, Holes: holes}
+		if p.sim != nil {
+			msg.Frame = p.sim.sendGarbage(holes)
+		}
+		m.broadcast(msg)
+	}
+}
+
+// input steps the simulation of a player with its inputs
+func (m *versusMatch) input(p *versusPlayer, inputs []InputMessage) {
+	m.mux.Lock()
+	defer m.unlock()
+	if !p.alive || p.sim == nil {
+		return
+	}
+	for _, in := range inputs {
+		if err := p.sim.input(in); err != nil {
+			m.disqualify(p, err)
+			return
+		}
+	}
+	m.publish(p)
+}
+
+// disqualify takes out a player whose game diverged from the simulation, it is disconnected once the match is unlocked
+func (m *versusMatch) disqualify(p *versusPlayer, err error) {
+	m.logger.Warn("versus player diverged", zap.String("player", p.name), zap.Error(err))
+	m.eliminateLocked(p, err.Error())
+	m.closing = append(m.closing, p.stream)
+}
+
+func (m *versusMatch) nextTarget(p *versusPlayer) *versusPlayer {
+	for range m.players {
+		target := m.players[p.target]
+		p.target = (p.target + 1) % len(m.players)
+		if target != p && target.alive {
+			return target
+		}
+	}
+	return nil
+}
+
+// eliminate takes a player out of the match, the match is over when a player is left
+func (m *versusMatch) eliminate(p *versusPlayer) {
+	m.mux.Lock()
+	defer m.unlock()
+	m.eliminateLocked(p, "")
+}
+
+// unlock unlocks the match. Once the match is over it saves the replay and calls OnMatchEnd,
+// neither the write of the replay nor the hook runs under the lock.
+func (m *versusMatch) unlock() {
+	end := m.over && !m.ended
+	m.ended = m.over
+	closing := m.closing
+	m.closing = nil
+	m.mux.Unlock()
+	// closing a stream may write to the client, a client that does not read must not hold the match
+	for _, stream := range closing {
+		stream.Close()
+	}
+	if !end {
+		return
+	}
+	if m.replay != nil {
+		m.saveReplay()
+	}
+	if m.config.OnMatchEnd != nil {
+		m.config.OnMatchEnd(m.log)
+	}
+}
+
+func (m *versusMatch) eliminateLocked(p *versusPlayer, reason string) {
+	if !p.alive {
+		return
+	}
+	p.alive = false
+	m.log.Places[p.name] = m.alive
+	m.broadcast(&VersusMessage{Type: VersusEliminated, Player: p.name, Place: m.alive, Reason: reason})
+	m.alive--
+	if m.alive > 1 {
+		return
+	}
+
+	end := &VersusMessage{Type: VersusEnd}
+	for _, w := range m.players {
+		if w.alive {
+			w.alive = false
+			end.Winner = w.name
+			m.log.Places[w.name] = 1
+		}
+	}
+	m.broadcast(end)
+	m.over = true
+	for _, w := range m.players {
+		w.queue.close()
+	}
+	m.logger.Info("versus match is over", zap.String("winner", end.Winner))
+	m.cancel()
+
+	m.log.End = time.Now()
+	m.log.Winner = end.Winner
+	for _, w := range m.players {
+		if w.sim == nil {
+			continue
+		}
+		verdict := Verdict{Player: w.name, Valid: w.sim.err == nil}
+		var diverged *divergenceError
+		if xerrors.As(w.sim.err, &diverged) {
+			verdict.Frame = diverged.frame
+			verdict.Reason = diverged.Error()
+		}
+		m.log.Verdicts = append(m.log.Verdicts, verdict)
+	}
+	m.recordReplay()
+	if m.watched != nil {
+		for _, w := range m.players {
+			m.publishSnapshot(w)
+		}
+		m.watched.close()
+	}
+}
+
+// publish sends spectators what happened in the game of a player since it was last published,
+// and a snapshot every SnapshotEvery frames
+func (m *versusMatch) publish(p *versusPlayer) {
+	events := p.sim.events
+	p.sim.events = nil
+	if m.watched == nil {
+		return
+	}
+	if len(events) > 0 {
+		m.watched.publish(&StateMessage{Type: StateDelta, Player: p.name, Frame: p.sim.game.Frame(), Events: events})
+	}
+	every := m.watched.config.SnapshotEvery
+	if p.sim.game.Frame()/every > p.snapshot/every {
+		m.publishSnapshot(p)
+	}
+}
+
+func (m *versusMatch) publishSnapshot(p *versusPlayer) {
+	snapshot := p.sim.game.Snapshot()
+	p.snapshot = snapshot.Frame
+	m.watched.publish(&StateMessage{Type: StateSnapshot, Player: p.name, Frame: snapshot.Frame, Seed: m.log.Seed, Snapshot: &snapshot})
+}
+
+// recordReplay builds the replay of a verified match to be saved into the replays of the config
+func (m *versusMatch) recordReplay() {
+	if m.config.Replays == nil || !m.config.Verify {
+		return
+	}
+	m.replay = &game.Replay{RulesVersion: game.RulesVersion, Config: m.config.Game, Seed: m.log.Seed}
+	for _, p := range m.players {
+		m.replay.Players = append(m.replay.Players, p.sim.rec.Player())
+	}
+}
+
+// saveReplay saves the replay of the match that is over, it is called once by the player who ended the match
+func (m *versusMatch) saveReplay() {
+	id, err := m.config.Replays.Save(m.replay)
+	if err != nil {
+		m.logger.Warn("failed to save replay", zap.Error(err))
+		return
+	}
+	m.log.Replay = id
+}
+
+// broadcast queues a message for every player, it never waits for a player
+func (m *versusMatch) broadcast(msg *VersusMessage) {
+	for _, p := range m.players {
+		p.queue.send(msg)
+	}
+}
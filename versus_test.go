@@ -0,0 +1,235 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// expectVersus receives messages until one of the type, it fails on the way if another message is not expected
+func expectVersus(t *testing.T, stream *ClientStream, typ VersusMessageType) *VersusMessage {
+	t.Helper()
+	for {
+		var msg VersusMessage
+		if err := stream.RecvMsg(&msg); err != nil {
+			t.Fatalf("RecvMsg() error = %v, waiting for %s", err, typ)
+		}
+		if msg.Type == typ {
+			return &msg
+		}
+	}
+}
+
+func TestVersus(t *testing.T) {
+	addr := "127.0.0.1:31122"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	versus := NewVersus(VersusConfig{
+		Holes: game.HolePerAttack,
+		Seed: func() uint64 {
+			return 42
+		},
+	}, zap.NewNop())
+	server.RegisterHandler("versus", versus.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	join := func(user string) *ClientStream {
+		cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		stream, err := cli.NewStreamSession(context.Background(), "versus", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stream
+	}
+	alice := join("alice")
+	bob := join("bob")
+
+	for _, stream := range []*ClientStream{alice, bob} {
+		start := expectVersus(t, stream, VersusStart)
+		// the match is not spectated, there is no room to watch it in
+		if start.Seed != 42 || !reflect.DeepEqual(start.Players, []string{"alice", "bob"}) || start.Room != "" {
+			t.Errorf("start = %+v", start)
+		}
+	}
+
+	lock := func(stream *ClientStream, score game.ScoreEvent) {
+		if err := stream.SendMsg(&VersusMessage{Type: VersusLock, Score: &score}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a tetris sends 4 lines to bob
+	lock(alice, game.ScoreEvent{Lines: 4, Combo: 0})
+	if attack := expectVersus(t, bob, VersusAttack); attack.Player != "alice" || attack.Target != "bob" || attack.Lines != 4 {
+		t.Errorf("attack = %+v", attack)
+	}
+	if score := expectVersus(t, alice, VersusScore); score.Player != "alice" || score.Score.Lines != 4 {
+		t.Errorf("score = %+v", score)
+	}
+
+	// bob cancels 2 of them with a T-spin single
+	lock(bob, game.ScoreEvent{Lines: 1, TSpin: game.TSpinFull, Combo: -1})
+	if score := expectVersus(t, alice, VersusScore); score.Player != "bob" {
+		t.Errorf("score = %+v", score)
+	}
+
+	// the lines left rise when bob locks without clearing
+	lock(bob, game.ScoreEvent{Combo: -1})
+	garbage := expectVersus(t, alice, VersusGarbage)
+	if garbage.Player != "bob" || len(garbage.Holes) != 2 {
+		t.Errorf("garbage = %+v, want 2 rows for bob", garbage)
+	}
+	if got := expectVersus(t, bob, VersusGarbage); !reflect.DeepEqual(got, garbage) {
+		t.Errorf("garbage = %+v, want %+v", got, garbage)
+	}
+
+	if err := bob.SendMsg(&VersusMessage{Type: VersusTopOut}); err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range []*ClientStream{alice, bob} {
+		if eliminated := expectVersus(t, stream, VersusEliminated); eliminated.Player != "bob" || eliminated.Place != 2 {
+			t.Errorf("eliminated = %+v", eliminated)
+		}
+		if end := expectVersus(t, stream, VersusEnd); end.Winner != "alice" {
+			t.Errorf("end = %+v", end)
+		}
+	}
+}
+
+func TestVersus_join(t *testing.T) {
+	ended := make(chan *MatchLog, 1)
+	var m *versusMatch
+	v := NewVersus(VersusConfig{
+		OnMatchEnd: func(log *MatchLog) {
+			// the hook runs outside the lock of the match
+			m.mux.Lock()
+			m.mux.Unlock()
+			ended <- log
+		},
+	}, zap.NewNop())
+	player := func(name string) *versusPlayer {
+		return &versusPlayer{stream: discardStream(t), name: name, matched: make(chan *versusMatch, 1)}
+	}
+
+	alice, alice2, bob := player("alice"), player("alice"), player("bob")
+	v.join(alice)
+	v.join(alice2)
+	if len(alice.matched) != 0 || len(v.waiting) != 2 {
+		t.Fatalf("alice is matched against itself")
+	}
+	v.join(bob)
+	m = <-alice.matched
+	if got := <-bob.matched; got != m || !reflect.DeepEqual(m.log.Players, []string{"alice", "bob"}) {
+		t.Errorf("players = %v", m.log.Players)
+	}
+	if len(v.waiting) != 1 || v.waiting[0] != alice2 {
+		t.Errorf("the second alice must wait for an opponent")
+	}
+
+	m.eliminate(bob)
+	select {
+	case log := <-ended:
+		if log.Winner != "alice" {
+			t.Errorf("winner = %q", log.Winner)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnMatchEnd is not called")
+	}
+	<-alice.queue.written
+}
+
+func TestVersusMatch_SlowPlayer(t *testing.T) {
+	slow := &versusPlayer{stream: stuckStream(t), name: "slow", alive: true}
+	m := &versusMatch{players: []*versusPlayer{slow}, logger: zap.NewNop()}
+	slow.queue = newSendQueue(slow.stream, 4, zap.NewNop())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		for i := 0; i < 100; i++ {
+			m.broadcast(&VersusMessage{Type: VersusScore, Player: "fast"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast is blocked by a player that does not read")
+	}
+	select {
+	case <-slow.stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("a player falling behind must be disconnected")
+	}
+	<-slow.queue.written
+}
+
+func TestVersusMatch_DisqualifySlowPlayer(t *testing.T) {
+	slow := &versusPlayer{stream: stuckResumableStream(t), name: "slow", alive: true}
+	fast := &versusPlayer{stream: discardStream(t), name: "fast", alive: true}
+	players := []*versusPlayer{slow, fast}
+	for _, p := range players {
+		p.queue = newSendQueue(p.stream, 4, zap.NewNop())
+		p.sim = newVersusSim(p.name, game.DefaultConfig, 1, 60)
+	}
+	m := &versusMatch{
+		config:  VersusConfig{Verify: true},
+		players: players,
+		alive:   len(players),
+		logger:  zap.NewNop(),
+		log:     &MatchLog{Places: make(map[string]int)},
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	defer m.cancel()
+
+	// the input diverges, the stream of the player is closed while the client does not read
+	go m.input(slow, []InputMessage{{Frame: 2}, {Frame: 1}})
+	over := make(chan struct{})
+	go func() {
+		defer close(over)
+		for {
+			m.mux.Lock()
+			done := m.over
+			m.mux.Unlock()
+			if done {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-over:
+	case <-time.After(time.Second):
+		t.Fatal("the match is blocked by a disqualified player that does not read")
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.log.Places["slow"] != 2 {
+		t.Errorf("places = %v, want the diverged player out", m.log.Places)
+	}
+}
@@ -0,0 +1,172 @@
+package tetris
+
+import (
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"golang.org/x/xerrors"
+)
+
+// MatchLog is the record of a versus match
+type MatchLog struct {
+	Mode    string
+	Ranked  bool
+	Players []string
+	Seed    uint64
+	Start   time.Time
+	End     time.Time
+	Winner  string
+	Places  map[string]int // player -> place, 1 is the winner
+	// Verdicts are the results of re-simulating the games of the players, empty unless VersusConfig.Verify
+	Verdicts []Verdict
+	// Replay is the id of the replay of the match, empty unless VersusConfig.Replays
+	Replay string
+}
+
+func (l *MatchLog) clone() MatchLog {
+	c := *l
+	c.Players = append([]string(nil), l.Players...)
+	c.Places = make(map[string]int, len(l.Places))
+	for user, place := range l.Places {
+		c.Places[user] = place
+	}
+	c.Verdicts = append([]Verdict(nil), l.Verdicts...)
+	return c
+}
+
+// played reports whether the user is a player of the match
+func (l *MatchLog) played(user string) bool {
+	for _, p := range l.Players {
+		if p == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Verdict is whether the game a player claimed matches its inputs
+type Verdict struct {
+	Player string
+	Valid  bool
+	Frame  uint64 // the frame the game diverged at
+	Reason string
+}
+
+// versusSim re-simulates the game of a player from its inputs
+type versusSim struct {
+	game    *game.Game
+	rec     *game.Recorder
+	frame   uint64 // frame of the last input
+	grace   uint64 // frames the player has to raise garbage
+	garbage []sentGarbage
+	scores  []game.ScoreEvent
+	events  []game.Event // events not published to spectators yet
+	err     error        // why the game diverged
+}
+
+// sentGarbage is garbage sent to the player it has not raised yet
+type sentGarbage struct {
+	holes []int
+	due   uint64 // the last frame the player may raise it at
+}
+
+func newVersusSim(name string, config game.Config, seed, grace uint64) *versusSim {
+	return &versusSim{game: game.New(config, seed), rec: game.NewRecorder(name), grace: grace}
+}
+
+func (s *versusSim) diverged(frame uint64, format string, args ...interface{}) error {
+	if s.err == nil {
+		s.err = &divergenceError{frame: frame, err: xerrors.Errorf(format, args...)}
+	}
+	return s.err
+}
+
+type divergenceError struct {
+	frame uint64
+	err   error
+}
+
+func (e *divergenceError) Error() string {
+	return e.err.Error()
+}
+
+// sendGarbage records garbage the player must raise, it returns the last frame the player may raise it at.
+// The player is given the grace from the latest frame of its game the server has, as it keeps playing
+// until the garbage reaches it.
+func (s *versusSim) sendGarbage(holes []int) uint64 {
+	due := s.frame + s.grace
+	s.garbage = append(s.garbage, sentGarbage{holes: holes, due: due})
+	return due
+}
+
+// overdue reports whether garbage is left past the frame it is due at
+func (s *versusSim) overdue(frame uint64) bool {
+	return len(s.garbage) > 0 && frame > s.garbage[0].due
+}
+
+// input steps the game to the frame of the input and applies it
+func (s *versusSim) input(in InputMessage) error {
+	if s.err != nil {
+		return s.err
+	}
+	if in.Frame <= s.frame {
+		return s.diverged(in.Frame, "input for frame %d after frame %d", in.Frame, s.frame)
+	}
+	if !in.Garbage && s.overdue(in.Frame) {
+		return s.diverged(in.Frame, "did not raise the garbage due at frame %d", s.garbage[0].due)
+	}
+	s.frame = in.Frame
+	s.stepTo(in.Frame - 1)
+	if in.Garbage {
+		if len(s.garbage) == 0 {
+			return s.diverged(in.Frame, "raised garbage that was not sent")
+		}
+		s.events = append(s.events, s.game.AddGarbage(s.garbage[0].holes)...)
+		s.rec.Garbage(s.garbage[0].holes)
+		s.garbage = s.garbage[1:]
+	}
+	s.step(in.Input)
+	return nil
+}
+
+func (s *versusSim) stepTo(frame uint64) {
+	for s.game.Frame() < frame && s.game.Over() == game.TopOutNone {
+		s.step(0)
+	}
+}
+
+func (s *versusSim) step(in game.Input) {
+	events := s.game.Step(in)
+	for _, e := range events {
+		if e.Type == game.EventScore {
+			s.scores = append(s.scores, e.Score)
+		}
+	}
+	s.events = append(s.events, events...)
+	s.rec.Step(s.game.Frame(), in)
+}
+
+// lock checks a lock the player claims against the simulation, it returns the score of the simulation
+func (s *versusSim) lock(frame uint64, claimed game.ScoreEvent) (game.ScoreEvent, error) {
+	if s.err != nil {
+		return game.ScoreEvent{}, s.err
+	}
+	if frame < s.frame {
+		return game.ScoreEvent{}, s.diverged(frame, "lock at frame %d after an input for frame %d", frame, s.frame)
+	}
+	if s.overdue(frame) {
+		return game.ScoreEvent{}, s.diverged(frame, "did not raise the garbage due at frame %d", s.garbage[0].due)
+	}
+	s.stepTo(frame)
+	s.frame = frame
+
+	scores := s.scores
+	s.scores = nil
+	if len(scores) != 1 || scores[0].Frame != frame {
+		return game.ScoreEvent{}, s.diverged(frame, "claimed a lock at frame %d, simulated %d locks", frame, len(scores))
+	}
+	if scores[0] != claimed {
+		return game.ScoreEvent{}, s.diverged(frame, "claimed score %+v, simulated %+v", claimed, scores[0])
+	}
+	return scores[0], nil
+}
@@ -0,0 +1,524 @@
+package tetris
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vkg/tetris/game"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+)
+
+// versusClient plays a verified versus match with a local game
+type versusClient struct {
+	t      *testing.T
+	stream *ClientStream
+	seed   uint64
+	game   *game.Game
+	rec    *game.Recorder
+	inputs []InputMessage
+	raised bool // garbage is raised before the next input
+}
+
+func (c *versusClient) start(seed uint64) {
+	c.seed = seed
+	c.game = game.New(game.Config{}, seed)
+	c.rec = game.NewRecorder("")
+}
+
+// play steps the local game with the input, it sends the inputs and the lock when a piece locks.
+// cheat changes the score claimed for the lock. It returns the score of the lock.
+func (c *versusClient) play(in game.Input, cheat func(*game.ScoreEvent)) (locked *game.ScoreEvent) {
+	c.t.Helper()
+	events := c.game.Step(in)
+	c.rec.Step(c.game.Frame(), in)
+	if in != 0 || c.raised {
+		c.inputs = append(c.inputs, InputMessage{Frame: c.game.Frame(), Input: in, Garbage: c.raised})
+		c.raised = false
+	}
+	for _, e := range events {
+		if e.Type != game.EventScore {
+			continue
+		}
+		scored, score := e.Score, e.Score
+		locked = &scored
+		if cheat != nil {
+			cheat(&score)
+		}
+		if err := c.stream.SendMsg(&VersusMessage{Type: VersusInput, Inputs: c.inputs}); err != nil {
+			c.t.Fatal(err)
+		}
+		c.inputs = nil
+		if err := c.stream.SendMsg(&VersusMessage{Type: VersusLock, Frame: e.Frame, Score: &score}); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return locked
+}
+
+// raise adds the garbage sent to the player to the local game before the next input
+func (c *versusClient) raise(holes []int) {
+	c.game.AddGarbage(holes)
+	c.rec.Garbage(holes)
+	c.raised = true
+}
+
+// placeBest drops the active piece where it leaves the lowest board with the fewest holes,
+// preferring the placements clearing two lines or more. It returns the score of the lock.
+func (c *versusClient) placeBest() *game.ScoreEvent {
+	c.t.Helper()
+	var best []game.Input
+	bestCost := 0
+	for rotations := 0; rotations < 4; rotations++ {
+		for dx := -5; dx <= 5; dx++ {
+			var inputs []game.Input
+			for i := 0; i < rotations; i++ {
+				inputs = append(inputs, game.InputRotateCW)
+			}
+			for i := 0; i < dx; i++ {
+				inputs = append(inputs, game.InputRight)
+			}
+			for i := 0; i > dx; i-- {
+				inputs = append(inputs, game.InputLeft)
+			}
+			inputs = append(inputs, game.InputHardDrop)
+
+			g := c.clone()
+			lines := 0
+			for _, in := range inputs {
+				for _, e := range g.Step(in) {
+					if e.Type == game.EventScore {
+						lines = int(e.Score.Lines)
+					}
+				}
+			}
+			if g.Over() != game.TopOutNone {
+				continue
+			}
+			cost := boardCost(g.Board())
+			switch {
+			case lines >= 2:
+				cost -= 1000
+			case lines == 1:
+				cost += 30
+			}
+			if best == nil || cost < bestCost {
+				best, bestCost = inputs, cost
+			}
+		}
+	}
+	if best == nil {
+		c.t.Fatal("no placement left")
+	}
+	var locked *game.ScoreEvent
+	for _, in := range best {
+		if score := c.play(in, nil); score != nil {
+			locked = score
+		}
+	}
+	return locked
+}
+
+// clone plays the game recorded so far again
+func (c *versusClient) clone() *game.Game {
+	c.t.Helper()
+	replay := &game.Replay{RulesVersion: game.RulesVersion, Seed: c.seed, Players: []game.ReplayPlayer{c.rec.Player()}}
+	p, err := game.NewPlayback(replay)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	p.Seek(c.game.Frame())
+	return p.Game(0)
+}
+
+// boardCost grows with the heights of the columns, the holes under them and how uneven they are
+func boardCost(b game.Board) int {
+	cost, prev := 0, -1
+	for x := 0; x < game.Width; x++ {
+		height := 0
+		for y := game.Height - 1; y >= 0 && height == 0; y-- {
+			if b.Cell(x, y) != game.CellEmpty {
+				height = y + 1
+			}
+		}
+		for y := 0; y < height; y++ {
+			if b.Cell(x, y) == game.CellEmpty {
+				cost += 20
+			}
+		}
+		cost += height
+		if prev >= 0 {
+			if height > prev {
+				cost += height - prev
+			} else {
+				cost += prev - height
+			}
+		}
+		prev = height
+	}
+	return cost
+}
+
+func TestVersus_Verify(t *testing.T) {
+	addr := "127.0.0.1:31125"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logs := make(chan *MatchLog, 1)
+	replays := NewReplays(ReplaysConfig{}, zap.NewNop())
+	versus := NewVersus(VersusConfig{
+		Verify: true,
+		OnMatchEnd: func(log *MatchLog) {
+			logs <- log
+		},
+		Replays: replays,
+	}, zap.NewNop())
+	server.RegisterHandler("versus", versus.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	join := func(user string) *versusClient {
+		cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		stream, err := cli.NewStreamSession(context.Background(), "versus", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &versusClient{t: t, stream: stream}
+	}
+	alice := join("alice")
+	bob := join("bob")
+	for _, c := range []*versusClient{alice, bob} {
+		start := expectVersus(t, c.stream, VersusStart)
+		c.start(start.Seed)
+	}
+
+	// alice plays honestly
+	for i := 0; i < 3; i++ {
+		alice.play(game.InputLeft, nil)
+		alice.play(game.InputHardDrop, nil)
+		if score := expectVersus(t, bob.stream, VersusScore); score.Player != "alice" {
+			t.Errorf("score = %+v", score)
+		}
+	}
+
+	// bob claims lines he did not clear
+	bob.play(game.InputRotateCW, nil)
+	bob.play(game.InputHardDrop, func(score *game.ScoreEvent) {
+		score.Lines = 4
+	})
+
+	eliminated := expectVersus(t, alice.stream, VersusEliminated)
+	if eliminated.Player != "bob" || eliminated.Reason == "" {
+		t.Errorf("eliminated = %+v, want bob disqualified", eliminated)
+	}
+	if end := expectVersus(t, alice.stream, VersusEnd); end.Winner != "alice" {
+		t.Errorf("end = %+v", end)
+	}
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		for {
+			var msg VersusMessage
+			if err := bob.stream.RecvMsg(&msg); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Error("bob must be disconnected")
+	}
+
+	var log *MatchLog
+	select {
+	case log = <-logs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("match log is not recorded")
+	}
+	if log.Winner != "alice" || log.Places["bob"] != 2 || len(log.Verdicts) != 2 {
+		t.Fatalf("log = %+v", log)
+	}
+	for _, v := range log.Verdicts {
+		switch v.Player {
+		case "alice":
+			if !v.Valid {
+				t.Errorf("verdict = %+v, want valid", v)
+			}
+		case "bob":
+			if v.Valid || v.Frame != 2 {
+				t.Errorf("verdict = %+v, want diverged at frame 2", v)
+			}
+		}
+	}
+
+	replay, err := replays.Load(log.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := game.NewPlayback(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Seek(alice.game.Frame())
+	if replay.Players[0].Name != "alice" || p.Game(0).Board() != alice.game.Board() || p.Game(0).Score() != alice.game.Score() {
+		t.Errorf("replay of alice = %+v, want her game", replay.Players[0])
+	}
+}
+
+func TestVersusSim_Garbage(t *testing.T) {
+	sim := newVersusSim("alice", game.Config{}, 5, 60)
+	local := game.New(game.Config{}, 5)
+	holes := []int{3, 3}
+
+	sim.sendGarbage(holes)
+	if err := sim.input(InputMessage{Frame: 2, Input: game.InputHardDrop, Garbage: true}); err != nil {
+		t.Fatal(err)
+	}
+	local.Step(0)
+	local.AddGarbage(holes)
+	var score game.ScoreEvent
+	for _, e := range local.Step(game.InputHardDrop) {
+		if e.Type == game.EventScore {
+			score = e.Score
+		}
+	}
+	if _, err := sim.lock(2, score); err != nil {
+		t.Errorf("lock() error = %v", err)
+	}
+	if sim.game.Board() != local.Board() {
+		t.Error("boards differ")
+	}
+	if got, want := sim.rec.Player().Inputs, []game.ReplayInput{{Frame: 2, Input: game.InputHardDrop, Garbage: holes}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded inputs = %+v, want %+v", got, want)
+	}
+
+	// garbage that was not sent
+	if err := sim.input(InputMessage{Frame: 3, Garbage: true}); err == nil {
+		t.Error("input() must fail")
+	}
+}
+
+func TestVersusSim_GarbageInFlight(t *testing.T) {
+	sim := newVersusSim("alice", game.Config{}, 5, 60)
+	local := game.New(game.Config{}, 5)
+	holes := []int{3, 3}
+	if due := sim.sendGarbage(holes); due != 60 {
+		t.Errorf("sendGarbage() = %d, want due at frame 60", due)
+	}
+
+	// the player locks before the garbage reaches it, and raises it afterwards
+	if err := sim.input(InputMessage{Frame: 2, Input: game.InputHardDrop}); err != nil {
+		t.Fatal(err)
+	}
+	local.Step(0)
+	var score game.ScoreEvent
+	for _, e := range local.Step(game.InputHardDrop) {
+		if e.Type == game.EventScore {
+			score = e.Score
+		}
+	}
+	if _, err := sim.lock(2, score); err != nil {
+		t.Fatalf("lock() error = %v", err)
+	}
+	if err := sim.input(InputMessage{Frame: 60, Garbage: true}); err != nil {
+		t.Fatal(err)
+	}
+	for local.Frame() < 59 {
+		local.Step(0)
+	}
+	local.AddGarbage(holes)
+	local.Step(0)
+	if sim.game.Board() != local.Board() {
+		t.Error("boards differ")
+	}
+}
+
+func TestVersusSim_IgnoredGarbage(t *testing.T) {
+	tests := []struct {
+		name string
+		play func(sim *versusSim) error
+	}{
+		{"input", func(sim *versusSim) error {
+			return sim.input(InputMessage{Frame: 61, Input: game.InputHardDrop})
+		}},
+		{"lock", func(sim *versusSim) error {
+			_, err := sim.lock(61, game.ScoreEvent{})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newVersusSim("alice", game.Config{}, 5, 60)
+			sim.sendGarbage([]int{3, 3})
+			if err := tt.play(sim); err == nil {
+				t.Fatal("a player that does not raise the garbage sent to it in time must be flagged")
+			}
+			var diverged *divergenceError
+			if !xerrors.As(sim.err, &diverged) {
+				t.Errorf("err = %v, want a divergence", sim.err)
+			}
+		})
+	}
+}
+
+func TestVersus_VerifyGarbage(t *testing.T) {
+	addr := "127.0.0.1:31135"
+	keyRegister := &mockedKeyRegister{
+		FindMock: func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			return SSHUser{UserName: conn.User()}, nil
+		},
+	}
+
+	server, err := NewSSHServer(zap.NewNop(), addr, []byte(testHostKey), keyRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logs := make(chan *MatchLog, 1)
+	replays := NewReplays(ReplaysConfig{}, zap.NewNop())
+	versus := NewVersus(VersusConfig{
+		Verify: true,
+		Seed: func() uint64 {
+			return 7
+		},
+		OnMatchEnd: func(log *MatchLog) {
+			logs <- log
+		},
+		Replays: replays,
+	}, zap.NewNop())
+	server.RegisterHandler("versus", versus.Handler())
+
+	go func() {
+		if err := server.Listen(context.Background()); err != nil {
+			panic(err)
+		}
+	}()
+
+	// the messages are read as they come so that a player busy playing is never disconnected
+	join := func(user string) (*versusClient, <-chan *VersusMessage) {
+		cli, err := NewSSHClient(user, addr, defaultPrivateKey(t), zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		stream, err := cli.NewStreamSession(context.Background(), "versus", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs := make(chan *VersusMessage, 1024)
+		go func() {
+			defer close(msgs)
+			for {
+				var msg VersusMessage
+				if err := stream.RecvMsg(&msg); err != nil {
+					return
+				}
+				msgs <- &msg
+			}
+		}()
+		return &versusClient{t: t, stream: stream}, msgs
+	}
+	expect := func(msgs <-chan *VersusMessage, typ VersusMessageType, player string) *VersusMessage {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					t.Fatalf("disconnected while waiting for %s", typ)
+				}
+				if msg.Type == VersusEliminated && msg.Reason != "" {
+					t.Fatalf("%s is disqualified: %s", msg.Player, msg.Reason)
+				}
+				if msg.Type == typ && msg.Player == player {
+					return msg
+				}
+			case <-timeout:
+				t.Fatalf("no %s of %s", typ, player)
+			}
+		}
+	}
+	alice, aliceMsgs := join("alice")
+	bob, bobMsgs := join("bob")
+	alice.start(expect(aliceMsgs, VersusStart, "").Seed)
+	bob.start(expect(bobMsgs, VersusStart, "").Seed)
+
+	// alice stacks pieces until a clear attacks bob
+	for pieces := 0; ; pieces++ {
+		if pieces == 100 {
+			t.Fatal("alice cleared no lines to attack with")
+		}
+		if score := alice.placeBest(); score != nil && game.Attack(*score) > 0 {
+			break
+		}
+	}
+	attack := expect(bobMsgs, VersusAttack, "alice")
+	if attack.Target != "bob" {
+		t.Fatalf("attack = %+v", attack)
+	}
+
+	// bob locks a piece, the garbage rises into his well, and he locks another one before the garbage reaches him
+	bob.play(game.InputHardDrop, nil)
+	bob.play(game.InputLeft, nil)
+	bob.play(game.InputHardDrop, nil)
+	garbage := expect(bobMsgs, VersusGarbage, "bob")
+	if len(garbage.Holes) != attack.Lines || garbage.Frame < bob.game.Frame() {
+		t.Fatalf("garbage = %+v, want %d lines due after frame %d", garbage, attack.Lines, bob.game.Frame())
+	}
+	bob.raise(garbage.Holes)
+	bob.play(game.InputRight, nil)
+	bob.play(game.InputHardDrop, nil)
+	expect(aliceMsgs, VersusScore, "bob")
+	if err := bob.stream.SendMsg(&VersusMessage{Type: VersusTopOut}); err != nil {
+		t.Fatal(err)
+	}
+	if end := expect(aliceMsgs, VersusEnd, ""); end.Winner != "alice" {
+		t.Errorf("end = %+v", end)
+	}
+
+	var log *MatchLog
+	select {
+	case log = <-logs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("match log is not recorded")
+	}
+	for _, v := range log.Verdicts {
+		if !v.Valid {
+			t.Errorf("verdict = %+v, want valid", v)
+		}
+	}
+	replay, err := replays.Load(log.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := game.NewPlayback(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Seek(bob.game.Frame())
+	if replay.Players[1].Name != "bob" || p.Game(1).Board() != bob.game.Board() {
+		t.Errorf("replay of bob = %+v, want his game with the garbage", replay.Players[1])
+	}
+}